@@ -0,0 +1,496 @@
+package main
+
+import (
+    "bufio"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// The users are kept by the name, every command checks the permissions of the current rules
+// of the user, so a change applies to the clients already authenticated. The ACL file has
+// one "user <name> <rules ...>" line per user, the same rules as ACL SETUSER.
+
+var (
+    ErrAclNoPermKey  = &CodeErrorReply{"NOPERM", "this user has no permissions to access one of the keys used as arguments"}
+    ErrAclDelDefault = fmt.Errorf("The 'default' user cannot be removed")
+)
+
+// User is an ACL user, the allowed commands are resolved from the command rules
+type User struct {
+    Name      string
+    Enabled   bool
+    NoPass    bool
+    Passwords map[string]bool // the SHA-256 hex of the passwords
+    AllKeys   bool
+    Patterns  []string
+    Allowed   map[string]bool
+    // the command rules as applied, to describe the user
+    CommandRules []string
+}
+
+func NewUser(name string) *User {
+    return &User{
+        Name:      name,
+        Passwords: make(map[string]bool),
+        Allowed:   make(map[string]bool),
+    }
+}
+
+func (u *User) clone() *User {
+    c := *u
+    c.Passwords = make(map[string]bool, len(u.Passwords))
+    for hash := range u.Passwords {
+        c.Passwords[hash] = true
+    }
+    c.Allowed = make(map[string]bool, len(u.Allowed))
+    for name := range u.Allowed {
+        c.Allowed[name] = true
+    }
+    c.Patterns = append([]string{}, u.Patterns...)
+    c.CommandRules = append([]string{}, u.CommandRules...)
+    return &c
+}
+
+// Apply changes the user by one ACL rule
+func (u *User) Apply(rule string) error {
+    lower := strings.ToLower(rule)
+    switch {
+    case lower == "on":
+        u.Enabled = true
+    case lower == "off":
+        u.Enabled = false
+    case lower == "nopass":
+        u.NoPass = true
+        u.Passwords = make(map[string]bool)
+    case lower == "resetpass":
+        u.NoPass = false
+        u.Passwords = make(map[string]bool)
+    case lower == "allkeys":
+        u.AllKeys = true
+        u.Patterns = nil
+    case lower == "resetkeys":
+        u.AllKeys = false
+        u.Patterns = nil
+    case lower == "allcommands":
+        return u.Apply("+@all")
+    case lower == "nocommands":
+        return u.Apply("-@all")
+    case lower == "reset":
+        *u = *NewUser(u.Name)
+        return u.Apply("-@all")
+    case strings.HasPrefix(rule, ">"):
+        u.Passwords[__acl_hashPassword(rule[1:])] = true
+        u.NoPass = false
+    case strings.HasPrefix(rule, "<"):
+        delete(u.Passwords, __acl_hashPassword(rule[1:]))
+    case strings.HasPrefix(rule, "#"):
+        hash := strings.ToLower(rule[1:])
+        if !__acl_isHash(hash) {
+            return fmt.Errorf("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+        }
+        u.Passwords[hash] = true
+        u.NoPass = false
+    case strings.HasPrefix(rule, "!"):
+        delete(u.Passwords, strings.ToLower(rule[1:]))
+    case strings.HasPrefix(rule, "~"):
+        if rule == "~*" {
+            return u.Apply("allkeys")
+        }
+        if !u.AllKeys {
+            u.Patterns = append(u.Patterns, rule[1:])
+        }
+    case strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "-"):
+        return u.applyCommandRule(lower)
+    default:
+        return fmt.Errorf("Syntax error in ACL SETUSER modifier '%s'", rule)
+    }
+    return nil
+}
+
+func (u *User) applyCommandRule(rule string) error {
+    allow, name := rule[0] == '+', rule[1:]
+    if strings.HasPrefix(name, "@") {
+        category := name[1:]
+        if !__acl_isCategory(category) {
+            return fmt.Errorf("Unknown command or category name in ACL")
+        }
+        for i := range commandTable {
+            for _, c := range commandTable[i].Categories() {
+                if c == category {
+                    u.setAllowed(commandTable[i].Name, allow)
+                    break
+                }
+            }
+        }
+        if category == "all" {
+            // the previous rules make no difference any more
+            u.CommandRules = nil
+        }
+    } else {
+        if _, ok := commandSpecs[name]; !ok {
+            return fmt.Errorf("Unknown command or category name in ACL")
+        }
+        u.setAllowed(name, allow)
+    }
+    u.CommandRules = append(u.CommandRules, rule)
+    return nil
+}
+
+func (u *User) setAllowed(name string, allow bool) {
+    if allow {
+        u.Allowed[name] = true
+    } else {
+        delete(u.Allowed, name)
+    }
+}
+
+func (u *User) checkPassword(password string) bool {
+    if u.NoPass {
+        return true
+    }
+    hash := []byte(__acl_hashPassword(password))
+    matched := 0
+    for expected := range u.Passwords {
+        matched |= subtle.ConstantTimeCompare([]byte(expected), hash)
+    }
+    return matched == 1
+}
+
+func (u *User) canAccess(key []byte) bool {
+    if u.AllKeys {
+        return true
+    }
+    for _, pattern := range u.Patterns {
+        if globMatch([]byte(pattern), key) {
+            return true
+        }
+    }
+    return false
+}
+
+func (u *User) flags() []string {
+    flags := []string{"off"}
+    if u.Enabled {
+        flags[0] = "on"
+    }
+    if u.NoPass {
+        flags = append(flags, "nopass")
+    }
+    if u.AllKeys {
+        flags = append(flags, "allkeys")
+    }
+    return flags
+}
+
+func (u *User) passwordHashes() []string {
+    hashes := make([]string, 0, len(u.Passwords))
+    for hash := range u.Passwords {
+        hashes = append(hashes, hash)
+    }
+    sort.Strings(hashes)
+    return hashes
+}
+
+func (u *User) keyRules() []string {
+    if u.AllKeys {
+        return []string{"~*"}
+    }
+    rules := make([]string, len(u.Patterns))
+    for i, pattern := range u.Patterns {
+        rules[i] = "~" + pattern
+    }
+    return rules
+}
+
+func (u *User) commandRules() []string {
+    if len(u.CommandRules) == 0 {
+        return []string{"-@all"}
+    }
+    return u.CommandRules
+}
+
+// Describe returns the rules which recreate the user
+func (u *User) Describe() string {
+    rules := u.flags()
+    if u.AllKeys {
+        // allkeys is in the flags
+        rules = rules[:len(rules)-1]
+    }
+    for _, hash := range u.passwordHashes() {
+        rules = append(rules, "#"+hash)
+    }
+    rules = append(rules, u.keyRules()...)
+    rules = append(rules, u.commandRules()...)
+    return strings.Join(rules, " ")
+}
+
+type ACL struct {
+    sync.RWMutex
+    users map[string]*User
+    file  string
+}
+
+// NewACL creates the default user, protected by the password if not empty, then loads the file
+func NewACL(requirePass, file string) (*ACL, error) {
+    acl := &ACL{
+        users: make(map[string]*User),
+        file:  file,
+    }
+    rules := []string{"on", "~*", "+@all", "nopass"}
+    if requirePass != "" {
+        rules[3] = ">" + requirePass
+    }
+    user := NewUser(kDefaultUser)
+    for _, rule := range rules {
+        user.Apply(rule)
+    }
+    acl.users[kDefaultUser] = user
+    if file != "" {
+        if err := acl.load(); err != nil {
+            return nil, err
+        }
+    }
+    return acl, nil
+}
+
+// DefaultNoPass tells if the new clients are authenticated as the default user
+func (acl *ACL) DefaultNoPass() bool {
+    acl.RLock()
+    defer acl.RUnlock()
+    user := acl.users[kDefaultUser]
+    return user != nil && user.Enabled && user.NoPass
+}
+
+func (acl *ACL) Authenticate(name, password string) bool {
+    acl.RLock()
+    defer acl.RUnlock()
+    user, ok := acl.users[name]
+    return ok && user.Enabled && user.checkPassword(password)
+}
+
+// Check tells if the user can run the command on the keys in the arguments
+func (acl *ACL) Check(name string, spec *CommandSpec, args [][]byte) error {
+    acl.RLock()
+    defer acl.RUnlock()
+    user, ok := acl.users[name]
+    if !ok || !user.Allowed[spec.Name] {
+        return &CodeErrorReply{"NOPERM", fmt.Sprintf("this user has no permissions to run the '%s' command", spec.Name)}
+    }
+    for _, key := range spec.Keys(args) {
+        if !user.canAccess(key) {
+            return ErrAclNoPermKey
+        }
+    }
+    return nil
+}
+
+// SetUser applies all the rules or none of them, the user is created if not exists
+func (acl *ACL) SetUser(name string, rules []string) error {
+    acl.Lock()
+    defer acl.Unlock()
+    var user *User
+    if old, ok := acl.users[name]; ok {
+        user = old.clone()
+    } else {
+        user = NewUser(name)
+        user.Apply("-@all")
+    }
+    for _, rule := range rules {
+        if err := user.Apply(rule); err != nil {
+            return fmt.Errorf("Error in ACL SETUSER modifier '%s': %s", rule, err)
+        }
+    }
+    acl.users[name] = user
+    return acl.save()
+}
+
+func (acl *ACL) DelUser(names [][]byte) (int, error) {
+    acl.Lock()
+    defer acl.Unlock()
+    for _, name := range names {
+        if string(name) == kDefaultUser {
+            return 0, ErrAclDelDefault
+        }
+    }
+    count := 0
+    for _, name := range names {
+        if _, ok := acl.users[string(name)]; ok {
+            delete(acl.users, string(name))
+            count++
+        }
+    }
+    if count == 0 {
+        return 0, nil
+    }
+    return count, acl.save()
+}
+
+func (acl *ACL) GetUser(name string) (*User, bool) {
+    acl.RLock()
+    defer acl.RUnlock()
+    user, ok := acl.users[name]
+    if !ok {
+        return nil, false
+    }
+    return user.clone(), true
+}
+
+// List returns the users sorted by the name as the lines of the ACL file
+func (acl *ACL) List() []string {
+    acl.RLock()
+    defer acl.RUnlock()
+    names := make([]string, 0, len(acl.users))
+    for name := range acl.users {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    lines := make([]string, len(names))
+    for i, name := range names {
+        lines[i] = "user " + name + " " + acl.users[name].Describe()
+    }
+    return lines
+}
+
+// save writes the ACL file with the lock held, through a temporary file so it is never partial
+func (acl *ACL) save() error {
+    if acl.file == "" {
+        return nil
+    }
+    names := make([]string, 0, len(acl.users))
+    for name := range acl.users {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var content []byte
+    for _, name := range names {
+        content = append(content, "user "+name+" "+acl.users[name].Describe()+"\n"...)
+    }
+    tmpFile := acl.file + ".tmp"
+    if err := ioutil.WriteFile(tmpFile, content, 0600); err != nil {
+        return fmt.Errorf("failed to save the ACL file: %s", err)
+    }
+    if err := os.Rename(tmpFile, acl.file); err != nil {
+        return fmt.Errorf("failed to save the ACL file: %s", err)
+    }
+    return nil
+}
+
+func (acl *ACL) load() error {
+    f, err := os.Open(acl.file)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return err
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    for lineNo := 1; scanner.Scan(); lineNo++ {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+            continue
+        }
+        if len(fields) < 2 || fields[0] != "user" {
+            return fmt.Errorf("%s:%d: should start with user <username>", acl.file, lineNo)
+        }
+        user := NewUser(fields[1])
+        user.Apply("reset")
+        for _, rule := range fields[2:] {
+            if err := user.Apply(rule); err != nil {
+                return fmt.Errorf("%s:%d: %s", acl.file, lineNo, err)
+            }
+        }
+        acl.users[user.Name] = user
+    }
+    if err := scanner.Err(); err != nil {
+        return err
+    }
+    log.Printf("[ACL] Loaded %d users from %s", len(acl.users), acl.file)
+    return nil
+}
+
+// ACL SETUSER username [rule ...] | GETUSER username | DELUSER username [username ...] | LIST | WHOAMI
+func (s *Server) RedisAcl(request *Request, subCommand []byte, args ...[]byte) (interface{}, error) {
+    switch strings.ToLower(string(subCommand)) {
+    case "setuser":
+        if len(args) == 0 {
+            return nil, ErrWrongArgumentsCount
+        }
+        rules := make([]string, len(args)-1)
+        for i, rule := range args[1:] {
+            rules[i] = string(rule)
+        }
+        if err := s.acl.SetUser(string(args[0]), rules); err != nil {
+            return nil, err
+        }
+        return &StatusReply{"OK"}, nil
+    case "getuser":
+        if len(args) != 1 {
+            return nil, ErrWrongArgumentsCount
+        }
+        user, ok := s.acl.GetUser(string(args[0]))
+        if !ok {
+            return []interface{}(nil), nil
+        }
+        return []interface{}{
+            []byte("flags"), &MultiBulkReply{__acl_bytes(user.flags())},
+            []byte("passwords"), &MultiBulkReply{__acl_bytes(user.passwordHashes())},
+            []byte("commands"), []byte(strings.Join(user.commandRules(), " ")),
+            []byte("keys"), []byte(strings.Join(user.keyRules(), " ")),
+        }, nil
+    case "deluser":
+        if len(args) == 0 {
+            return nil, ErrWrongArgumentsCount
+        }
+        return s.acl.DelUser(args)
+    case "list":
+        return __acl_bytes(s.acl.List()), nil
+    case "whoami":
+        if request.Client == nil {
+            return nil, ErrNotFromClient
+        }
+        return []byte(request.Client.user), nil
+    }
+    return nil, ErrSyntax
+}
+
+func __acl_hashPassword(password string) string {
+    sum := sha256.Sum256([]byte(password))
+    return hex.EncodeToString(sum[:])
+}
+
+func __acl_isHash(hash string) bool {
+    if len(hash) != sha256.Size*2 {
+        return false
+    }
+    _, err := hex.DecodeString(hash)
+    return err == nil
+}
+
+func __acl_isCategory(category string) bool {
+    for i := range commandTable {
+        for _, c := range commandTable[i].Categories() {
+            if c == category {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func __acl_bytes(values []string) [][]byte {
+    data := make([][]byte, len(values))
+    for i := range values {
+        data[i] = []byte(values[i])
+    }
+    return data
+}
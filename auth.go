@@ -0,0 +1,135 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+var (
+    ErrNoAuth       = &CodeErrorReply{"NOAUTH", "Authentication required."}
+    ErrWrongPass    = &CodeErrorReply{"WRONGPASS", "invalid username-password pair or user is disabled."}
+    ErrNoPassConfig = fmt.Errorf("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+    ErrNoProto      = &CodeErrorReply{"NOPROTO", "unsupported protocol version"}
+    ErrHelloNoAuth  = &CodeErrorReply{"NOAUTH", "HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"}
+)
+
+// kDefaultUser is the user of AUTH with only the password, it is protected by RequirePass
+const kDefaultUser = "default"
+
+// AUTH [username] password
+func (s *Server) RedisAuth(request *Request, args ...[]byte) (interface{}, error) {
+    if request.Client == nil {
+        return nil, ErrNotFromClient
+    }
+    var username, password string
+    switch len(args) {
+    case 1:
+        username, password = kDefaultUser, string(args[0])
+        if s.acl.DefaultNoPass() {
+            return nil, ErrNoPassConfig
+        }
+    case 2:
+        username, password = string(args[0]), string(args[1])
+    default:
+        return nil, ErrSyntax
+    }
+    if !s.acl.Authenticate(username, password) {
+        return nil, ErrWrongPass
+    }
+    request.Client.setUser(username)
+    return &StatusReply{"OK"}, nil
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]] switches the protocol of the
+// client, nothing is changed if any option fails
+func (s *Server) RedisHello(request *Request, args ...[]byte) (interface{}, error) {
+    client := request.Client
+    if client == nil {
+        return nil, ErrNotFromClient
+    }
+    proto := client.Protocol()
+    if len(args) > 0 {
+        n, err := strconv.Atoi(string(args[0]))
+        if err != nil {
+            return nil, fmt.Errorf("Protocol version is not an integer or out of range")
+        }
+        if n != kProtoResp2 && n != kProtoResp3 {
+            return nil, ErrNoProto
+        }
+        proto = n
+    }
+    var username, password, name string
+    auth, setName := false, false
+    for i := 1; i < len(args); i++ {
+        switch strings.ToLower(string(args[i])) {
+        case "auth":
+            if i+2 >= len(args) {
+                return nil, ErrSyntax
+            }
+            username, password, auth = string(args[i+1]), string(args[i+2]), true
+            i += 2
+        case "setname":
+            if i+1 >= len(args) {
+                return nil, ErrSyntax
+            }
+            name, setName = string(args[i+1]), true
+            if err := checkClientName(name); err != nil {
+                return nil, err
+            }
+            i++
+        default:
+            return nil, ErrSyntax
+        }
+    }
+
+    if auth {
+        if !s.acl.Authenticate(username, password) {
+            return nil, ErrWrongPass
+        }
+        client.setUser(username)
+    } else if client.user == "" {
+        return nil, ErrHelloNoAuth
+    }
+    if setName {
+        client.setName(name)
+    }
+    client.proto.Set(int64(proto))
+    return &MapReply{[]interface{}{
+        []byte("server"), []byte("redis"),
+        []byte("version"), []byte(globalStat.version),
+        []byte("proto"), proto,
+        []byte("id"), int(client.Id),
+        []byte("mode"), []byte("standalone"),
+        []byte("role"), []byte("master"),
+        []byte("modules"), &ArrayReply{[]interface{}{}},
+    }}, nil
+}
+
+// QUIT replies OK, then the connection is closed
+func (s *Server) RedisQuit(request *Request) (interface{}, error) {
+    if request.Client != nil {
+        request.Client.quitting = true
+    }
+    return &StatusReply{"OK"}, nil
+}
+
+// needAuth tells if the request must be rejected until the client authenticates
+func (s *Server) needAuth(request *Request) bool {
+    if request.Client == nil || request.Client.user != "" {
+        return false
+    }
+    return lookupCommand(request.Command).Flags&kCmdNoAuth == 0
+}
+
+// checkPermission tells if the user of the client can run the request
+func (s *Server) checkPermission(client *Client, request *Request) error {
+    if client == nil {
+        return nil
+    }
+    spec := lookupCommand(request.Command)
+    if spec.Flags&kCmdNoAuth != 0 {
+        return nil
+    }
+    return s.acl.Check(client.user, spec, request.Arguments)
+}
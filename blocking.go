@@ -0,0 +1,155 @@
+package main
+
+import (
+    "container/list"
+    "sync"
+    "time"
+)
+
+// kWakeAllWaiters notifies all the waiters of the key, e.g. the readers of a stream
+const kWakeAllWaiters = -1
+
+// KeyWaiter is a client blocked on one or more keys, it will be signaled
+// with the key that became ready.
+type KeyWaiter struct {
+    keys     []string
+    elements map[string]*list.Element
+    ready    chan string
+}
+
+// KeyWaiters is the registry of clients blocked on keys, the waiters of the
+// same key will be woken in FIFO order. The held lock is the one the blocked
+// commands are served under, it is released while waiting, e.g. for the scripts to run.
+type KeyWaiters struct {
+    sync.Mutex
+    waiters map[string]*list.List
+    held    sync.Locker
+}
+
+func NewKeyWaiters(held sync.Locker) *KeyWaiters {
+    return &KeyWaiters{
+        waiters: make(map[string]*list.List),
+        held:    held,
+    }
+}
+
+func (kw *KeyWaiters) Wait(keys [][]byte) *KeyWaiter {
+    kw.Lock()
+    defer kw.Unlock()
+
+    waiter := &KeyWaiter{
+        keys:     make([]string, 0, len(keys)),
+        elements: make(map[string]*list.Element),
+        ready:    make(chan string, 1),
+    }
+    for _, key := range keys {
+        sKey := string(key)
+        if _, ok := waiter.elements[sKey]; ok {
+            continue
+        }
+        queue, ok := kw.waiters[sKey]
+        if !ok {
+            queue = list.New()
+            kw.waiters[sKey] = queue
+        }
+        waiter.keys = append(waiter.keys, sKey)
+        waiter.elements[sKey] = queue.PushBack(waiter)
+    }
+    globalStat.blockedClients.Add(1)
+    return waiter
+}
+
+// Cancel removes the waiter from the registry, if the waiter was signaled but
+// will not consume the key, the signal is passed to the next one in the queue.
+func (kw *KeyWaiters) Cancel(waiter *KeyWaiter) {
+    kw.Lock()
+    defer kw.Unlock()
+
+    kw.remove(waiter)
+    select {
+    case key := <-waiter.ready:
+        kw.notify(key, 1)
+    default:
+    }
+}
+
+// Notify wakes at most count waiters blocked on the key, or all with kWakeAllWaiters.
+func (kw *KeyWaiters) Notify(key []byte, count int) {
+    kw.Lock()
+    defer kw.Unlock()
+    kw.notify(string(key), count)
+}
+
+func (kw *KeyWaiters) notify(key string, count int) {
+    queue, ok := kw.waiters[key]
+    if !ok {
+        return
+    }
+    for i := 0; (count == kWakeAllWaiters || i < count) && queue.Len() > 0; i++ {
+        waiter := queue.Front().Value.(*KeyWaiter)
+        kw.remove(waiter)
+        waiter.ready <- key
+    }
+}
+
+func (kw *KeyWaiters) remove(waiter *KeyWaiter) {
+    if waiter.elements == nil {
+        return
+    }
+    for _, key := range waiter.keys {
+        if queue, ok := kw.waiters[key]; ok {
+            queue.Remove(waiter.elements[key])
+            if queue.Len() == 0 {
+                delete(kw.waiters, key)
+            }
+        }
+    }
+    waiter.elements = nil
+    globalStat.blockedClients.Add(-1)
+}
+
+// BlockFor calls serve until it reports the keys were served, blocking the client
+// between the tries until one of the keys is signaled. A zero timeout blocks forever.
+// It returns with no error if timed out or the client is gone.
+func (kw *KeyWaiters) BlockFor(client *Client, keys [][]byte, timeout time.Duration, serve func() (bool, error)) error {
+    if served, err := serve(); err != nil || served {
+        return err
+    }
+    if client == nil {
+        // not from a connection, e.g. an internal call, never blocks
+        return nil
+    }
+    client.blocked.Set(1)
+    defer client.blocked.Set(0)
+
+    var deadline <-chan time.Time
+    if timeout > 0 {
+        timer := time.NewTimer(timeout)
+        defer timer.Stop()
+        deadline = timer.C
+    }
+    closed, stop := client.WatchDisconnect()
+    defer stop()
+
+    for {
+        waiter := kw.Wait(keys)
+        // the key may have been pushed before the waiter registered
+        if served, err := serve(); err != nil || served {
+            kw.Cancel(waiter)
+            return err
+        }
+        signaled := false
+        kw.held.Unlock()
+        select {
+        case <-waiter.ready:
+            signaled = true
+        case <-deadline:
+        case <-closed:
+        }
+        kw.held.Lock()
+        if !signaled {
+            kw.Cancel(waiter)
+            return nil
+        }
+    }
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io"
+    "net"
+    "sync"
+    "time"
+)
+
+const (
+    kClientPushQueueSize = 1024
+)
+
+var (
+    ErrNotFromClient    = fmt.Errorf("command is only allowed from a client connection")
+    ErrOutputBufferFull = fmt.Errorf("client output buffer limit reached")
+    ErrClientName       = fmt.Errorf("Client names cannot contain spaces, newlines or special characters.")
+)
+
+// nextClientId is the id of the last client connected
+var nextClientId AtomicInt
+
+type Client struct {
+    Id      int64
+    Address string
+    conn    net.Conn
+    reader  *bufio.Reader
+
+    // only changed by the goroutine serving the client, under the info lock as CLIENT LIST
+    // reads them from the others. The user is empty until authenticated.
+    infoLock    sync.Mutex
+    user        string
+    name        string
+    lastCommand string
+    quitting    bool
+
+    created    time.Time
+    lastActive AtomicInt // in unix nano
+    queryBuf   AtomicInt // the bytes read but not served yet
+    blocked    AtomicInt
+    monitoring AtomicInt
+
+    // the protocol version set by HELLO, read by the publishers to encode the messages
+    proto AtomicInt
+
+    // guarded by the server's broker
+    channels      map[string]bool
+    patterns      map[string]bool
+    subscriptions AtomicInt
+
+    // once in push mode, every reply goes through the queue and the writer goroutine
+    pushOnce  sync.Once
+    pushQueue chan []byte
+    pushBytes AtomicInt
+    pushLimit int64
+    closeOnce sync.Once
+
+    // the output limits of the server, nil for no limit
+    limits *ClientLimits
+}
+
+func NewClient(conn net.Conn) *Client {
+    return &Client{
+        Id:       nextClientId.Add(1),
+        Address:  clientAddr(conn),
+        proto:    kProtoResp2,
+        created:  time.Now(),
+        conn:     conn,
+        reader:   bufio.NewReader(conn),
+        channels: make(map[string]bool),
+        patterns: make(map[string]bool),
+    }
+}
+
+// clientAddr returns the peer address, the unix socket peers are unnamed so they are
+// reported by the socket path like Redis does, e.g. /tmp/rockdis.sock:0
+func clientAddr(conn net.Conn) string {
+    if addr := conn.RemoteAddr(); addr != nil && addr.Network() != "unix" && addr.String() != "" {
+        return addr.String()
+    }
+    return conn.LocalAddr().String() + ":0"
+}
+
+func __client_commandName(command string) string {
+    if command == "" {
+        return "NULL"
+    }
+    return command
+}
+
+// checkClientName only allows the printable chars without spaces, so CLIENT LIST stays parsable
+func checkClientName(name string) error {
+    for i := 0; i < len(name); i++ {
+        if name[i] < '!' || name[i] > '~' {
+            return ErrClientName
+        }
+    }
+    return nil
+}
+
+func (c *Client) setUser(user string) {
+    c.infoLock.Lock()
+    defer c.infoLock.Unlock()
+    c.user = user
+}
+
+func (c *Client) setName(name string) {
+    c.infoLock.Lock()
+    defer c.infoLock.Unlock()
+    c.name = name
+}
+
+// User may be called by the other goroutines
+func (c *Client) User() string {
+    c.infoLock.Lock()
+    defer c.infoLock.Unlock()
+    return c.user
+}
+
+func (c *Client) Name() string {
+    c.infoLock.Lock()
+    defer c.infoLock.Unlock()
+    return c.name
+}
+
+// touch records the command is going to be served
+func (c *Client) touch(command string) {
+    c.infoLock.Lock()
+    c.lastCommand = command
+    c.infoLock.Unlock()
+    c.lastActive.Set(time.Now().UnixNano())
+    c.queryBuf.Set(int64(c.reader.Buffered()))
+}
+
+// Info describes the client in a line of CLIENT LIST
+func (c *Client) Info() string {
+    c.infoLock.Lock()
+    defer c.infoLock.Unlock()
+    flags := "N"
+    if c.monitoring.Get() > 0 {
+        flags = "O"
+    } else if c.blocked.Get() > 0 {
+        flags = "b"
+    } else if c.IsSubscriber() {
+        flags = "P"
+    }
+    lastActive := c.lastActiveTime()
+    return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=0 sub=%d qbuf=%d omem=%d cmd=%s user=%s resp=%d",
+        c.Id, c.Address, c.conn.LocalAddr(), c.name,
+        int64(time.Since(c.created)/time.Second), int64(time.Since(lastActive)/time.Second),
+        flags, c.subscriptions.Get(), c.queryBuf.Get(), c.pushBytes.Get(),
+        __client_commandName(c.lastCommand), c.user, c.Protocol())
+}
+
+func (c *Client) lastActiveTime() time.Time {
+    if nano := c.lastActive.Get(); nano > 0 {
+        return time.Unix(0, nano)
+    }
+    return c.created
+}
+
+func (c *Client) Protocol() int {
+    return int(c.proto.Get())
+}
+
+func (c *Client) IsSubscriber() bool {
+    return c.subscriptions.Get() > 0
+}
+
+// EnterPushMode starts the writer goroutine, the messages pushed by the other
+// clients are queued and the client is killed if more than limit bytes pending.
+func (c *Client) EnterPushMode(limit int64) {
+    c.pushOnce.Do(func() {
+        c.pushLimit = limit
+        c.pushQueue = make(chan []byte, kClientPushQueueSize)
+        go func(queue chan []byte) {
+            for data := range queue {
+                c.pushBytes.Add(-int64(len(data)))
+                c.setWriteDeadline()
+                if _, err := c.conn.Write(data); err != nil {
+                    c.Kill()
+                }
+            }
+        }(c.pushQueue)
+    })
+}
+
+// Push never blocks, a slow client will be disconnected instead
+func (c *Client) Push(data []byte) error {
+    if c.pushQueue == nil {
+        _, err := c.conn.Write(data)
+        return err
+    }
+    if c.pushLimit > 0 && c.pushBytes.Get()+int64(len(data)) > c.pushLimit {
+        c.Kill()
+        return ErrOutputBufferFull
+    }
+    c.pushBytes.Add(int64(len(data)))
+    select {
+    case c.pushQueue <- data:
+        return nil
+    default:
+        c.pushBytes.Add(-int64(len(data)))
+        c.Kill()
+        return ErrOutputBufferFull
+    }
+}
+
+func (c *Client) WriteReply(reply Reply) error {
+    if c.pushQueue == nil {
+        var w io.Writer = c.conn
+        if c.limits != nil {
+            c.setWriteDeadline()
+            if limit := c.limits.outputLimit.Get(); limit > 0 {
+                w = &outputLimitWriter{c.conn, limit}
+            }
+        }
+        _, err := reply.WriteTo(newProtoWriter(w, c.Protocol()))
+        return err
+    }
+    buffer := new(bytes.Buffer)
+    if _, err := reply.WriteTo(newProtoWriter(buffer, c.Protocol())); err != nil {
+        return err
+    }
+    if buffer.Len() == 0 {
+        return nil
+    }
+    return c.Push(buffer.Bytes())
+}
+
+// setWriteDeadline disconnects a client not reading its replies within the output timeout
+func (c *Client) setWriteDeadline() {
+    if c.limits == nil {
+        return
+    }
+    if timeout := time.Duration(c.limits.outputTimeout.Get()); timeout > 0 {
+        c.conn.SetWriteDeadline(time.Now().Add(timeout))
+    } else {
+        c.conn.SetWriteDeadline(time.Time{})
+    }
+}
+
+// outputLimitWriter fails a reply to a normal client once it is larger than the limit
+type outputLimitWriter struct {
+    w    io.Writer
+    left int64
+}
+
+func (w *outputLimitWriter) Write(p []byte) (int, error) {
+    if int64(len(p)) > w.left {
+        return 0, ErrOutputBufferFull
+    }
+    w.left -= int64(len(p))
+    return w.w.Write(p)
+}
+
+// Kill closes the connection, the serving goroutine will clean up the client
+func (c *Client) Kill() {
+    c.conn.Close()
+}
+
+// Close stops the writer goroutine, should only be called by the serving goroutine
+func (c *Client) Close() {
+    c.closeOnce.Do(func() {
+        if c.pushQueue != nil {
+            close(c.pushQueue)
+        }
+    })
+}
+
+// WatchDisconnect is used while the client is blocked by a command, the returned
+// channel will be closed if the peer closes the connection. The stop func must be
+// called before reading the next request from the client.
+func (c *Client) WatchDisconnect() (<-chan struct{}, func()) {
+    closed := make(chan struct{})
+    done := make(chan struct{})
+    c.conn.SetReadDeadline(time.Time{})
+    go func() {
+        defer close(done)
+        // Peek will not consume any pipelined request
+        if _, err := c.reader.Peek(1); err != nil {
+            if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+                return
+            }
+            close(closed)
+        }
+    }()
+    stop := func() {
+        c.conn.SetReadDeadline(time.Now())
+        <-done
+    }
+    return closed, stop
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    kDefaultMaxClients = 10000
+    // kClientReadTimeout wakes up the reading goroutine to check the connection and the idle timeout
+    kClientReadTimeout = 10 * time.Minute
+)
+
+var (
+    ErrNoSuchClient = fmt.Errorf("No such client")
+    ErrMaxClients   = &CodeErrorReply{"ERR", "max number of clients reached"}
+)
+
+// ClientLimits are read for every request and reply without any lock, CONFIG SET changes them.
+// A zero limit disables it, except maxArgs and maxBulkLen which are always set.
+type ClientLimits struct {
+    maxClients    AtomicInt
+    idleTimeout   AtomicInt // nanoseconds
+    maxArgs       AtomicInt
+    maxBulkLen    AtomicInt
+    outputLimit   AtomicInt // bytes of a reply to a normal client, the subscribers have pubsubOutputLimit
+    outputTimeout AtomicInt // nanoseconds a write to the client may take
+}
+
+// readTimeout is the read deadline of the next request, so an idle client is found in time
+func (l *ClientLimits) readTimeout() time.Duration {
+    if timeout := time.Duration(l.idleTimeout.Get()); timeout > 0 && timeout < kClientReadTimeout {
+        return timeout
+    }
+    return kClientReadTimeout
+}
+
+// isIdle tells if the client has been idle over the timeout, the subscribers and the monitors
+// are never idle like Redis.
+func (l *ClientLimits) isIdle(c *Client) bool {
+    timeout := time.Duration(l.idleTimeout.Get())
+    return timeout > 0 && !c.IsSubscriber() && c.monitoring.Get() == 0 && time.Since(c.lastActiveTime()) >= timeout
+}
+
+// ClientRegistry holds the live connections, e.g. to list and kill them
+type ClientRegistry struct {
+    sync.RWMutex
+    clients map[int64]*Client
+}
+
+func NewClientRegistry() *ClientRegistry {
+    return &ClientRegistry{clients: make(map[int64]*Client)}
+}
+
+func (r *ClientRegistry) Add(client *Client) {
+    r.Lock()
+    defer r.Unlock()
+    r.clients[client.Id] = client
+}
+
+func (r *ClientRegistry) Remove(client *Client) {
+    r.Lock()
+    defer r.Unlock()
+    delete(r.clients, client.Id)
+}
+
+// List returns the clients in the order they connected
+func (r *ClientRegistry) List() []*Client {
+    r.RLock()
+    defer r.RUnlock()
+    clients := make([]*Client, 0, len(r.clients))
+    for _, client := range r.clients {
+        clients = append(clients, client)
+    }
+    sort.Sort(clientsById(clients))
+    return clients
+}
+
+type clientsById []*Client
+
+func (c clientsById) Len() int           { return len(c) }
+func (c clientsById) Less(i, j int) bool { return c[i].Id < c[j].Id }
+func (c clientsById) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// ClientPause holds the commands of the clients until the deadline or CLIENT UNPAUSE,
+// only the writes are held unless all is set.
+type ClientPause struct {
+    sync.Mutex
+    all     bool
+    until   time.Time
+    resumed chan struct{}
+    closed  bool
+}
+
+func NewClientPause() *ClientPause {
+    return &ClientPause{}
+}
+
+// Pause keeps the later deadline and the stricter mode of an active pause
+func (p *ClientPause) Pause(timeout time.Duration, all bool) {
+    p.Lock()
+    defer p.Unlock()
+    if p.closed {
+        return
+    }
+    until := time.Now().Add(timeout)
+    if !p.paused() {
+        p.all, p.until, p.resumed = all, until, make(chan struct{})
+        return
+    }
+    p.all = p.all || all
+    if until.After(p.until) {
+        p.until = until
+    }
+}
+
+func (p *ClientPause) Unpause() {
+    p.Lock()
+    defer p.Unlock()
+    p.unpause()
+}
+
+// Close resumes the clients for good, e.g. on shutdown
+func (p *ClientPause) Close() {
+    p.Lock()
+    defer p.Unlock()
+    p.closed = true
+    p.unpause()
+}
+
+func (p *ClientPause) unpause() {
+    if p.resumed != nil {
+        close(p.resumed)
+        p.resumed = nil
+    }
+}
+
+// Wait returns once the command is no longer paused
+func (p *ClientPause) Wait(spec *CommandSpec) {
+    for {
+        p.Lock()
+        if !p.paused() || spec.Flags&kCmdNoPause != 0 ||
+            (!p.all && spec.Flags&(kCmdWrite|kCmdExclusive) == 0) {
+            // the scripts may write
+            p.Unlock()
+            return
+        }
+        resumed, timer := p.resumed, time.NewTimer(p.until.Sub(time.Now()))
+        p.Unlock()
+        select {
+        case <-resumed:
+        case <-timer.C:
+        }
+        timer.Stop()
+    }
+}
+
+func (p *ClientPause) paused() bool {
+    return p.resumed != nil && time.Now().Before(p.until)
+}
+
+// CLIENT LIST [TYPE normal|pubsub] [ID id ...] | INFO | ID | SETNAME name | GETNAME
+// | KILL addr | KILL [ID id] [ADDR addr] [USER username] [SKIPME yes|no]
+// | PAUSE timeout [WRITE|ALL] | UNPAUSE
+func (s *Server) RedisClient(request *Request, subCommand []byte, args ...[]byte) (interface{}, error) {
+    client := request.Client
+    if client == nil {
+        return nil, ErrNotFromClient
+    }
+    switch strings.ToLower(string(subCommand)) {
+    case "list":
+        return s._client_list(args)
+    case "info":
+        if len(args) != 0 {
+            return nil, ErrWrongArgumentsCount
+        }
+        return &VerbatimReply{"txt", []byte(client.Info() + "\n")}, nil
+    case "id":
+        if len(args) != 0 {
+            return nil, ErrWrongArgumentsCount
+        }
+        return int(client.Id), nil
+    case "setname":
+        if len(args) != 1 {
+            return nil, ErrWrongArgumentsCount
+        }
+        if err := checkClientName(string(args[0])); err != nil {
+            return nil, err
+        }
+        client.setName(string(args[0]))
+        return &StatusReply{"OK"}, nil
+    case "getname":
+        if len(args) != 0 {
+            return nil, ErrWrongArgumentsCount
+        }
+        return []byte(client.Name()), nil
+    case "kill":
+        return s._client_kill(client, args)
+    case "pause":
+        if len(args) != 1 && len(args) != 2 {
+            return nil, ErrWrongArgumentsCount
+        }
+        timeout, err := strconv.Atoi(string(args[0]))
+        if err != nil || timeout < 0 {
+            return nil, fmt.Errorf("timeout is not an integer or out of range")
+        }
+        all := true
+        if len(args) == 2 {
+            switch strings.ToLower(string(args[1])) {
+            case "write":
+                all = false
+            case "all":
+            default:
+                return nil, ErrSyntax
+            }
+        }
+        s.pause.Pause(time.Duration(timeout)*time.Millisecond, all)
+        return &StatusReply{"OK"}, nil
+    case "unpause":
+        if len(args) != 0 {
+            return nil, ErrWrongArgumentsCount
+        }
+        s.pause.Unpause()
+        return &StatusReply{"OK"}, nil
+    }
+    return nil, ErrSyntax
+}
+
+func (s *Server) _client_list(args [][]byte) (interface{}, error) {
+    var kind string
+    var ids map[int64]bool
+    for i := 0; i < len(args); i++ {
+        switch strings.ToLower(string(args[i])) {
+        case "type":
+            if i+1 >= len(args) {
+                return nil, ErrSyntax
+            }
+            kind = strings.ToLower(string(args[i+1]))
+            if kind != "normal" && kind != "pubsub" {
+                return nil, fmt.Errorf("Unknown client type '%s'", args[i+1])
+            }
+            i++
+        case "id":
+            if i+1 >= len(args) {
+                return nil, ErrSyntax
+            }
+            ids = make(map[int64]bool)
+            for i++; i < len(args); i++ {
+                id, err := strconv.ParseInt(string(args[i]), 10, 64)
+                if err != nil || id <= 0 {
+                    return nil, fmt.Errorf("Invalid client ID")
+                }
+                ids[id] = true
+            }
+        default:
+            return nil, ErrSyntax
+        }
+    }
+    var lines []byte
+    for _, c := range s.clients.List() {
+        if ids != nil && !ids[c.Id] {
+            continue
+        }
+        if (kind == "normal" && c.IsSubscriber()) || (kind == "pubsub" && !c.IsSubscriber()) {
+            continue
+        }
+        lines = append(lines, c.Info()+"\n"...)
+    }
+    return &VerbatimReply{"txt", lines}, nil
+}
+
+// _client_kill replies OK for the old form with only the address, or the number of the
+// clients killed for the filters. The client itself is closed after the reply.
+func (s *Server) _client_kill(self *Client, args [][]byte) (interface{}, error) {
+    if len(args) == 1 {
+        for _, c := range s.clients.List() {
+            if c.Address == string(args[0]) {
+                __client_kill(self, c)
+                return &StatusReply{"OK"}, nil
+            }
+        }
+        return nil, ErrNoSuchClient
+    }
+    if len(args) == 0 || len(args)%2 != 0 {
+        return nil, ErrSyntax
+    }
+
+    var id int64
+    var addr, user string
+    skipMe := true
+    for i := 0; i < len(args); i += 2 {
+        value := string(args[i+1])
+        switch strings.ToLower(string(args[i])) {
+        case "id":
+            n, err := strconv.ParseInt(value, 10, 64)
+            if err != nil || n <= 0 {
+                return nil, fmt.Errorf("client-id should be greater than 0")
+            }
+            id = n
+        case "addr":
+            addr = value
+        case "user":
+            if _, ok := s.acl.GetUser(value); !ok {
+                return nil, fmt.Errorf("No such user '%s'", value)
+            }
+            user = value
+        case "skipme":
+            switch strings.ToLower(value) {
+            case "yes":
+                skipMe = true
+            case "no":
+                skipMe = false
+            default:
+                return nil, ErrSyntax
+            }
+        default:
+            return nil, ErrSyntax
+        }
+    }
+    count := 0
+    for _, c := range s.clients.List() {
+        if (id != 0 && c.Id != id) || (addr != "" && c.Address != addr) ||
+            (user != "" && c.User() != user) || (skipMe && c == self) {
+            continue
+        }
+        __client_kill(self, c)
+        count++
+    }
+    return count, nil
+}
+
+func __client_kill(self, c *Client) {
+    if c == self {
+        self.quitting = true
+    } else {
+        c.Kill()
+    }
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+    "fmt"
+    "math/bits"
+    "sort"
+    "time"
+)
+
+// The latency histogram has exact buckets for the values below 32, then 16 buckets for
+// every power of 2, so a value is recorded within 1/16 of it. The values are in microseconds
+// and are capped at 2^37, about 38 hours.
+const (
+    kHistogramSubBits    = 4
+    kHistogramSubBuckets = 1 << kHistogramSubBits
+    kHistogramMaxShift   = 32
+    kHistogramBuckets    = (kHistogramMaxShift + 2) * kHistogramSubBuckets
+    kHistogramMaxValue   = 1<<(kHistogramMaxShift+kHistogramSubBits+1) - 1
+)
+
+// LatencyHistogram counts the values in log-linear buckets like HDR histogram without any lock
+type LatencyHistogram struct {
+    counts [kHistogramBuckets]AtomicInt
+}
+
+func (h *LatencyHistogram) Record(value int64) {
+    if value < 0 {
+        value = 0
+    } else if value > kHistogramMaxValue {
+        value = kHistogramMaxValue
+    }
+    h.counts[__histogram_index(value)].Add(1)
+}
+
+// Percentile returns the highest value of the bucket holding the percentile, 0 if nothing recorded
+func (h *LatencyHistogram) Percentile(percentile float64) int64 {
+    var counts [kHistogramBuckets]int64
+    var total int64
+    for i := range h.counts {
+        counts[i] = h.counts[i].Get()
+        total += counts[i]
+    }
+    if total == 0 {
+        return 0
+    }
+    target := int64(percentile / 100 * float64(total))
+    if float64(target) < percentile/100*float64(total) {
+        target++
+    }
+    if target < 1 {
+        target = 1
+    }
+    var seen int64
+    for i := range counts {
+        seen += counts[i]
+        if seen >= target {
+            return __histogram_highest(i)
+        }
+    }
+    return __histogram_highest(kHistogramBuckets - 1)
+}
+
+func (h *LatencyHistogram) Count() int64 {
+    var total int64
+    for i := range h.counts {
+        total += h.counts[i].Get()
+    }
+    return total
+}
+
+func (h *LatencyHistogram) Reset() {
+    for i := range h.counts {
+        h.counts[i].Set(0)
+    }
+}
+
+func __histogram_index(value int64) int {
+    if value < 2*kHistogramSubBuckets {
+        return int(value)
+    }
+    shift := bits.Len64(uint64(value)) - kHistogramSubBits - 1
+    return shift*kHistogramSubBuckets + int(value>>uint(shift))
+}
+
+func __histogram_highest(index int) int64 {
+    if index < 2*kHistogramSubBuckets {
+        return int64(index)
+    }
+    shift := uint(index/kHistogramSubBuckets - 1)
+    mantissa := int64(index%kHistogramSubBuckets + kHistogramSubBuckets)
+    return (mantissa+1)<<shift - 1
+}
+
+// CommandStat is updated by the dispatcher with the atomic counters only
+type CommandStat struct {
+    calls    AtomicInt
+    usec     AtomicInt
+    rejected AtomicInt
+    failed   AtomicInt
+    latency  LatencyHistogram
+}
+
+// CommandStats has a stat for every command of the command table, the map is never
+// changed after created, so it is read without any lock.
+type CommandStats struct {
+    stats map[string]*CommandStat
+}
+
+func NewCommandStats() *CommandStats {
+    cs := &CommandStats{stats: make(map[string]*CommandStat, len(commandTable))}
+    for i := range commandTable {
+        cs.stats[commandTable[i].Name] = &CommandStat{}
+    }
+    return cs
+}
+
+// Record a command served, the duration is not recorded if negative, e.g. of a blocking command
+func (cs *CommandStats) Record(name string, duration time.Duration, failed bool) {
+    stat, ok := cs.stats[name]
+    if !ok {
+        return
+    }
+    stat.calls.Add(1)
+    if failed {
+        stat.failed.Add(1)
+    }
+    if duration >= 0 {
+        usec := int64(duration / time.Microsecond)
+        stat.usec.Add(usec)
+        stat.latency.Record(usec)
+    }
+}
+
+// Reject records a command refused before served, e.g. by ACL
+func (cs *CommandStats) Reject(name string) {
+    if stat, ok := cs.stats[name]; ok {
+        stat.rejected.Add(1)
+    }
+}
+
+func (cs *CommandStats) Reset() {
+    for _, stat := range cs.stats {
+        stat.calls.Set(0)
+        stat.usec.Set(0)
+        stat.rejected.Set(0)
+        stat.failed.Set(0)
+        stat.latency.Reset()
+    }
+}
+
+// InfoCommandStats returns the lines of INFO commandstats of the commands ever called
+func (cs *CommandStats) InfoCommandStats() []string {
+    lines := make([]string, 0)
+    for _, name := range cs.names() {
+        stat := cs.stats[name]
+        calls, usec := stat.calls.Get(), stat.usec.Get()
+        perCall := 0.0
+        if calls > 0 {
+            perCall = float64(usec) / float64(calls)
+        }
+        lines = append(lines, fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+            name, calls, usec, perCall, stat.rejected.Get(), stat.failed.Get()))
+    }
+    return lines
+}
+
+// InfoLatencyStats returns the lines of INFO latencystats of the commands with any latency recorded
+func (cs *CommandStats) InfoLatencyStats() []string {
+    lines := make([]string, 0)
+    for _, name := range cs.names() {
+        stat := cs.stats[name]
+        if stat.latency.Count() == 0 {
+            continue
+        }
+        lines = append(lines, fmt.Sprintf("latency_percentiles_usec_%s:p50=%.3f,p99=%.3f,p99.9=%.3f",
+            name,
+            float64(stat.latency.Percentile(50)),
+            float64(stat.latency.Percentile(99)),
+            float64(stat.latency.Percentile(99.9))))
+    }
+    return lines
+}
+
+func (cs *CommandStats) names() []string {
+    names := make([]string, 0)
+    for name, stat := range cs.stats {
+        if stat.calls.Get() > 0 || stat.rejected.Get() > 0 {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    return names
+}
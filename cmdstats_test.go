@@ -0,0 +1,60 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestHistogramIndex(t *testing.T) {
+    tests := []struct {
+        value int64
+        index int
+    }{
+        {0, 0},
+        {1, 1},
+        {31, 31},
+        {32, 32},
+        {33, 32},
+        {34, 33},
+        {63, 47},
+        {64, 48},
+        {1000, 111},
+        {1023, 111},
+        {1024, 112},
+    }
+    for _, test := range tests {
+        if index := __histogram_index(test.value); index != test.index {
+            t.Errorf("__histogram_index(%d) = %d, want %d", test.value, index, test.index)
+        }
+    }
+}
+
+func TestHistogramHighest(t *testing.T) {
+    tests := []struct {
+        index   int
+        highest int64
+    }{
+        {0, 0},
+        {31, 31},
+        {32, 33},
+        {33, 35},
+        {47, 63},
+        {111, 1023},
+        {kHistogramBuckets - 1, kHistogramMaxValue},
+    }
+    for _, test := range tests {
+        if highest := __histogram_highest(test.index); highest != test.highest {
+            t.Errorf("__histogram_highest(%d) = %d, want %d", test.index, highest, test.highest)
+        }
+    }
+
+    // the highest value of a bucket is in it, and the next value is in the next bucket
+    for index := 0; index < kHistogramBuckets-1; index++ {
+        highest := __histogram_highest(index)
+        if i := __histogram_index(highest); i != index {
+            t.Fatalf("__histogram_index(%d) = %d, want %d", highest, i, index)
+        }
+        if i := __histogram_index(highest + 1); i != index+1 {
+            t.Fatalf("__histogram_index(%d) = %d, want %d", highest+1, i, index+1)
+        }
+    }
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+    "strconv"
+    "strings"
+)
+
+// The command flags tell the dispatcher how to serve a command.
+const (
+    // kCmdWrite changes the dataset
+    kCmdWrite = 1 << iota
+    // kCmdNoScript can not be called from the scripts
+    kCmdNoScript
+    // kCmdExclusive holds the execution lock alone, e.g. a script runs atomically
+    kCmdExclusive
+    // kCmdNoLock is served without the execution lock
+    kCmdNoLock
+    // kCmdAllowBusy is served while a script runs over the time limit, e.g. SCRIPT KILL
+    kCmdAllowBusy
+    // kCmdNoAuth is served before the client authenticates
+    kCmdNoAuth
+    // kCmdBlocking may block the client
+    kCmdBlocking
+    // kCmdAdmin manages the server, e.g. ACL
+    kCmdAdmin
+    // kCmdNoPause is served while the clients are paused, e.g. CLIENT UNPAUSE
+    kCmdNoPause
+)
+
+// kDataGroups are the groups of the commands on the dataset, their commands are either @read or @write
+var kDataGroups = map[string]bool{
+    "keyspace": true, "string": true, "list": true, "hash": true,
+    "set": true, "sortedset": true, "geo": true, "stream": true,
+}
+
+// CommandSpec describes a command. The keys are at FirstKey to LastKey of the arguments
+// by Step, 1 for the first argument after the command name, a negative LastKey counts
+// from the end, and no key if FirstKey is 0.
+type CommandSpec struct {
+    Name     string
+    Group    string
+    Flags    int
+    FirstKey int
+    LastKey  int
+    Step     int
+}
+
+var commandTable = []CommandSpec{
+    {"del", "keyspace", kCmdWrite, 1, -1, 1},
+    {"exists", "keyspace", 0, 1, -1, 1},
+    {"expire", "keyspace", kCmdWrite, 1, 1, 1},
+    {"keys", "keyspace", 0, 0, 0, 0},
+    {"type", "keyspace", 0, 1, 1, 1},
+
+    {"append", "string", kCmdWrite, 1, 1, 1},
+    {"decr", "string", kCmdWrite, 1, 1, 1},
+    {"decrby", "string", kCmdWrite, 1, 1, 1},
+    {"get", "string", 0, 1, 1, 1},
+    {"getset", "string", kCmdWrite, 1, 1, 1},
+    {"incr", "string", kCmdWrite, 1, 1, 1},
+    {"incrby", "string", kCmdWrite, 1, 1, 1},
+    {"mget", "string", 0, 1, -1, 1},
+    {"mset", "string", kCmdWrite, 1, -1, 2},
+    {"set", "string", kCmdWrite, 1, 1, 1},
+
+    {"blmove", "list", kCmdWrite | kCmdBlocking, 1, 2, 1},
+    {"blpop", "list", kCmdWrite | kCmdBlocking, 1, -2, 1},
+    {"brpop", "list", kCmdWrite | kCmdBlocking, 1, -2, 1},
+    {"lindex", "list", 0, 1, 1, 1},
+    {"llen", "list", 0, 1, 1, 1},
+    {"lmove", "list", kCmdWrite, 1, 2, 1},
+    {"lpop", "list", kCmdWrite, 1, 1, 1},
+    {"lpush", "list", kCmdWrite, 1, 1, 1},
+    {"lrange", "list", 0, 1, 1, 1},
+    {"ltrim", "list", kCmdWrite, 1, 1, 1},
+    {"rpop", "list", kCmdWrite, 1, 1, 1},
+    {"rpush", "list", kCmdWrite, 1, 1, 1},
+
+    {"hdel", "hash", kCmdWrite, 1, 1, 1},
+    {"hexists", "hash", 0, 1, 1, 1},
+    {"hget", "hash", 0, 1, 1, 1},
+    {"hgetall", "hash", 0, 1, 1, 1},
+    {"hincrby", "hash", kCmdWrite, 1, 1, 1},
+    {"hincrbyfloat", "hash", kCmdWrite, 1, 1, 1},
+    {"hkeys", "hash", 0, 1, 1, 1},
+    {"hlen", "hash", 0, 1, 1, 1},
+    {"hmget", "hash", 0, 1, 1, 1},
+    {"hmset", "hash", kCmdWrite, 1, 1, 1},
+    {"hrandfield", "hash", 0, 1, 1, 1},
+    {"hset", "hash", kCmdWrite, 1, 1, 1},
+    {"hsetnx", "hash", kCmdWrite, 1, 1, 1},
+    {"hstrlen", "hash", 0, 1, 1, 1},
+    {"hvals", "hash", 0, 1, 1, 1},
+
+    {"sadd", "set", kCmdWrite, 1, 1, 1},
+    {"scard", "set", 0, 1, 1, 1},
+    {"sdiff", "set", 0, 1, -1, 1},
+    {"sdiffstore", "set", kCmdWrite, 1, -1, 1},
+    {"sinter", "set", 0, 1, -1, 1},
+    {"sinterstore", "set", kCmdWrite, 1, -1, 1},
+    {"sismember", "set", 0, 1, 1, 1},
+    {"smembers", "set", 0, 1, 1, 1},
+    {"smismember", "set", 0, 1, 1, 1},
+    {"smove", "set", kCmdWrite, 1, 2, 1},
+    {"spop", "set", kCmdWrite, 1, 1, 1},
+    {"srandmember", "set", 0, 1, 1, 1},
+    {"srem", "set", kCmdWrite, 1, 1, 1},
+    {"sunion", "set", 0, 1, -1, 1},
+    {"sunionstore", "set", kCmdWrite, 1, -1, 1},
+
+    {"bzpopmax", "sortedset", kCmdWrite | kCmdBlocking, 1, -2, 1},
+    {"bzpopmin", "sortedset", kCmdWrite | kCmdBlocking, 1, -2, 1},
+    {"zadd", "sortedset", kCmdWrite, 1, 1, 1},
+    {"zcard", "sortedset", 0, 1, 1, 1},
+    {"zinterstore", "sortedset", kCmdWrite, 1, 1, 1},
+    {"zlexcount", "sortedset", 0, 1, 1, 1},
+    {"zpopmax", "sortedset", kCmdWrite, 1, 1, 1},
+    {"zpopmin", "sortedset", kCmdWrite, 1, 1, 1},
+    {"zrange", "sortedset", 0, 1, 1, 1},
+    {"zrangebylex", "sortedset", 0, 1, 1, 1},
+    {"zrangebyscore", "sortedset", 0, 1, 1, 1},
+    {"zrem", "sortedset", kCmdWrite, 1, 1, 1},
+    {"zremrangebylex", "sortedset", kCmdWrite, 1, 1, 1},
+    {"zrevrange", "sortedset", 0, 1, 1, 1},
+    {"zrevrangebylex", "sortedset", 0, 1, 1, 1},
+    {"zscore", "sortedset", 0, 1, 1, 1},
+    {"zunionstore", "sortedset", kCmdWrite, 1, 1, 1},
+
+    {"geoadd", "geo", kCmdWrite, 1, 1, 1},
+    {"geodist", "geo", 0, 1, 1, 1},
+    {"geopos", "geo", 0, 1, 1, 1},
+    {"georadius", "geo", 0, 1, 1, 1},
+    {"geosearch", "geo", 0, 1, 1, 1},
+
+    {"xack", "stream", kCmdWrite, 1, 1, 1},
+    {"xadd", "stream", kCmdWrite, 1, 1, 1},
+    {"xautoclaim", "stream", kCmdWrite, 1, 1, 1},
+    {"xclaim", "stream", kCmdWrite, 1, 1, 1},
+    {"xgroup", "stream", kCmdWrite, 2, 2, 1},
+    {"xlen", "stream", 0, 1, 1, 1},
+    {"xpending", "stream", 0, 1, 1, 1},
+    {"xrange", "stream", 0, 1, 1, 1},
+    {"xread", "stream", kCmdBlocking, 0, 0, 0},
+    {"xreadgroup", "stream", kCmdWrite | kCmdBlocking, 0, 0, 0},
+    {"xrevrange", "stream", 0, 1, 1, 1},
+    {"xtrim", "stream", kCmdWrite, 1, 1, 1},
+
+    {"psubscribe", "pubsub", kCmdNoScript | kCmdNoLock, 0, 0, 0},
+    {"publish", "pubsub", kCmdNoLock, 0, 0, 0},
+    {"pubsub", "pubsub", kCmdNoLock, 0, 0, 0},
+    {"punsubscribe", "pubsub", kCmdNoScript | kCmdNoLock, 0, 0, 0},
+    {"subscribe", "pubsub", kCmdNoScript | kCmdNoLock, 0, 0, 0},
+    {"unsubscribe", "pubsub", kCmdNoScript | kCmdNoLock, 0, 0, 0},
+
+    {"eval", "scripting", kCmdNoScript | kCmdExclusive, 0, 0, 0},
+    {"evalsha", "scripting", kCmdNoScript | kCmdExclusive, 0, 0, 0},
+    {"script", "scripting", kCmdNoScript | kCmdNoLock | kCmdAllowBusy, 0, 0, 0},
+
+    {"auth", "connection", kCmdNoScript | kCmdNoLock | kCmdAllowBusy | kCmdNoAuth | kCmdNoPause, 0, 0, 0},
+    {"client", "connection", kCmdNoScript | kCmdNoLock | kCmdAdmin | kCmdNoPause, 0, 0, 0},
+    {"hello", "connection", kCmdNoScript | kCmdNoLock | kCmdAllowBusy | kCmdNoAuth | kCmdNoPause, 0, 0, 0},
+    {"ping", "connection", 0, 0, 0, 0},
+    {"quit", "connection", kCmdNoScript | kCmdNoLock | kCmdAllowBusy | kCmdNoAuth | kCmdNoPause, 0, 0, 0},
+    {"select", "connection", 0, 0, 0, 0},
+
+    {"acl", "", kCmdNoScript | kCmdNoLock | kCmdAdmin, 0, 0, 0},
+    {"config", "", kCmdNoScript | kCmdNoLock | kCmdAdmin, 0, 0, 0},
+    {"info", "", 0, 0, 0, 0},
+    {"monitor", "", kCmdNoScript | kCmdNoLock | kCmdAdmin, 0, 0, 0},
+    {"slowlog", "", kCmdNoLock | kCmdAdmin, 0, 0, 0},
+    {"shutdown", "", kCmdNoScript | kCmdNoLock | kCmdAllowBusy | kCmdAdmin | kCmdNoPause, 0, 0, 0},
+}
+
+// commandKeysFns find the keys of the commands which have them at variable positions
+var commandKeysFns = map[string]func(args [][]byte) [][]byte{
+    "eval":        __command_numKeys(1),
+    "evalsha":     __command_numKeys(1),
+    "zinterstore": __command_numKeys(1),
+    "zunionstore": __command_numKeys(1),
+    "xread":       __command_streamsKeys,
+    "xreadgroup":  __command_streamsKeys,
+}
+
+var commandSpecs map[string]*CommandSpec
+
+func init() {
+    commandSpecs = make(map[string]*CommandSpec, len(commandTable))
+    for i := range commandTable {
+        commandSpecs[commandTable[i].Name] = &commandTable[i]
+    }
+}
+
+// lookupCommand returns the spec of the command, an unknown command has no flags
+func lookupCommand(name string) *CommandSpec {
+    if spec, ok := commandSpecs[strings.ToLower(name)]; ok {
+        return spec
+    }
+    return &CommandSpec{Name: strings.ToLower(name)}
+}
+
+// Keys returns the keys in the arguments of the command
+func (spec *CommandSpec) Keys(args [][]byte) [][]byte {
+    keys := make([][]byte, 0)
+    if keysFn, ok := commandKeysFns[spec.Name]; ok {
+        keys = append(keys, keysFn(args)...)
+    }
+    if spec.FirstKey <= 0 || spec.FirstKey > len(args) {
+        return keys
+    }
+    last := spec.LastKey
+    if last < 0 {
+        last += len(args) + 1
+    }
+    if last > len(args) {
+        last = len(args)
+    }
+    for i := spec.FirstKey; i <= last; i += spec.Step {
+        keys = append(keys, args[i-1])
+    }
+    return keys
+}
+
+// Categories returns the ACL categories of the command without the @
+func (spec *CommandSpec) Categories() []string {
+    categories := []string{"all"}
+    if spec.Group != "" {
+        categories = append(categories, spec.Group)
+    }
+    if kDataGroups[spec.Group] {
+        if spec.Flags&kCmdWrite != 0 {
+            categories = append(categories, "write")
+        } else {
+            categories = append(categories, "read")
+        }
+    }
+    if spec.Flags&kCmdBlocking != 0 {
+        categories = append(categories, "blocking")
+    }
+    if spec.Flags&kCmdAdmin != 0 {
+        categories = append(categories, "admin", "dangerous")
+    }
+    return categories
+}
+
+// __command_numKeys finds the keys counted by the numkeys argument at the position, e.g. 1 for EVAL
+func __command_numKeys(position int) func(args [][]byte) [][]byte {
+    return func(args [][]byte) [][]byte {
+        if len(args) <= position {
+            return nil
+        }
+        n, err := strconv.Atoi(string(args[position]))
+        if err != nil || n < 0 || position+1+n > len(args) {
+            return nil
+        }
+        return args[position+1 : position+1+n]
+    }
+}
+
+// __command_streamsKeys finds the keys in the first half after STREAMS
+func __command_streamsKeys(args [][]byte) [][]byte {
+    for i := range args {
+        if strings.ToLower(string(args[i])) == "streams" {
+            rest := args[i+1:]
+            return rest[:len(rest)/2]
+        }
+    }
+    return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func __test_args(line string) [][]byte {
+    if line == "" {
+        return nil
+    }
+    var args [][]byte
+    for _, field := range strings.Fields(line) {
+        args = append(args, []byte(field))
+    }
+    return args
+}
+
+func TestCommandNumKeys(t *testing.T) {
+    tests := []struct {
+        position int
+        args     string
+        keys     string
+    }{
+        {1, "script 2 a b c", "a b"},
+        {1, "script 0 a", ""},
+        {1, "script 3 a b", ""},
+        {1, "script -1 a", ""},
+        {1, "script x a", ""},
+        {1, "script", ""},
+        {0, "2 a b", "a b"},
+    }
+    for _, test := range tests {
+        keys := __command_numKeys(test.position)(__test_args(test.args))
+        if len(keys) != 0 || test.keys != "" {
+            if !reflect.DeepEqual(keys, __test_args(test.keys)) {
+                t.Errorf("__command_numKeys(%d)(%s) = %q, want %s", test.position, test.args, keys, test.keys)
+            }
+        }
+    }
+}
+
+func TestCommandStreamsKeys(t *testing.T) {
+    tests := []struct {
+        args string
+        keys string
+    }{
+        {"STREAMS a 0", "a"},
+        {"COUNT 2 streams a b 0 0", "a b"},
+        {"GROUP g c BLOCK 0 STREAMS a b > >", "a b"},
+        {"COUNT 2", ""},
+        {"STREAMS", ""},
+    }
+    for _, test := range tests {
+        keys := __command_streamsKeys(__test_args(test.args))
+        if len(keys) != 0 || test.keys != "" {
+            if !reflect.DeepEqual(keys, __test_args(test.keys)) {
+                t.Errorf("__command_streamsKeys(%s) = %q, want %s", test.args, keys, test.keys)
+            }
+        }
+    }
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "reflect"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var ErrConfigNoFile = fmt.Errorf("The server is running without a config file")
+
+// configParam is a setting of CONFIG GET and SET, bound by reflection to the variable of the
+// section in RockdisConfig. The apply checks the new config and returns the function changing
+// the server, it is nil for the settings read only once at the start.
+type configParam struct {
+    name     string
+    section  string
+    variable string
+    apply    func(s *Server, config *RockdisConfig) (func() error, error)
+}
+
+var kConfigParams = []configParam{
+    {"bind", "Server", "Bind", nil},
+    {"port", "Server", "Port", nil},
+    {"tls-port", "Server", "TlsPort", nil},
+    {"tls-cert-file", "Server", "TlsCertFile", nil},
+    {"tls-key-file", "Server", "TlsKeyFile", nil},
+    {"tls-ca-cert-file", "Server", "TlsCaCertFile", nil},
+    {"tls-auth-clients", "Server", "TlsAuthClients", nil},
+    {"unixsocket", "Server", "UnixSocket", nil},
+    {"unixsocketperm", "Server", "UnixSocketPerm", nil},
+    {"metrics-bind", "Server", "MetricsBind", nil},
+    {"metrics-port", "Server", "MetricsPort", nil},
+    {"aclfile", "Server", "AclFile", nil},
+    {"monitor-log", "Server", "MonitorLog", __config_monitorLog},
+    {"pubsub-output-limit", "Server", "PubSubOutputLimit", __config_pubsubOutputLimit},
+    {"notify-keyspace-events", "Server", "NotifyKeyspaceEvents", __config_notifyKeyspaceEvents},
+    {"lua-time-limit", "Server", "LuaTimeLimit", __config_luaTimeLimit},
+    {"slowlog-log-slower-than", "Server", "SlowlogLogSlowerThan", __config_slowlogSlowerThan},
+    {"slowlog-max-len", "Server", "SlowlogMaxLen", __config_slowlogMaxLen},
+    {"maxclients", "Server", "MaxClients", __config_maxClients},
+    {"timeout", "Server", "Timeout", __config_timeout},
+    {"proto-max-bulk-len", "Server", "ProtoMaxBulkLen", __config_protoMaxBulkLen},
+    {"max-multibulk-args", "Server", "MaxMultibulkArgs", __config_maxMultibulkArgs},
+    {"client-output-limit", "Server", "ClientOutputLimit", __config_clientOutputLimit},
+    {"client-output-timeout", "Server", "ClientOutputTimeout", __config_clientOutputTimeout},
+    {"rocksdb-dir", "Database", "DbDir", nil},
+    {"rocksdb-max-memory", "Database", "MaxMemory", nil},
+    {"rocksdb-block-size", "Database", "BlockSize", nil},
+    {"rocksdb-create-if-missing", "Database", "CreateIfMissing", nil},
+    {"rocksdb-bloom-filter", "Database", "BloomFilter", nil},
+    {"rocksdb-compression", "Database", "Compression", nil},
+    {"rocksdb-compaction-style", "Database", "CompactionStyle", nil},
+    {"rocksdb-max-open-files", "Database", "MaxOpenFiles", nil},
+    {"rocksdb-max-merge", "Database", "MaxMerge", nil},
+    {"rocksdb-write-buffer-size", "Database", "WriteBufferSize", __config_rocksdbOption("write_buffer_size")},
+    {"rocksdb-max-write-buffer-number", "Database", "MaxWriteBufferNumber", __config_rocksdbOption("max_write_buffer_number")},
+    {"rocksdb-level0-slowdown-writes-trigger", "Database", "Level0SlowdownWritesTrigger", __config_rocksdbOption("level0_slowdown_writes_trigger")},
+    {"rocksdb-disable-auto-compactions", "Database", "DisableAutoCompactions", __config_rocksdbOption("disable_auto_compactions")},
+}
+
+// OptionsSetter is implemented by the handlers with the options changeable at runtime,
+// e.g. the RocksDB mutable options.
+type OptionsSetter interface {
+    SetOptions(keys, values []string) error
+}
+
+// kConfigClientLimits are the params of ClientLimits
+var kConfigClientLimits = []string{
+    "maxclients", "timeout", "proto-max-bulk-len", "max-multibulk-args", "client-output-limit", "client-output-timeout",
+}
+
+// CONFIG GET pattern [pattern ...] | SET parameter value [parameter value ...] | REWRITE | RESETSTAT
+func (s *Server) RedisConfig(subCommand []byte, args ...[]byte) (interface{}, error) {
+    switch strings.ToLower(string(subCommand)) {
+    case "get":
+        if len(args) == 0 {
+            return nil, ErrWrongArgumentsCount
+        }
+        return s._config_get(args), nil
+    case "set":
+        if len(args) == 0 || len(args)%2 != 0 {
+            return nil, ErrWrongArgumentsCount
+        }
+        if err := s._config_set(args); err != nil {
+            return nil, err
+        }
+        return &StatusReply{"OK"}, nil
+    case "rewrite":
+        if len(args) != 0 {
+            return nil, ErrWrongArgumentsCount
+        }
+        if err := s._config_rewrite(); err != nil {
+            return nil, err
+        }
+        return &StatusReply{"OK"}, nil
+    case "resetstat":
+        if len(args) != 0 {
+            return nil, ErrWrongArgumentsCount
+        }
+        s.resetStats()
+        return &StatusReply{"OK"}, nil
+    }
+    return nil, ErrSyntax
+}
+
+func (s *Server) _config_get(patterns [][]byte) *MapReply {
+    s.configLock.Lock()
+    defer s.configLock.Unlock()
+    values := make([]interface{}, 0)
+    for _, p := range kConfigParams {
+        for _, pattern := range patterns {
+            if globMatch([]byte(strings.ToLower(string(pattern))), []byte(p.name)) {
+                value := __config_field(&globalStat.config, p)
+                values = append(values, []byte(p.name), []byte(__config_format(value, false)))
+                break
+            }
+        }
+    }
+    return &MapReply{values}
+}
+
+// _config_set changes all the parameters or none of them if any is invalid, see applyConfig
+func (s *Server) _config_set(args [][]byte) error {
+    s.configLock.Lock()
+    defer s.configLock.Unlock()
+    config := globalStat.config
+    params := make([]configParam, 0, len(args)/2)
+    for i := 0; i < len(args); i += 2 {
+        p, ok := __config_lookup(string(args[i]))
+        if !ok {
+            return fmt.Errorf("Unknown option or number of arguments for CONFIG SET - '%s'", args[i])
+        }
+        for _, seen := range params {
+            if seen.name == p.name {
+                return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", p.name)
+            }
+        }
+        if p.apply == nil && p.section == "Database" {
+            return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - the RocksDB options are only applied when the database is opened", p.name)
+        }
+        if p.apply == nil {
+            return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", p.name)
+        }
+        if err := __config_parse(__config_field(&config, p), string(args[i+1])); err != nil {
+            return fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - %s", p.name, err)
+        }
+        params = append(params, p)
+    }
+
+    if err := s.applyConfig(&config, params); err != nil {
+        return fmt.Errorf("CONFIG SET failed %s", err)
+    }
+    return nil
+}
+
+// ReloadConfig applies the settings changed in the config file, e.g. on SIGHUP, all of them or
+// none if any is invalid, the RocksDB mutable options included, which are only kept unchanged
+// if SetOptions fails. The settings read only at the
+// start are logged to need a restart, so is a RocksDB option back to the default.
+func (s *Server) ReloadConfig(config RockdisConfig) error {
+    s.configLock.Lock()
+    defer s.configLock.Unlock()
+    params, restarts := make([]configParam, 0), make([]configParam, 0)
+    for _, p := range kConfigParams {
+        if __config_field(&config, p).Interface() == __config_field(&globalStat.config, p).Interface() {
+            continue
+        }
+        value := __config_field(&config, p)
+        // a zero size or number keeps the RocksDB option, unlike false
+        if p.apply == nil || (p.section == "Database" && value.Kind() != reflect.Bool && __config_isZero(value)) {
+            restarts = append(restarts, p)
+        } else {
+            params = append(params, p)
+        }
+    }
+    err := s.applyConfig(&config, params)
+    for _, p := range params {
+        if __config_field(&config, p).Interface() != __config_field(&globalStat.config, p).Interface() {
+            // failed to change
+            continue
+        }
+        log.Printf("[Config] [%s] %s changed to %s", p.section, p.variable, __config_format(__config_field(&config, p), true))
+    }
+    for _, p := range restarts {
+        log.Printf("[Config] [%s] %s changed to %s, it needs a restart", p.section, p.variable, __config_format(__config_field(&config, p), true))
+    }
+    if config.Server.RequirePass != globalStat.config.Server.RequirePass {
+        log.Printf("[Config] [Server] RequirePass changed, it needs a restart")
+    }
+    return err
+}
+
+// applyConfig checks the params of the new config before changing any of them, the caller holds the configLock.
+// A change can still fail, e.g. SetOptions of RocksDB, then its value is not copied so CONFIG GET and
+// REWRITE keep the applied one, and the first failure is returned after the other changes.
+func (s *Server) applyConfig(config *RockdisConfig, params []configParam) error {
+    changes := make([]func() error, 0, len(params))
+    for _, p := range params {
+        change, err := p.apply(s, config)
+        if err != nil {
+            return fmt.Errorf("(possibly related to argument '%s') - %s", p.name, err)
+        }
+        changes = append(changes, change)
+    }
+    var failed error
+    globalStat.configLock.Lock()
+    defer globalStat.configLock.Unlock()
+    for i, p := range params {
+        if err := changes[i](); err != nil {
+            if failed == nil {
+                failed = fmt.Errorf("(possibly related to argument '%s') - %s", p.name, err)
+            }
+            continue
+        }
+        __config_field(&globalStat.config, p).Set(__config_field(config, p))
+    }
+    return failed
+}
+
+// _config_rewrite writes the settings which can change back to the config file, the lines are
+// edited in place so the comments and the other settings are kept. A setting missing in the file
+// is added to the end of its section unless it is the zero value, i.e. the default.
+func (s *Server) _config_rewrite() error {
+    s.configLock.Lock()
+    defer s.configLock.Unlock()
+    if globalStat.configFile == "" {
+        return ErrConfigNoFile
+    }
+    info, err := os.Stat(globalStat.configFile)
+    if err != nil {
+        return fmt.Errorf("Rewriting config file: %s", err)
+    }
+    content, err := ioutil.ReadFile(globalStat.configFile)
+    if err != nil {
+        return fmt.Errorf("Rewriting config file: %s", err)
+    }
+    lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+    for _, p := range kConfigParams {
+        if p.apply == nil {
+            continue
+        }
+        value := __config_field(&globalStat.config, p)
+        lines = __config_rewriteLine(lines, p, __config_format(value, true), __config_isZero(value))
+    }
+
+    tmpFile := globalStat.configFile + ".tmp"
+    if err := ioutil.WriteFile(tmpFile, []byte(strings.Join(lines, "\n")+"\n"), info.Mode().Perm()); err != nil {
+        return fmt.Errorf("Rewriting config file: %s", err)
+    }
+    if err := os.Rename(tmpFile, globalStat.configFile); err != nil {
+        return fmt.Errorf("Rewriting config file: %s", err)
+    }
+    return nil
+}
+
+// resetStats resets the counters of INFO, but not the gauges like connected_clients
+func (s *Server) resetStats() {
+    s.cmdstats.Reset()
+    globalStat.totalConnections.Set(0)
+    globalStat.rejectedConnections.Set(0)
+    globalStat.totalCommands.Set(0)
+    globalStat.keyHits.Set(0)
+    globalStat.keyMisses.Set(0)
+    globalStat.qpsCommands.Set(0)
+    globalStat.qpsStart.Set(time.Now().Unix())
+}
+
+func __config_monitorLog(s *Server, config *RockdisConfig) (func() error, error) {
+    monitorLog := int64(0)
+    if config.Server.MonitorLog {
+        monitorLog = 1
+    }
+    return func() error {
+        s.MonitorLog.Set(monitorLog)
+        return nil
+    }, nil
+}
+
+// __config_pubsubOutputLimit changes the limit of the clients entering the push mode later
+func __config_pubsubOutputLimit(s *Server, config *RockdisConfig) (func() error, error) {
+    limit, err := parsePubSubOutputLimit(config.Server.PubSubOutputLimit)
+    if err != nil {
+        return nil, fmt.Errorf("argument must be a memory value")
+    }
+    return func() error {
+        s.pubsubOutputLimit.Set(limit)
+        return nil
+    }, nil
+}
+
+func __config_notifyKeyspaceEvents(s *Server, config *RockdisConfig) (func() error, error) {
+    classes, err := parseNotifyKeyspaceEvents(config.Server.NotifyKeyspaceEvents)
+    if err != nil {
+        return nil, err
+    }
+    return func() error {
+        s.notifyClasses.Set(int64(classes))
+        return nil
+    }, nil
+}
+
+func __config_luaTimeLimit(s *Server, config *RockdisConfig) (func() error, error) {
+    timeLimit := time.Duration(config.Server.LuaTimeLimit) * time.Millisecond
+    return func() error {
+        s.scripting.SetTimeLimit(timeLimit)
+        return nil
+    }, nil
+}
+
+func __config_slowlogSlowerThan(s *Server, config *RockdisConfig) (func() error, error) {
+    slowerThan, err := parseSlowlogSlowerThan(config.Server.SlowlogLogSlowerThan)
+    if err != nil {
+        return nil, fmt.Errorf("argument must be a number")
+    }
+    return func() error {
+        s.slowlog.SetSlowerThan(slowerThan)
+        return nil
+    }, nil
+}
+
+// __config_slowlogMaxLen takes 0 to keep nothing, only the config file takes 0 for the default
+// as it can't tell an unset value from 0, see NewServer
+func __config_slowlogMaxLen(s *Server, config *RockdisConfig) (func() error, error) {
+    maxLen := config.Server.SlowlogMaxLen
+    if maxLen < 0 {
+        return nil, fmt.Errorf("argument must be greater than or equal to 0")
+    }
+    return func() error {
+        s.slowlog.SetMaxLen(maxLen)
+        return nil
+    }, nil
+}
+
+// __config_rocksdbOption changes the RocksDB mutable option of the open database by SetOptions,
+// the zero value keeps the option as it is.
+func __config_rocksdbOption(option string) func(s *Server, config *RockdisConfig) (func() error, error) {
+    return func(s *Server, config *RockdisConfig) (func() error, error) {
+        value, err := rocksdbMutableOption(config, option)
+        if err != nil || value == "" {
+            return func() error { return nil }, err
+        }
+        return func() error {
+            for _, setter := range s.optionsSetters {
+                if err := setter.SetOptions([]string{option}, []string{value}); err != nil {
+                    return err
+                }
+            }
+            return nil
+        }, nil
+    }
+}
+
+// __config_maxClients takes 0 for the default, the clients connected over the limit are kept
+func __config_maxClients(s *Server, config *RockdisConfig) (func() error, error) {
+    maxClients := config.Server.MaxClients
+    if maxClients < 0 {
+        return nil, fmt.Errorf("argument must be greater than or equal to 0")
+    }
+    if maxClients == 0 {
+        maxClients = kDefaultMaxClients
+    }
+    return func() error {
+        s.limits.maxClients.Set(int64(maxClients))
+        return nil
+    }, nil
+}
+
+// __config_timeout is the idle timeout in seconds, 0 to never close the idle clients
+func __config_timeout(s *Server, config *RockdisConfig) (func() error, error) {
+    if config.Server.Timeout < 0 {
+        return nil, fmt.Errorf("argument must be greater than or equal to 0")
+    }
+    timeout := time.Duration(config.Server.Timeout) * time.Second
+    return func() error {
+        s.limits.idleTimeout.Set(int64(timeout))
+        return nil
+    }, nil
+}
+
+func __config_protoMaxBulkLen(s *Server, config *RockdisConfig) (func() error, error) {
+    maxBulkLen, err := parseSizeLimit(config.Server.ProtoMaxBulkLen, kDefaultProtoMaxBulkLen)
+    if err != nil {
+        return nil, fmt.Errorf("argument must be a memory value")
+    }
+    if maxBulkLen < 1<<20 {
+        return nil, fmt.Errorf("argument must be at least 1mb")
+    }
+    return func() error {
+        s.limits.maxBulkLen.Set(maxBulkLen)
+        return nil
+    }, nil
+}
+
+// __config_maxMultibulkArgs takes 0 for the default
+func __config_maxMultibulkArgs(s *Server, config *RockdisConfig) (func() error, error) {
+    maxArgs := config.Server.MaxMultibulkArgs
+    if maxArgs < 0 {
+        return nil, fmt.Errorf("argument must be greater than or equal to 0")
+    }
+    if maxArgs == 0 {
+        maxArgs = kDefaultMaxMultibulkArgs
+    }
+    return func() error {
+        s.limits.maxArgs.Set(int64(maxArgs))
+        return nil
+    }, nil
+}
+
+func __config_clientOutputLimit(s *Server, config *RockdisConfig) (func() error, error) {
+    limit, err := parseSizeLimit(config.Server.ClientOutputLimit, 0)
+    if err != nil {
+        return nil, fmt.Errorf("argument must be a memory value")
+    }
+    return func() error {
+        s.limits.outputLimit.Set(limit)
+        return nil
+    }, nil
+}
+
+func __config_clientOutputTimeout(s *Server, config *RockdisConfig) (func() error, error) {
+    if config.Server.ClientOutputTimeout < 0 {
+        return nil, fmt.Errorf("argument must be greater than or equal to 0")
+    }
+    timeout := time.Duration(config.Server.ClientOutputTimeout) * time.Second
+    return func() error {
+        s.limits.outputTimeout.Set(int64(timeout))
+        return nil
+    }, nil
+}
+
+func __config_lookup(name string) (configParam, bool) {
+    name = strings.ToLower(name)
+    for _, p := range kConfigParams {
+        if p.name == name {
+            return p, true
+        }
+    }
+    return configParam{}, false
+}
+
+func __config_field(config *RockdisConfig, p configParam) reflect.Value {
+    return reflect.ValueOf(config).Elem().FieldByName(p.section).FieldByName(p.variable)
+}
+
+// __config_format formats the value for CONFIG GET, or for the config file with the strings
+// quoted when needed and the booleans as true/false.
+func __config_format(value reflect.Value, file bool) string {
+    switch value.Kind() {
+    case reflect.Bool:
+        if file {
+            return strconv.FormatBool(value.Bool())
+        }
+        if value.Bool() {
+            return "yes"
+        }
+        return "no"
+    case reflect.Int:
+        return strconv.FormatInt(value.Int(), 10)
+    }
+    if file && (value.String() == "" || strings.ContainsAny(value.String(), " \t;#\"\\")) {
+        return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value.String()) + `"`
+    }
+    return value.String()
+}
+
+func __config_parse(value reflect.Value, data string) error {
+    switch value.Kind() {
+    case reflect.Bool:
+        switch strings.ToLower(data) {
+        case "yes", "true", "on", "1":
+            value.SetBool(true)
+        case "no", "false", "off", "0":
+            value.SetBool(false)
+        default:
+            return fmt.Errorf("argument must be 'yes' or 'no'")
+        }
+    case reflect.Int:
+        n, err := strconv.Atoi(data)
+        if err != nil {
+            return fmt.Errorf("argument couldn't be parsed into an integer")
+        }
+        value.SetInt(int64(n))
+    default:
+        value.SetString(data)
+    }
+    return nil
+}
+
+func __config_isZero(value reflect.Value) bool {
+    return value.Interface() == reflect.Zero(value.Type()).Interface()
+}
+
+// __config_rewriteLine replaces the value of the variable in its section, or adds the line
+func __config_rewriteLine(lines []string, p configParam, value string, zero bool) []string {
+    section, sectionEnd := "", -1
+    for i, line := range lines {
+        trimmed := strings.TrimSpace(line)
+        if strings.HasPrefix(trimmed, "[") {
+            section = strings.Trim(strings.Fields(trimmed)[0], "[]")
+            continue
+        }
+        if !strings.EqualFold(section, p.section) {
+            continue
+        }
+        if trimmed != "" && trimmed[0] != ';' && trimmed[0] != '#' {
+            sectionEnd = i
+        }
+        if eq := strings.IndexByte(line, '='); eq > 0 && strings.EqualFold(strings.TrimSpace(line[:eq]), p.variable) {
+            lines[i] = __config_replaceValue(line, eq, value)
+            return lines
+        }
+    }
+    if zero {
+        return lines
+    }
+    newLine := p.variable + " = " + value
+    if sectionEnd < 0 {
+        return append(lines, "", "["+p.section+"]", newLine)
+    }
+    lines = append(lines, "")
+    copy(lines[sectionEnd+2:], lines[sectionEnd+1:])
+    lines[sectionEnd+1] = newLine
+    return lines
+}
+
+// __config_replaceValue keeps the name and the comment of the line "name = value ; comment"
+func __config_replaceValue(line string, eq int, value string) string {
+    quoted, end := false, len(line)
+    for i := eq + 1; i < len(line) && end == len(line); i++ {
+        switch c := line[i]; {
+        case c == '\\' && quoted:
+            i++
+        case c == '"':
+            quoted = !quoted
+        case !quoted && (c == ';' || c == '#'):
+            end = i
+        }
+    }
+    comment := ""
+    if end < len(line) {
+        comment = " " + line[end:]
+    }
+    return strings.TrimRight(line[:eq], " \t") + " = " + value + comment
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+    "fmt"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestConfigReplaceValue(t *testing.T) {
+    tests := []struct {
+        line  string
+        value string
+        want  string
+    }{
+        {"port = 6379", "6380", "port = 6380"},
+        {"port=6379", "6380", "port = 6380"},
+        {"  port   =6379#comment", "6380", "  port = 6380 #comment"},
+        {"port = 6379 ; the port", "6380", "port = 6380 ; the port"},
+        {`dbdir = "a;b" # the dir`, `"c"`, `dbdir = "c" # the dir`},
+        {`dbdir = "a\";b"`, `"c"`, `dbdir = "c"`},
+    }
+    for _, test := range tests {
+        eq := 0
+        for eq < len(test.line) && test.line[eq] != '=' {
+            eq++
+        }
+        if got := __config_replaceValue(test.line, eq, test.value); got != test.want {
+            t.Errorf("__config_replaceValue(%q, %q) = %q, want %q", test.line, test.value, got, test.want)
+        }
+    }
+}
+
+func TestConfigRewriteLine(t *testing.T) {
+    port := configParam{"port", "Server", "Port", nil}
+    tests := []struct {
+        name  string
+        lines []string
+        zero  bool
+        want  []string
+    }{
+        {
+            "replaced",
+            []string{"[Server]", "port = 6379"},
+            false,
+            []string{"[Server]", "port = 6380"},
+        },
+        {
+            "replaced case insensitive",
+            []string{"[server]", "Port = 6379 ; the port"},
+            false,
+            []string{"[server]", "Port = 6380 ; the port"},
+        },
+        {
+            "other section untouched",
+            []string{"[Database]", "port = 1", "[Server]", "bind = 127.0.0.1"},
+            false,
+            []string{"[Database]", "port = 1", "[Server]", "bind = 127.0.0.1", "Port = 6380"},
+        },
+        {
+            "added after the last variable",
+            []string{"[Server]", "bind = 127.0.0.1", "; a comment", "", "[Database]", "dbdir = /tmp"},
+            false,
+            []string{"[Server]", "bind = 127.0.0.1", "Port = 6380", "; a comment", "", "[Database]", "dbdir = /tmp"},
+        },
+        {
+            "section added",
+            []string{"[Database]", "dbdir = /tmp"},
+            false,
+            []string{"[Database]", "dbdir = /tmp", "", "[Server]", "Port = 6380"},
+        },
+        {
+            "zero value not added",
+            []string{"[Database]", "dbdir = /tmp"},
+            true,
+            []string{"[Database]", "dbdir = /tmp"},
+        },
+        {
+            "zero value replaced",
+            []string{"[Server]", "port = 6379"},
+            true,
+            []string{"[Server]", "port = 6380"},
+        },
+    }
+    for _, test := range tests {
+        got := __config_rewriteLine(test.lines, port, "6380", test.zero)
+        if !reflect.DeepEqual(got, test.want) {
+            t.Errorf("%s: __config_rewriteLine = %q, want %q", test.name, got, test.want)
+        }
+    }
+}
+
+type failedOptionsSetter struct{}
+
+func (f *failedOptionsSetter) SetOptions(keys, values []string) error {
+    return fmt.Errorf("Invalid argument: %s", keys[0])
+}
+
+func TestConfigSetRocksdbOptionFailed(t *testing.T) {
+    var config RockdisConfig
+    config.Database.WriteBufferSize = "32m"
+    globalStat.config = config
+    s := NewServer(config)
+    s.RegisterHandler(&failedOptionsSetter{})
+
+    _, err := s.RedisConfig([]byte("set"), []byte("rocksdb-write-buffer-size"), []byte("64m"), []byte("slowlog-max-len"), []byte("10"))
+    if err == nil {
+        t.Fatal("CONFIG SET replied OK with the RocksDB option not set")
+    }
+    if globalStat.config.Database.WriteBufferSize != "32m" {
+        t.Errorf("WriteBufferSize = %s, want the unchanged 32m", globalStat.config.Database.WriteBufferSize)
+    }
+    if globalStat.config.Server.SlowlogMaxLen != 10 {
+        t.Errorf("SlowlogMaxLen = %d, want 10", globalStat.config.Server.SlowlogMaxLen)
+    }
+}
+
+func TestConfigSetSlowlogMaxLenZero(t *testing.T) {
+    var config RockdisConfig
+    globalStat.config = config
+    s := NewServer(config)
+    if _, err := s.RedisConfig([]byte("set"), []byte("slowlog-max-len"), []byte("0")); err != nil {
+        t.Fatal(err)
+    }
+    s.slowlog.SetSlowerThan(0)
+    s.slowlog.Log(&Request{Command: "get"}, time.Millisecond)
+    if n := s.slowlog.Len(); n != 0 {
+        t.Errorf("SLOWLOG LEN = %d with slowlog-max-len 0, want 0", n)
+    }
+}
@@ -9,15 +9,38 @@ import (
     "os"
     "os/signal"
     "runtime"
+    "sync"
     "syscall"
     "time"
 )
 
 type RockdisConfig struct {
     Server struct {
-        Bind       string
-        Port       int
-        MonitorLog bool
+        Bind                 string
+        Port                 int
+        MonitorLog           bool
+        PubSubOutputLimit    string
+        NotifyKeyspaceEvents string
+        LuaTimeLimit         int
+        RequirePass          string
+        AclFile              string
+        TlsPort              int
+        TlsCertFile          string
+        TlsKeyFile           string
+        TlsCaCertFile        string
+        TlsAuthClients       string
+        UnixSocket           string
+        UnixSocketPerm       string
+        SlowlogLogSlowerThan string
+        SlowlogMaxLen        int
+        MetricsBind          string
+        MetricsPort          int
+        MaxClients           int
+        Timeout              int
+        ProtoMaxBulkLen      string
+        MaxMultibulkArgs     int
+        ClientOutputLimit    string
+        ClientOutputTimeout  int
     }
     Database struct {
         DbDir           string
@@ -29,6 +52,11 @@ type RockdisConfig struct {
         CompactionStyle string
         MaxOpenFiles    int
         MaxMerge        int
+        // the mutable options, changeable on the open database
+        WriteBufferSize             string
+        MaxWriteBufferNumber        int
+        Level0SlowdownWritesTrigger int
+        DisableAutoCompactions      bool
     }
 }
 
@@ -57,45 +85,76 @@ func main() {
 
     rock := NewRocksDBHandler(config)
     server := NewServer(config)
-    defer func() {
-        rock.Close()
-        server.Close()
-    }()
 
-    signalChan := make(chan os.Signal, 1)
-    signal.Notify(signalChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGABRT)
+    // the server shuts down gracefully and closes the database, a second signal exits at once
+    signalChan := make(chan os.Signal, 2)
+    signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGABRT)
     go func() {
         s := <-signalChan
-        log.Printf("[Main] Captured the signal %v", s)
-        rock.Close()
-        server.Close()
-        os.Exit(0)
+        log.Printf("[Main] Captured the signal %v, shutting down", s)
+        server.RequestShutdown(true)
+        s = <-signalChan
+        log.Printf("[Main] Captured the signal %v again, exiting", s)
+        os.Exit(1)
+    }()
+
+    // SIGHUP reloads the config file while serving
+    reloadChan := make(chan os.Signal, 1)
+    signal.Notify(reloadChan, syscall.SIGHUP)
+    go func() {
+        for _ = range reloadChan {
+            log.Printf("[Main] Captured the signal SIGHUP, reloading the config file %s", confName)
+            var newConfig RockdisConfig
+            if err := gcfg.ReadFileInto(&newConfig, confName); err != nil {
+                log.Printf("[Main] Failed to reload the config file, %s", err)
+                continue
+            }
+            if err := server.ReloadConfig(newConfig); err != nil {
+                log.Printf("[Main] Failed to reload the config file %s", err)
+            }
+        }
     }()
 
     if err := server.RegisterHandler(rock); err != nil {
         log.Fatalf("[Main] Register Handler error, %s", err)
     }
+    if err := server.RegisterHandler(server); err != nil {
+        log.Fatalf("[Main] Register Handler error, %s", err)
+    }
     if err := server.ListenAndServe(); err != nil {
         log.Fatalf("[Main] ListenAndServe error, %s", err)
     }
+    server.Close()
 }
 
 type Stat struct {
-    version          string
-    configFile       string
-    config           RockdisConfig
-    startTime        time.Time
-    clients          AtomicInt
-    totalConnections AtomicInt
-    totalCommands    AtomicInt
-    keyHits          AtomicInt
-    keyMisses        AtomicInt
-    qpsCommands      AtomicInt
-    qpsStart         AtomicInt
+    version    string
+    configFile string
+    // config is written by CONFIG SET and the reload under configLock, the CONFIG commands
+    // serialized by the configLock of the server read it directly, the others use Config
+    configLock          sync.RWMutex
+    config              RockdisConfig
+    startTime           time.Time
+    clients             AtomicInt
+    blockedClients      AtomicInt
+    totalConnections    AtomicInt
+    rejectedConnections AtomicInt
+    totalCommands       AtomicInt
+    keyHits             AtomicInt
+    keyMisses           AtomicInt
+    qpsCommands         AtomicInt
+    qpsStart            AtomicInt
 }
 
 var globalStat *Stat
 
+// Config returns a copy of the config, the settings can change at runtime
+func (st *Stat) Config() RockdisConfig {
+    st.configLock.RLock()
+    defer st.configLock.RUnlock()
+    return st.config
+}
+
 func init() {
     globalStat = &Stat{version: "0.0.1"}
     log.SetFlags(log.LstdFlags | log.Lshortfile)
@@ -0,0 +1,198 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "runtime"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// The metrics are written in the Prometheus text format by hand, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+// kMetricsLatencyBuckets are the upper bounds in microseconds of the latency histograms,
+// a bucket of the command histogram is counted in the first bound above its highest value.
+var kMetricsLatencyBuckets = []int64{
+    10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 25000, 50000, 100000, 250000, 500000, 1000000,
+}
+
+// MetricsWriter is implemented by the handlers which export their own metrics,
+// e.g. the RocksDB properties.
+type MetricsWriter interface {
+    WriteMetrics(w io.Writer)
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    s.writeMetrics(w)
+    for _, mw := range s.metricsWriters {
+        mw.WriteMetrics(w)
+    }
+}
+
+func (s *Server) writeMetrics(w io.Writer) {
+    __metrics_write(w, "rockdis_uptime_seconds", "gauge", "Seconds since the server started.",
+        time.Since(globalStat.startTime).Seconds())
+    __metrics_write(w, "rockdis_connected_clients", "gauge", "Number of the client connections.",
+        float64(globalStat.clients.Get()))
+    __metrics_write(w, "rockdis_blocked_clients", "gauge", "Number of the clients blocked on keys.",
+        float64(globalStat.blockedClients.Get()))
+    __metrics_write(w, "rockdis_connections_received_total", "counter", "Total number of the connections accepted.",
+        float64(globalStat.totalConnections.Get()))
+    __metrics_write(w, "rockdis_connections_rejected_total", "counter", "Number of the connections rejected by maxclients.",
+        float64(globalStat.rejectedConnections.Get()))
+    __metrics_write(w, "rockdis_commands_processed_total", "counter", "Total number of the commands processed.",
+        float64(globalStat.totalCommands.Get()))
+    __metrics_write(w, "rockdis_keyspace_hits_total", "counter", "Number of the successful lookups of keys.",
+        float64(globalStat.keyHits.Get()))
+    __metrics_write(w, "rockdis_keyspace_misses_total", "counter", "Number of the failed lookups of keys.",
+        float64(globalStat.keyMisses.Get()))
+    s.cmdstats.WriteMetrics(w)
+
+    var memStats runtime.MemStats
+    runtime.ReadMemStats(&memStats)
+    __metrics_write(w, "go_goroutines", "gauge", "Number of goroutines that currently exist.",
+        float64(runtime.NumGoroutine()))
+    __metrics_write(w, "go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.",
+        float64(memStats.Alloc))
+    __metrics_write(w, "go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.",
+        float64(memStats.Sys))
+    __metrics_write(w, "go_memstats_heap_objects", "gauge", "Number of allocated objects.",
+        float64(memStats.HeapObjects))
+    __metrics_write(w, "go_memstats_gc_count_total", "counter", "Number of the completed GC cycles.",
+        float64(memStats.NumGC))
+    __metrics_write(w, "go_memstats_gc_pause_seconds_total", "counter", "Total seconds the GC paused the program.",
+        float64(memStats.PauseTotalNs)/float64(time.Second))
+    __metrics_write(w, "go_cgo_calls_total", "counter", "Number of the cgo calls, e.g. to RocksDB.",
+        float64(runtime.NumCgoCall()))
+}
+
+// WriteMetrics exports the commands ever called
+func (cs *CommandStats) WriteMetrics(w io.Writer) {
+    names := cs.names()
+    __metrics_header(w, "rockdis_command_calls_total", "counter", "Number of the calls of the command.")
+    for _, name := range names {
+        __metrics_sample(w, "rockdis_command_calls_total", __metrics_label("cmd", name), float64(cs.stats[name].calls.Get()))
+    }
+    __metrics_header(w, "rockdis_command_rejected_calls_total", "counter", "Number of the calls refused before served, e.g. by ACL.")
+    for _, name := range names {
+        __metrics_sample(w, "rockdis_command_rejected_calls_total", __metrics_label("cmd", name), float64(cs.stats[name].rejected.Get()))
+    }
+    __metrics_header(w, "rockdis_command_failed_calls_total", "counter", "Number of the calls replied with an error.")
+    for _, name := range names {
+        __metrics_sample(w, "rockdis_command_failed_calls_total", __metrics_label("cmd", name), float64(cs.stats[name].failed.Get()))
+    }
+
+    __metrics_header(w, "rockdis_command_latency_seconds", "histogram", "Latency of the command, without the time blocked on keys.")
+    for _, name := range names {
+        stat := cs.stats[name]
+        label := __metrics_label("cmd", name)
+        var counts [kHistogramBuckets]int64
+        var total int64
+        for i := range counts {
+            counts[i] = stat.latency.counts[i].Get()
+            total += counts[i]
+        }
+        if total == 0 {
+            continue
+        }
+        index, cumulative := 0, int64(0)
+        for _, bound := range kMetricsLatencyBuckets {
+            for ; index < kHistogramBuckets && __histogram_highest(index) <= bound; index++ {
+                cumulative += counts[index]
+            }
+            __metrics_sample(w, "rockdis_command_latency_seconds_bucket",
+                label+","+__metrics_label("le", __metrics_float(float64(bound)/1e6)), float64(cumulative))
+        }
+        __metrics_sample(w, "rockdis_command_latency_seconds_bucket", label+`,le="+Inf"`, float64(total))
+        __metrics_sample(w, "rockdis_command_latency_seconds_sum", label, float64(stat.usec.Get())/1e6)
+        __metrics_sample(w, "rockdis_command_latency_seconds_count", label, float64(total))
+    }
+}
+
+// WriteMetrics exports the RocksDB properties, a property unknown to the RocksDB built with is skipped
+func (rh *RocksDBHandler) WriteMetrics(w io.Writer) {
+    rh.dbLock.RLock()
+    defer rh.dbLock.RUnlock()
+    if rh.db == nil {
+        return
+    }
+    properties := []struct {
+        name, kind, help, property string
+    }{
+        {"rockdis_rocksdb_memtable_bytes", "gauge", "Size of all the memtables.", "rocksdb.cur-size-all-mem-tables"},
+        {"rockdis_rocksdb_pending_compaction_bytes", "gauge", "Estimated bytes the compaction needs to rewrite.", "rocksdb.estimate-pending-compaction-bytes"},
+        {"rockdis_rocksdb_block_cache_usage_bytes", "gauge", "Memory size of the entries in the block cache.", "rocksdb.block-cache-usage"},
+        {"rockdis_rocksdb_estimated_keys", "gauge", "Estimated number of the keys.", "rocksdb.estimate-num-keys"},
+        {"rockdis_rocksdb_write_stopped", "gauge", "1 if the writes are stopped.", "rocksdb.is-write-stopped"},
+        {"rockdis_rocksdb_delayed_write_rate", "gauge", "The write rate in bytes per second if the writes are delayed, 0 if not.", "rocksdb.actual-delayed-write-rate"},
+    }
+    for _, p := range properties {
+        if value, ok := rh.getIntProperty(p.property); ok {
+            __metrics_write(w, p.name, p.kind, p.help, float64(value))
+        }
+    }
+
+    header := false
+    for level := 0; level < kRocksdbMaxLevels; level++ {
+        value, ok := rh.getIntProperty(fmt.Sprintf("rocksdb.num-files-at-level%d", level))
+        if !ok {
+            continue
+        }
+        if !header {
+            __metrics_header(w, "rockdis_rocksdb_sst_files", "gauge", "Number of the SST files at the level.")
+            header = true
+        }
+        __metrics_sample(w, "rockdis_rocksdb_sst_files", __metrics_label("level", strconv.Itoa(level)), float64(value))
+    }
+
+    // the stall counters are only in the text of the stats, e.g.
+    // Stalls(count): 0 level0_slowdown, 0 level0_numfiles, 0 memtable_compaction, 0 leveln_slowdown
+    for _, line := range strings.Split(rh.db.GetProperty("rocksdb.stats"), "\n") {
+        if !strings.HasPrefix(line, "Stalls(count):") {
+            continue
+        }
+        __metrics_header(w, "rockdis_rocksdb_stalls_total", "counter", "Number of the write stalls by the cause.")
+        for _, stall := range strings.Split(strings.TrimPrefix(line, "Stalls(count):"), ",") {
+            fields := strings.Fields(stall)
+            if len(fields) != 2 {
+                continue
+            }
+            if value, err := strconv.ParseFloat(fields[0], 64); err == nil {
+                __metrics_sample(w, "rockdis_rocksdb_stalls_total", __metrics_label("cause", fields[1]), value)
+            }
+        }
+        break
+    }
+}
+
+// kRocksdbMaxLevels is the default num_levels of RocksDB
+const kRocksdbMaxLevels = 7
+
+func __metrics_write(w io.Writer, name, kind, help string, value float64) {
+    __metrics_header(w, name, kind, help)
+    __metrics_sample(w, name, "", value)
+}
+
+func __metrics_header(w io.Writer, name, kind, help string) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func __metrics_sample(w io.Writer, name, labels string, value float64) {
+    if labels != "" {
+        fmt.Fprintf(w, "%s{%s} %s\n", name, labels, __metrics_float(value))
+    } else {
+        fmt.Fprintf(w, "%s %s\n", name, __metrics_float(value))
+    }
+}
+
+func __metrics_label(name, value string) string {
+    return name + "=" + strconv.Quote(value)
+}
+
+func __metrics_float(value float64) string {
+    return strconv.FormatFloat(value, 'g', -1, 64)
+}
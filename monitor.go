@@ -0,0 +1,121 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// kMonitorRedacted are the commands with the passwords in the arguments
+var kMonitorRedacted = map[string]bool{"auth": true, "hello": true, "acl": true}
+
+// Monitors are the clients streaming the commands served, each line is queued to the
+// client in push mode, so a slow monitor is disconnected instead of stalling the others.
+type Monitors struct {
+    sync.RWMutex
+    clients map[*Client]bool
+    count   AtomicInt
+}
+
+func NewMonitors() *Monitors {
+    return &Monitors{clients: make(map[*Client]bool)}
+}
+
+func (m *Monitors) Add(client *Client) {
+    m.Lock()
+    defer m.Unlock()
+    if !m.clients[client] {
+        m.clients[client] = true
+        client.monitoring.Set(1)
+        m.count.Add(1)
+    }
+}
+
+func (m *Monitors) Remove(client *Client) {
+    m.Lock()
+    defer m.Unlock()
+    if m.clients[client] {
+        delete(m.clients, client)
+        client.monitoring.Set(0)
+        m.count.Add(-1)
+    }
+}
+
+// Active tells if any line should be formatted, without the lock
+func (m *Monitors) Active() bool {
+    return m.count.Get() > 0
+}
+
+func (m *Monitors) Feed(line string) {
+    m.RLock()
+    defer m.RUnlock()
+    data := []byte("+" + line + "\r\n")
+    for client := range m.clients {
+        client.Push(data)
+    }
+}
+
+// MONITOR streams the commands served by the server until the connection is closed
+func (s *Server) RedisMonitor(request *Request) (Reply, error) {
+    if request.Client == nil {
+        return nil, ErrNotFromClient
+    }
+    request.Client.EnterPushMode(s.pubsubOutputLimit.Get())
+    if err := request.Client.WriteReply(&StatusReply{"OK"}); err != nil {
+        return nil, err
+    }
+    s.monitors.Add(request.Client)
+    return &PushedReply{}, nil
+}
+
+// __monitor_format formats the line the way Redis does, e.g. 1339518083.107412 [0 127.0.0.1:60866] "keys" "*"
+func __monitor_format(request *Request) string {
+    var buffer bytes.Buffer
+    fmt.Fprintf(&buffer, "%.6f [0 %s] ", float64(time.Now().UTC().UnixNano())/1e9, request.RemoteAddress)
+    __monitor_repr(&buffer, []byte(request.Command))
+    for _, arg := range request.Arguments {
+        buffer.WriteByte(' ')
+        if kMonitorRedacted[request.Command] {
+            buffer.WriteString(`"(redacted)"`)
+        } else {
+            __monitor_repr(&buffer, arg)
+        }
+    }
+    return buffer.String()
+}
+
+// __monitor_repr quotes the argument and escapes the non printable bytes, so the line
+// never breaks the protocol
+func __monitor_repr(buffer *bytes.Buffer, arg []byte) {
+    buffer.WriteByte('"')
+    for _, b := range arg {
+        switch b {
+        case '\\', '"':
+            buffer.WriteByte('\\')
+            buffer.WriteByte(b)
+        case '\n':
+            buffer.WriteString(`\n`)
+        case '\r':
+            buffer.WriteString(`\r`)
+        case '\t':
+            buffer.WriteString(`\t`)
+        case '\a':
+            buffer.WriteString(`\a`)
+        case '\b':
+            buffer.WriteString(`\b`)
+        default:
+            if b >= ' ' && b <= '~' {
+                buffer.WriteByte(b)
+            } else {
+                buffer.WriteString(`\x`)
+                if b < 0x10 {
+                    buffer.WriteByte('0')
+                }
+                buffer.WriteString(strconv.FormatInt(int64(b), 16))
+            }
+        }
+    }
+    buffer.WriteByte('"')
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+    "fmt"
+)
+
+// Keyspace notification classes, configured like notify-keyspace-events of redis. The expired (x),
+// evicted (e) and key miss (m) classes are rejected as the keys never expire nor are evicted, and
+// the misses are not notified.
+const (
+    kNotifyKeyspace = 1 << iota // K
+    kNotifyKeyevent             // E
+    kNotifyGeneric              // g
+    kNotifyString               // $
+    kNotifyList                 // l
+    kNotifySet                  // s
+    kNotifyHash                 // h
+    kNotifyZSet                 // z
+    kNotifyStream               // t
+    kNotifyAll                  = kNotifyGeneric | kNotifyString | kNotifyList | kNotifySet | kNotifyHash | kNotifyZSet | kNotifyStream
+)
+
+var (
+    kKeyspaceChannelPrefix = []byte("__keyspace@0__:")
+    kKeyeventChannelPrefix = []byte("__keyevent@0__:")
+)
+
+func parseNotifyKeyspaceEvents(flags string) (int, error) {
+    classes := 0
+    for _, c := range flags {
+        switch c {
+        case 'A':
+            classes |= kNotifyAll
+        case 'g':
+            classes |= kNotifyGeneric
+        case '$':
+            classes |= kNotifyString
+        case 'l':
+            classes |= kNotifyList
+        case 's':
+            classes |= kNotifySet
+        case 'h':
+            classes |= kNotifyHash
+        case 'z':
+            classes |= kNotifyZSet
+        case 't':
+            classes |= kNotifyStream
+        case 'x', 'e', 'm':
+            return 0, fmt.Errorf("Unsupported keyspace event flag '%c', the expired, evicted and key miss events are never notified", c)
+        case 'K':
+            classes |= kNotifyKeyspace
+        case 'E':
+            classes |= kNotifyKeyevent
+        default:
+            return 0, fmt.Errorf("Invalid keyspace event flag '%c'", c)
+        }
+    }
+    return classes, nil
+}
+
+func notifyKeyspaceEventsString(classes int) string {
+    flags := ""
+    if classes&kNotifyAll == kNotifyAll {
+        flags += "A"
+    } else {
+        for _, f := range []struct {
+            class int
+            flag  string
+        }{
+            {kNotifyGeneric, "g"}, {kNotifyString, "$"}, {kNotifyList, "l"}, {kNotifySet, "s"},
+            {kNotifyHash, "h"}, {kNotifyZSet, "z"}, {kNotifyStream, "t"},
+        } {
+            if classes&f.class != 0 {
+                flags += f.flag
+            }
+        }
+    }
+    if classes&kNotifyKeyspace != 0 {
+        flags += "K"
+    }
+    if classes&kNotifyKeyevent != 0 {
+        flags += "E"
+    }
+    return flags
+}
+
+func __notify_typeClass(objType string) int {
+    switch objType {
+    case kRedisString:
+        return kNotifyString
+    case kRedisList:
+        return kNotifyList
+    case kRedisHash:
+        return kNotifyHash
+    case kRedisSet:
+        return kNotifySet
+    case kRedisStream:
+        return kNotifyStream
+    case kRedisZSet:
+        return kNotifyZSet
+    }
+    return kNotifyGeneric
+}
+
+// NotifyKeyspaceEvent publishes the event of the key if the class is enabled,
+// it only costs an atomic load when the notifications are disabled.
+func (s *Server) NotifyKeyspaceEvent(class int, event string, key []byte) {
+    classes := int(s.notifyClasses.Get())
+    if classes&class == 0 {
+        return
+    }
+    if classes&kNotifyKeyspace != 0 {
+        channel := append(append([]byte{}, kKeyspaceChannelPrefix...), key...)
+        s.broker.Publish(channel, []byte(event))
+    }
+    if classes&kNotifyKeyevent != 0 {
+        channel := append(append([]byte{}, kKeyeventChannelPrefix...), event...)
+        s.broker.Publish(channel, key)
+    }
+}
@@ -5,6 +5,7 @@ import (
     "fmt"
     "io"
     "io/ioutil"
+    "math"
     "reflect"
     "strconv"
     "strings"
@@ -15,6 +16,7 @@ type Request struct {
     Arguments     [][]byte
     RemoteAddress string
     Connection    io.ReadCloser
+    Client        *Client
 }
 
 func (r *Request) HasArgument(index int) bool {
@@ -39,11 +41,11 @@ func (r *Request) GetInt(index int) (int, *ErrorReply) {
     }
 }
 
-func NewRequest(conn io.ReadCloser) (*Request, error) {
-    reader := bufio.NewReader(conn)
-
+// NewRequest reads a request, the lengths claimed by the client are checked against maxArgs and
+// maxBulkLen before anything is allocated for them.
+func NewRequest(reader *bufio.Reader, maxArgs int, maxBulkLen int64) (*Request, error) {
     // *<number of arguments>CRLF
-    line, err := reader.ReadString('\n')
+    line, err := readLine(reader)
     if err != nil {
         return nil, err
     }
@@ -53,22 +55,24 @@ func NewRequest(conn io.ReadCloser) (*Request, error) {
         if _, err := fmt.Sscanf(line, "*%d\r", &argCount); err != nil {
             return nil, Malformed("*<#Arguments>", line)
         }
+        if argCount < 1 || argCount > maxArgs {
+            return nil, ErrInvalidMultibulkLen
+        }
         // $<number of bytes of argument 1>CRLF
         // <argument data>CRLF
-        command, err := readArgument(reader)
+        command, err := readArgument(reader, maxBulkLen)
         if err != nil {
             return nil, err
         }
         arguments := make([][]byte, argCount-1)
         for i := 0; i < argCount-1; i++ {
-            if arguments[i], err = readArgument(reader); err != nil {
+            if arguments[i], err = readArgument(reader, maxBulkLen); err != nil {
                 return nil, err
             }
         }
         return &Request{
-            Command:    strings.ToLower(string(command)),
-            Arguments:  arguments,
-            Connection: conn,
+            Command:   strings.ToLower(string(command)),
+            Arguments: arguments,
         }, nil
     }
 
@@ -81,15 +85,16 @@ func NewRequest(conn io.ReadCloser) (*Request, error) {
         }
     }
     return &Request{
-        Command:    strings.ToLower(fields[0]),
-        Arguments:  arguments,
-        Connection: conn,
+        Command:   strings.ToLower(fields[0]),
+        Arguments: arguments,
     }, nil
 }
 
-func readArgument(reader *bufio.Reader) ([]byte, error) {
-    line, err := reader.ReadString('\n')
-    if err != nil {
+func readArgument(reader *bufio.Reader, maxBulkLen int64) ([]byte, error) {
+    line, err := readLine(reader)
+    if err == ErrTooBigInline {
+        return nil, err
+    } else if err != nil {
         return nil, Malformed("$<ArgumentLength>", line)
     }
 
@@ -97,6 +102,9 @@ func readArgument(reader *bufio.Reader) ([]byte, error) {
     if _, err := fmt.Sscanf(line, "$%d\r", &argLength); err != nil {
         return nil, Malformed("$<ArgumentLength>", line)
     }
+    if argLength < 0 || int64(argLength) > maxBulkLen {
+        return nil, ErrInvalidBulkLen
+    }
 
     data, err := ioutil.ReadAll(io.LimitReader(reader, int64(argLength)))
     if err != nil {
@@ -115,6 +123,33 @@ func readArgument(reader *bufio.Reader) ([]byte, error) {
     return data, nil
 }
 
+const (
+    kMaxInlineLen            = 64 << 10
+    kDefaultProtoMaxBulkLen  = 512 << 20
+    kDefaultMaxMultibulkArgs = 1024 * 1024
+)
+
+var (
+    ErrTooBigInline        = fmt.Errorf("Protocol error: too big inline request")
+    ErrInvalidMultibulkLen = fmt.Errorf("Protocol error: invalid multibulk length")
+    ErrInvalidBulkLen      = fmt.Errorf("Protocol error: invalid bulk length")
+)
+
+// readLine reads a line up to kMaxInlineLen, so a client never sending the LF can't take the memory
+func readLine(reader *bufio.Reader) (string, error) {
+    var line []byte
+    for {
+        data, err := reader.ReadSlice('\n')
+        if len(line)+len(data) > kMaxInlineLen {
+            return "", ErrTooBigInline
+        }
+        line = append(line, data...)
+        if err != bufio.ErrBufferFull {
+            return string(line), err
+        }
+    }
+}
+
 func Malformed(expected string, got string) error {
     return fmt.Errorf("Mailformed request: %s does not match %s", got, expected)
 }
@@ -129,6 +164,30 @@ func MalformedMissingCRLF() error {
 
 type Reply io.WriterTo
 
+// The protocol versions negotiated by HELLO, a client speaks RESP2 until it asks for RESP3
+const (
+    kProtoResp2 = 2
+    kProtoResp3 = 3
+)
+
+// resp3Writer tells the replies, and the nested ones, to write in RESP3
+type resp3Writer struct {
+    io.Writer
+}
+
+// newProtoWriter wraps the writer of a client speaking the protocol
+func newProtoWriter(w io.Writer, proto int) io.Writer {
+    if proto == kProtoResp3 {
+        return &resp3Writer{w}
+    }
+    return w
+}
+
+func isResp3(w io.Writer) bool {
+    _, ok := w.(*resp3Writer)
+    return ok
+}
+
 var (
     ErrMethodNotSupported   = &ErrorReply{"Method is not supported"}
     ErrNotEnoughArgs        = &ErrorReply{"Not enough arguments for the command"}
@@ -153,6 +212,28 @@ func (er *ErrorReply) Error() string {
     return er.message
 }
 
+// CodeErrorReply is an error reply with its own code instead of ERROR, e.g. NOSCRIPT or BUSY,
+// the clients dispatch on the code. A handler may return it as the error.
+type CodeErrorReply struct {
+    code    string
+    message string
+}
+
+func (er *CodeErrorReply) WriteTo(w io.Writer) (int64, error) {
+    n, err := w.Write([]byte("-" + er.code + " " + er.message + "\r\n"))
+    return int64(n), err
+}
+
+func (er *CodeErrorReply) Error() string {
+    return er.code + " " + er.message
+}
+
+func guardRequest() GuarderFn {
+    return func(request *Request) (reflect.Value, *ErrorReply) {
+        return reflect.ValueOf(request), nil
+    }
+}
+
 func guardRequestByteArg(index int) GuarderFn {
     return func(request *Request) (reflect.Value, *ErrorReply) {
         if err := request.ExpectArgument(index); err != nil {
@@ -180,6 +261,13 @@ func guardRequestIntArg(index int) GuarderFn {
     }
 }
 
+// PushedReply writes nothing, the reply has been pushed to the client by the handler
+type PushedReply struct{}
+
+func (r *PushedReply) WriteTo(w io.Writer) (int64, error) {
+    return 0, nil
+}
+
 type StatusReply struct {
     code string
 }
@@ -212,7 +300,8 @@ type MultiBulkReply struct {
 
 func (r *MultiBulkReply) WriteTo(w io.Writer) (int64, error) {
     if r.values == nil {
-        return 0, fmt.Errorf("Multi bulk reply found a nil values")
+        // null multi bulk, e.g. a blocking pop timed out
+        return writeNullArray(w)
     }
     if wrote, err := w.Write([]byte("*" + strconv.Itoa(len(r.values)) + "\r\n")); err != nil {
         return int64(wrote), err
@@ -229,6 +318,130 @@ func (r *MultiBulkReply) WriteTo(w io.Writer) (int64, error) {
     }
 }
 
+// ArrayReply is a multi bulk reply with mixed or nested values, e.g. integers and arrays
+type ArrayReply struct {
+    values []interface{}
+}
+
+func (r *ArrayReply) WriteTo(w io.Writer) (int64, error) {
+    if r.values == nil {
+        return writeNullArray(w)
+    }
+    return writeAggregate(w, '*', len(r.values), r.values)
+}
+
+// MapReply holds the keys and the values in turn, it is flattened to an array for RESP2
+type MapReply struct {
+    values []interface{}
+}
+
+func (r *MapReply) WriteTo(w io.Writer) (int64, error) {
+    if !isResp3(w) {
+        return writeAggregate(w, '*', len(r.values), r.values)
+    }
+    return writeAggregate(w, '%', len(r.values)/2, r.values)
+}
+
+// SetReply is an array of unordered and unique values for RESP2
+type SetReply struct {
+    values []interface{}
+}
+
+func (r *SetReply) WriteTo(w io.Writer) (int64, error) {
+    if !isResp3(w) {
+        return writeAggregate(w, '*', len(r.values), r.values)
+    }
+    return writeAggregate(w, '~', len(r.values), r.values)
+}
+
+// PushReply is an out of band message, e.g. the pub/sub messages, which is an array for RESP2
+type PushReply struct {
+    values []interface{}
+}
+
+func (r *PushReply) WriteTo(w io.Writer) (int64, error) {
+    if !isResp3(w) {
+        return writeAggregate(w, '*', len(r.values), r.values)
+    }
+    return writeAggregate(w, '>', len(r.values), r.values)
+}
+
+// DoubleReply is a bulk string of the number for RESP2
+type DoubleReply struct {
+    value float64
+}
+
+func (r *DoubleReply) WriteTo(w io.Writer) (int64, error) {
+    if !isResp3(w) {
+        return writeBytes([]byte(formatDouble(r.value)), w)
+    }
+    n, err := w.Write([]byte("," + formatDouble(r.value) + "\r\n"))
+    return int64(n), err
+}
+
+// NullReply is the null bulk string for RESP2
+type NullReply struct{}
+
+func (r *NullReply) WriteTo(w io.Writer) (int64, error) {
+    return writeNullBytes(w)
+}
+
+// BooleanReply is the integer 1 or 0 for RESP2
+type BooleanReply struct {
+    value bool
+}
+
+func (r *BooleanReply) WriteTo(w io.Writer) (int64, error) {
+    var data string
+    switch {
+    case isResp3(w) && r.value:
+        data = "#t\r\n"
+    case isResp3(w):
+        data = "#f\r\n"
+    case r.value:
+        data = ":1\r\n"
+    default:
+        data = ":0\r\n"
+    }
+    n, err := w.Write([]byte(data))
+    return int64(n), err
+}
+
+// BigNumberReply holds the decimal digits of an integer out of the 64 bits range,
+// it is a bulk string for RESP2
+type BigNumberReply struct {
+    value string
+}
+
+func (r *BigNumberReply) WriteTo(w io.Writer) (int64, error) {
+    if !isResp3(w) {
+        return writeBytes([]byte(r.value), w)
+    }
+    n, err := w.Write([]byte("(" + r.value + "\r\n"))
+    return int64(n), err
+}
+
+// VerbatimReply is a text with its format of three chars, e.g. txt or mkd, the format
+// is dropped for RESP2
+type VerbatimReply struct {
+    format string
+    value  []byte
+}
+
+func (r *VerbatimReply) WriteTo(w io.Writer) (int64, error) {
+    if !isResp3(w) {
+        return writeBytes(r.value, w)
+    }
+    data := make([]byte, 0, len(r.value)+32)
+    data = append(data, '=')
+    data = strconv.AppendInt(data, int64(len(r.format)+1+len(r.value)), 10)
+    data = append(data, "\r\n"+r.format+":"...)
+    data = append(data, r.value...)
+    data = append(data, "\r\n"...)
+    n, err := w.Write(data)
+    return int64(n), err
+}
+
 func NewReply(s *Server, request *Request, value interface{}) (Reply, error) {
     switch v := value.(type) {
     case []byte:
@@ -237,25 +450,92 @@ func NewReply(s *Server, request *Request, value interface{}) (Reply, error) {
         return &MultiBulkReply{v}, nil
     case int:
         return &IntReply{v}, nil
+    case []interface{}:
+        return &ArrayReply{v}, nil
+    case float64:
+        return &DoubleReply{v}, nil
+    case bool:
+        return &BooleanReply{v}, nil
     case *StatusReply:
         return v, nil
+    case Reply:
+        return v, nil
     default:
         return nil, fmt.Errorf("Unsupported type: %s (%T)", v, v)
     }
 }
 
+// bytesToValues converts the bulks to the values of an aggregate reply, e.g. a MapReply
+func bytesToValues(data [][]byte) []interface{} {
+    values := make([]interface{}, len(data))
+    for i := range data {
+        values[i] = data[i]
+    }
+    return values
+}
+
 func writeNullBytes(w io.Writer) (int64, error) {
+    if isResp3(w) {
+        n, err := w.Write([]byte("_\r\n"))
+        return int64(n), err
+    }
     n, err := w.Write([]byte("$-1\r\n"))
     return int64(n), err
 }
 
+func writeNullArray(w io.Writer) (int64, error) {
+    if isResp3(w) {
+        n, err := w.Write([]byte("_\r\n"))
+        return int64(n), err
+    }
+    n, err := w.Write([]byte("*-1\r\n"))
+    return int64(n), err
+}
+
+// writeAggregate writes the header of the kind, e.g. * for an array, then the values,
+// which are either the nested replies or the values of writeBytes
+func writeAggregate(w io.Writer, kind byte, count int, values []interface{}) (int64, error) {
+    wrote, err := w.Write([]byte(string(kind) + strconv.Itoa(count) + "\r\n"))
+    total := int64(wrote)
+    if err != nil {
+        return total, err
+    }
+    for _, value := range values {
+        var wroteData int64
+        if reply, ok := value.(Reply); ok {
+            wroteData, err = reply.WriteTo(w)
+        } else {
+            wroteData, err = writeBytes(value, w)
+        }
+        total += wroteData
+        if err != nil {
+            return total, err
+        }
+    }
+    return total, nil
+}
+
+// formatDouble formats the number the way Redis does, e.g. 1.5, inf or nan
+func formatDouble(value float64) string {
+    switch {
+    case math.IsInf(value, 1):
+        return "inf"
+    case math.IsInf(value, -1):
+        return "-inf"
+    case math.IsNaN(value):
+        return "nan"
+    }
+    return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
 func writeBytes(value interface{}, w io.Writer) (int64, error) {
     if value == nil {
         return writeNullBytes(w)
     }
     switch v := value.(type) {
     case []byte:
-        if len(v) == 0 {
+        // nil is the null bulk, an empty slice is the empty bulk
+        if v == nil {
             return writeNullBytes(w)
         }
         if wrote, err := w.Write([]byte("$" + strconv.Itoa(len(v)) + "\r\n")); err != nil {
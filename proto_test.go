@@ -0,0 +1,84 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "io"
+    "strings"
+    "testing"
+)
+
+func TestReadLine(t *testing.T) {
+    long := strings.Repeat("a", kMaxInlineLen-2)
+    tests := []struct {
+        data string
+        want string
+        err  error
+    }{
+        {"PING\r\n", "PING\r\n", nil},
+        {"PING\r\nPING\r\n", "PING\r\n", nil},
+        {"PING", "PING", io.EOF},
+        {long + "\r\n", long + "\r\n", nil},
+        {long + "a\r\n", "", ErrTooBigInline},
+        {long + "aaaa", "", ErrTooBigInline},
+    }
+    for _, test := range tests {
+        // the small buffer makes the line span several reads
+        reader := bufio.NewReaderSize(strings.NewReader(test.data), 16)
+        line, err := readLine(reader)
+        if line != test.want || err != test.err {
+            t.Errorf("readLine(%.20q) = %.20q, %v, want %.20q, %v", test.data, line, err, test.want, test.err)
+        }
+    }
+}
+
+func TestReadArgument(t *testing.T) {
+    tests := []struct {
+        data       string
+        maxBulkLen int64
+        want       []byte
+        err        error
+    }{
+        {"$4\r\nPING\r\n", kDefaultProtoMaxBulkLen, []byte("PING"), nil},
+        {"$0\r\n\r\n", kDefaultProtoMaxBulkLen, []byte{}, nil},
+        {"$4\r\nPING\r\n", 4, []byte("PING"), nil},
+        {"$5\r\nHELLO\r\n", 4, nil, ErrInvalidBulkLen},
+        {"$-1\r\n", kDefaultProtoMaxBulkLen, nil, ErrInvalidBulkLen},
+        {"4\r\nPING\r\n", kDefaultProtoMaxBulkLen, nil, Malformed("$<ArgumentLength>", "4\r\n")},
+        {"$4\r\nPIN", kDefaultProtoMaxBulkLen, nil, MalformedLength(4, 3)},
+        {"$4\r\nPINGS\r\n", kDefaultProtoMaxBulkLen, nil, MalformedMissingCRLF()},
+        {"$" + strings.Repeat("1", kMaxInlineLen), kDefaultProtoMaxBulkLen, nil, ErrTooBigInline},
+    }
+    for _, test := range tests {
+        reader := bufio.NewReader(strings.NewReader(test.data))
+        data, err := readArgument(reader, test.maxBulkLen)
+        if test.err != nil {
+            if err == nil || err.Error() != test.err.Error() {
+                t.Errorf("readArgument(%.20q) = %v, want %v", test.data, err, test.err)
+            }
+            continue
+        }
+        if err != nil || !bytes.Equal(data, test.want) || data == nil {
+            t.Errorf("readArgument(%.20q) = %q, %v, want %q", test.data, data, err, test.want)
+        }
+    }
+}
+
+func TestWriteBytes(t *testing.T) {
+    tests := []struct {
+        reply Reply
+        want  string
+    }{
+        {&BulkReply{nil}, "$-1\r\n"},
+        {&BulkReply{[]byte{}}, "$0\r\n\r\n"},
+        {&BulkReply{[]byte("PONG")}, "$4\r\nPONG\r\n"},
+        {&MultiBulkReply{[][]byte{[]byte("a"), nil, []byte{}}}, "*3\r\n$1\r\na\r\n$-1\r\n$0\r\n\r\n"},
+        {&ArrayReply{[]interface{}{[]byte{}, 1, nil}}, "*3\r\n$0\r\n\r\n:1\r\n$-1\r\n"},
+    }
+    for _, test := range tests {
+        var buf bytes.Buffer
+        if _, err := test.reply.WriteTo(&buf); err != nil || buf.String() != test.want {
+            t.Errorf("%#v.WriteTo = %q, %v, want %q", test.reply, buf.String(), err, test.want)
+        }
+    }
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+    "bytes"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// Broker maps the channels and patterns to the subscribed clients
+type Broker struct {
+    sync.RWMutex
+    channels map[string]map[*Client]bool
+    patterns map[string]map[*Client]bool
+}
+
+func NewBroker() *Broker {
+    return &Broker{
+        channels: make(map[string]map[*Client]bool),
+        patterns: make(map[string]map[*Client]bool),
+    }
+}
+
+// Subscribe pushes the confirmation while holding the lock, so it is always
+// delivered before any message of the channel.
+func (b *Broker) Subscribe(client *Client, channel []byte, isPattern bool) error {
+    b.Lock()
+    defer b.Unlock()
+
+    registry, clientSubs, kind := b.channels, client.channels, "subscribe"
+    if isPattern {
+        registry, clientSubs, kind = b.patterns, client.patterns, "psubscribe"
+    }
+    name := string(channel)
+    if !clientSubs[name] {
+        clients, ok := registry[name]
+        if !ok {
+            clients = make(map[*Client]bool)
+            registry[name] = clients
+        }
+        clients[client] = true
+        clientSubs[name] = true
+        client.subscriptions.Add(1)
+    }
+    return client.Push(__pubsub_message(client, kind, channel))
+}
+
+// Unsubscribe removes the client from the channels, or from all of its channels if none given
+func (b *Broker) Unsubscribe(client *Client, channels [][]byte, isPattern bool) error {
+    b.Lock()
+    defer b.Unlock()
+
+    registry, clientSubs, kind := b.channels, client.channels, "unsubscribe"
+    if isPattern {
+        registry, clientSubs, kind = b.patterns, client.patterns, "punsubscribe"
+    }
+    if len(channels) == 0 {
+        for name := range clientSubs {
+            channels = append(channels, []byte(name))
+        }
+        if len(channels) == 0 {
+            return client.Push(__pubsub_message(client, kind, nil))
+        }
+    }
+    for _, channel := range channels {
+        name := string(channel)
+        if clientSubs[name] {
+            delete(clientSubs, name)
+            if clients, ok := registry[name]; ok {
+                delete(clients, client)
+                if len(clients) == 0 {
+                    delete(registry, name)
+                }
+            }
+            client.subscriptions.Add(-1)
+        }
+        if err := client.Push(__pubsub_message(client, kind, channel)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// UnsubscribeAll silently removes the client, e.g. when the connection is closed
+func (b *Broker) UnsubscribeAll(client *Client) {
+    b.Lock()
+    defer b.Unlock()
+    for name := range client.channels {
+        if clients, ok := b.channels[name]; ok {
+            delete(clients, client)
+            if len(clients) == 0 {
+                delete(b.channels, name)
+            }
+        }
+    }
+    for name := range client.patterns {
+        if clients, ok := b.patterns[name]; ok {
+            delete(clients, client)
+            if len(clients) == 0 {
+                delete(b.patterns, name)
+            }
+        }
+    }
+    client.channels = make(map[string]bool)
+    client.patterns = make(map[string]bool)
+    client.subscriptions.Set(0)
+}
+
+// Publish returns the number of clients received the message
+func (b *Broker) Publish(channel, message []byte) int {
+    b.RLock()
+    defer b.RUnlock()
+
+    count := 0
+    if clients, ok := b.channels[string(channel)]; ok {
+        data := newPubsubData([]byte("message"), channel, message)
+        for client := range clients {
+            if client.Push(data.encode(client.Protocol())) == nil {
+                count++
+            }
+        }
+    }
+    for pattern, clients := range b.patterns {
+        if !globMatch([]byte(pattern), channel) {
+            continue
+        }
+        data := newPubsubData([]byte("pmessage"), []byte(pattern), channel, message)
+        for client := range clients {
+            if client.Push(data.encode(client.Protocol())) == nil {
+                count++
+            }
+        }
+    }
+    return count
+}
+
+func (b *Broker) Channels(pattern []byte) [][]byte {
+    b.RLock()
+    defer b.RUnlock()
+    channels := make([]string, 0, len(b.channels))
+    for name := range b.channels {
+        if pattern == nil || globMatch(pattern, []byte(name)) {
+            channels = append(channels, name)
+        }
+    }
+    sort.Strings(channels)
+    data := make([][]byte, len(channels))
+    for i := range channels {
+        data[i] = []byte(channels[i])
+    }
+    return data
+}
+
+func (b *Broker) NumSub(channel []byte) int {
+    b.RLock()
+    defer b.RUnlock()
+    return len(b.channels[string(channel)])
+}
+
+func (b *Broker) NumPat() int {
+    b.RLock()
+    defer b.RUnlock()
+    return len(b.patterns)
+}
+
+// Pub/Sub Commands
+func (s *Server) RedisSubscribe(request *Request, channel []byte, channels ...[]byte) (Reply, error) {
+    return s._pubsub_subscribe(request, append([][]byte{channel}, channels...), false)
+}
+
+func (s *Server) RedisPsubscribe(request *Request, pattern []byte, patterns ...[]byte) (Reply, error) {
+    return s._pubsub_subscribe(request, append([][]byte{pattern}, patterns...), true)
+}
+
+func (s *Server) RedisUnsubscribe(request *Request, channels [][]byte) (Reply, error) {
+    return s._pubsub_unsubscribe(request, channels, false)
+}
+
+func (s *Server) RedisPunsubscribe(request *Request, patterns [][]byte) (Reply, error) {
+    return s._pubsub_unsubscribe(request, patterns, true)
+}
+
+func (s *Server) RedisPublish(channel, message []byte) (int, error) {
+    if len(channel) == 0 {
+        return 0, ErrWrongArgumentsCount
+    }
+    return s.broker.Publish(channel, message), nil
+}
+
+// PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT
+func (s *Server) RedisPubsub(subCommand []byte, args ...[]byte) (interface{}, error) {
+    switch strings.ToLower(string(subCommand)) {
+    case "channels":
+        if len(args) > 1 {
+            return nil, ErrWrongArgumentsCount
+        }
+        var pattern []byte
+        if len(args) == 1 {
+            pattern = args[0]
+        }
+        return s.broker.Channels(pattern), nil
+    case "numsub":
+        data := make([]interface{}, 0, len(args)*2)
+        for _, channel := range args {
+            data = append(data, channel, s.broker.NumSub(channel))
+        }
+        return data, nil
+    case "numpat":
+        return s.broker.NumPat(), nil
+    }
+    return nil, ErrSyntax
+}
+
+func (s *Server) _pubsub_subscribe(request *Request, channels [][]byte, isPattern bool) (Reply, error) {
+    if request.Client == nil {
+        return nil, ErrNotFromClient
+    }
+    request.Client.EnterPushMode(s.pubsubOutputLimit.Get())
+    for _, channel := range channels {
+        if err := s.broker.Subscribe(request.Client, channel, isPattern); err != nil {
+            return nil, err
+        }
+    }
+    return &PushedReply{}, nil
+}
+
+func (s *Server) _pubsub_unsubscribe(request *Request, channels [][]byte, isPattern bool) (Reply, error) {
+    if request.Client == nil {
+        return nil, ErrNotFromClient
+    }
+    request.Client.EnterPushMode(s.pubsubOutputLimit.Get())
+    if err := s.broker.Unsubscribe(request.Client, channels, isPattern); err != nil {
+        return nil, err
+    }
+    return &PushedReply{}, nil
+}
+
+// serveSubscriber only allows the pub/sub commands while a RESP2 client is subscribed,
+// a RESP3 client tells the messages from the replies by the push type
+func (s *Server) serveSubscriber(request *Request) (Reply, bool) {
+    switch request.Command {
+    case "subscribe", "psubscribe", "unsubscribe", "punsubscribe", "quit":
+        return nil, false
+    case "ping":
+        var payload []byte
+        if len(request.Arguments) > 0 {
+            payload = request.Arguments[0]
+        }
+        return &ArrayReply{[]interface{}{[]byte("pong"), payload}}, true
+    }
+    return &ErrorReply{"Can't execute '" + request.Command +
+        "': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context"}, true
+}
+
+// pubsubData is a message encoded once for each protocol of the receivers
+type pubsubData struct {
+    values  []interface{}
+    encoded map[int][]byte
+}
+
+func newPubsubData(values ...interface{}) *pubsubData {
+    return &pubsubData{values: values, encoded: make(map[int][]byte, 2)}
+}
+
+// encode returns an array for RESP2 and a push for RESP3
+func (d *pubsubData) encode(proto int) []byte {
+    if data, ok := d.encoded[proto]; ok {
+        return data
+    }
+    buffer := new(bytes.Buffer)
+    (&PushReply{d.values}).WriteTo(newProtoWriter(buffer, proto))
+    d.encoded[proto] = buffer.Bytes()
+    return d.encoded[proto]
+}
+
+func __pubsub_message(client *Client, kind string, channel []byte) []byte {
+    var name interface{}
+    if channel != nil {
+        name = channel
+    }
+    data := newPubsubData([]byte(kind), name, int(client.subscriptions.Get()))
+    return data.encode(client.Protocol())
+}
+
+// parsePubSubOutputLimit parses the size like 32m, empty for the default
+func parsePubSubOutputLimit(value string) (int64, error) {
+    return parseSizeLimit(value, kDefaultPubSubOutputLimit)
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+    "bytes"
     "encoding/gob"
     "fmt"
     rocks "github.com/tecbot/gorocksdb"
     "log"
     "reflect"
+    "strconv"
     "strings"
+    "sync"
+    "time"
 )
 
 const (
@@ -14,10 +18,13 @@ const (
     kRedisList   = "list"
     kRedisHash   = "hash"
     kRedisSet    = "set"
+    kRedisStream = "stream"
+    kRedisZSet   = "zset"
 )
 
 var (
-    kTypeKeyPrefix = []byte("__*type*__")
+    kTypeKeyPrefix   = []byte("__*type*__")
+    kStreamKeyPrefix = []byte("__*stream*__")
 )
 
 type RedisObject struct {
@@ -59,9 +66,68 @@ func NewRocksDBHandler(config RockdisConfig) *RocksDBHandler {
     if err := handler.Init(); err != nil {
         log.Fatal(err)
     }
+    keys, values := make([]string, 0), make([]string, 0)
+    for _, option := range kRocksdbMutableOptions {
+        value, err := rocksdbMutableOption(&config, option)
+        if err != nil {
+            log.Fatalf("[Config] Format error for [Database] %s, %s", option, err)
+        }
+        if value != "" {
+            keys, values = append(keys, option), append(values, value)
+        }
+    }
+    if len(keys) > 0 {
+        if err := handler.SetOptions(keys, values); err != nil {
+            log.Fatalf("[Config] Failed to set the RocksDB options %v, %s", keys, err)
+        }
+    }
     return handler
 }
 
+// kRocksdbMutableOptions are the options of the config set on the open database by SetOptions
+var kRocksdbMutableOptions = []string{
+    "write_buffer_size", "max_write_buffer_number", "level0_slowdown_writes_trigger", "disable_auto_compactions",
+}
+
+// rocksdbMutableOption returns the value of the option in the config for SetOptions, empty to
+// keep the option as it is
+func rocksdbMutableOption(config *RockdisConfig, option string) (string, error) {
+    var n int
+    switch option {
+    case "write_buffer_size":
+        size, err := parseSizeLimit(config.Database.WriteBufferSize, 0)
+        if err != nil {
+            return "", fmt.Errorf("argument must be a memory value")
+        }
+        n = int(size)
+    case "max_write_buffer_number":
+        n = config.Database.MaxWriteBufferNumber
+    case "level0_slowdown_writes_trigger":
+        n = config.Database.Level0SlowdownWritesTrigger
+    case "disable_auto_compactions":
+        return strconv.FormatBool(config.Database.DisableAutoCompactions), nil
+    default:
+        return "", fmt.Errorf("unknown option %s", option)
+    }
+    if n < 0 {
+        return "", fmt.Errorf("argument must be greater than or equal to 0")
+    }
+    if n == 0 {
+        return "", nil
+    }
+    return strconv.Itoa(n), nil
+}
+
+// SetOptions changes the mutable options of the open database
+func (rh *RocksDBHandler) SetOptions(keys, values []string) error {
+    rh.dbLock.RLock()
+    defer rh.dbLock.RUnlock()
+    if rh.db == nil {
+        return ErrRocksIsDead
+    }
+    return rh.db.SetOptions(keys, values)
+}
+
 type RocksDBHandler struct {
     dbDir           string
     cacheSize       int
@@ -75,10 +141,25 @@ type RocksDBHandler struct {
 
     options *rocks.Options
     db      *rocks.DB
+    server  *Server
+    // the db is set to nil under the lock once closed
+    dbLock sync.RWMutex
+
+    // the stream writes are read-modify-write of the meta
+    streamLock sync.Mutex
+    // so are the sorted set writes, the score of a member is read before the index is updated
+    zsetLock sync.Mutex
+    // the hash increments of a key read the field to reply the value they merge, the other
+    // hash writes are merged without any lock
+    hashIncrLocks [kHashIncrLocks]sync.Mutex
 
     dsMergers map[string]DataStructureMerger
 }
 
+func (rh *RocksDBHandler) BindServer(s *Server) {
+    rh.server = s
+}
+
 func (rh *RocksDBHandler) Init() error {
     rh.options = rocks.NewDefaultOptions()
     rh.options.SetBlockCache(rocks.NewLRUCache(rh.cacheSize))
@@ -142,20 +223,101 @@ func (rh *RocksDBHandler) Init() error {
     return nil
 }
 
+// Close destroys the database, the readers out of the commands, e.g. the metrics, hold the dbLock
+// to never use the freed database.
 func (rh *RocksDBHandler) Close() {
+    rh.dbLock.Lock()
+    defer rh.dbLock.Unlock()
     if rh.options != nil {
         rh.options.Destroy()
+        rh.options = nil
     }
     if rh.db != nil {
         rh.db.Close()
+        rh.db = nil
     }
     log.Printf("[RocksDBHandler] Closed.")
 }
 
+// Shutdown flushes the memtables if save, then closes the database. The wrapper has no SyncWAL,
+// the flush waited for makes the WAL of the memtables obsolete, and without save the WAL is
+// replayed when the database is opened next time.
+func (rh *RocksDBHandler) Shutdown(save bool) {
+    if save && rh.db != nil {
+        options := rocks.NewDefaultFlushOptions()
+        options.SetWait(true)
+        if err := rh.db.Flush(options); err != nil {
+            log.Printf("[RocksDBHandler] Failed to flush the memtables, %s", err)
+        } else {
+            log.Printf("[RocksDBHandler] Flushed the memtables.")
+        }
+        options.Destroy()
+    }
+    rh.Close()
+}
+
 func (rh *RocksDBHandler) getTypeKey(key []byte) []byte {
     return append(kTypeKeyPrefix, key...)
 }
 
+// isInternalKey tells the keys of the types and the sub keys of the data structures
+func (rh *RocksDBHandler) isInternalKey(key []byte) bool {
+    for _, prefix := range [][]byte{kTypeKeyPrefix, kStreamKeyPrefix, kStreamGroupPrefix, kStreamPelPrefix,
+        kZSetMemberPrefix, kZSetScorePrefix} {
+        if bytes.HasPrefix(key, prefix) {
+            return true
+        }
+    }
+    return false
+}
+
+// deleteSubKeys deletes the keys stored outside of the object of the key, e.g. the stream entries
+func (rh *RocksDBHandler) deleteSubKeys(batch *rocks.WriteBatch, key []byte, objType string) {
+    switch objType {
+    case kRedisStream:
+        prefixes := append([][]byte{__stream_entryPrefix(key)}, __group_streamPrefixes(key)...)
+        for _, prefix := range prefixes {
+            rh.deleteRange(batch, prefix, __prefixSuccessor(prefix))
+        }
+    case kRedisZSet:
+        for _, prefix := range [][]byte{__zset_memberPrefix(key), __zset_scorePrefix(key)} {
+            rh.deleteRange(batch, prefix, __prefixSuccessor(prefix))
+        }
+    }
+}
+
+// lockSubKeys takes the lock of the writes to the sub-keys of the type, the returned func
+// releases it. The types without sub-keys have no lock.
+func (rh *RocksDBHandler) lockSubKeys(objType string) func() {
+    switch objType {
+    case kRedisStream:
+        rh.streamLock.Lock()
+        return rh.streamLock.Unlock
+    case kRedisZSet:
+        rh.zsetLock.Lock()
+        return rh.zsetLock.Unlock
+    }
+    return func() {}
+}
+
+// deleteOldSubKeys deletes within the batch the sub-keys of the object the key holds before it
+// is overwritten, the returned func must be called after the batch is written.
+func (rh *RocksDBHandler) deleteOldSubKeys(batch *rocks.WriteBatch, key []byte) (func(), error) {
+    oldType, err := rh.getKeyType(key)
+    if err != nil {
+        return nil, err
+    }
+    unlock := rh.lockSubKeys(oldType)
+    rh.deleteSubKeys(batch, key, oldType)
+    return unlock, nil
+}
+
+// deleteRange deletes the keys in [start, end) within the batch, including the keys put
+// earlier in the same batch.
+func (rh *RocksDBHandler) deleteRange(batch *rocks.WriteBatch, start, end []byte) {
+    batch.DeleteRange(start, end)
+}
+
 func (rh *RocksDBHandler) getKeyType(key []byte) (string, error) {
     if rh.db == nil {
         return "", ErrRocksIsDead
@@ -183,6 +345,9 @@ func (rh *RocksDBHandler) FullMerge(key, existingValue []byte, operands [][]byte
     switch keyType {
     case kRedisString:
         emptyData = []byte{}
+    case kRedisStream, kRedisZSet:
+        // the stream and the sorted set are never merged
+        return nil, false
     default:
         emptyData = [][]byte{}
     }
@@ -234,8 +399,26 @@ var (
     ErrWrongArgumentsCount  = fmt.Errorf("Wrong number of arguments for command")
     ErrWrongTypeRedisObject = fmt.Errorf("Operation against a key holding the wrong kind of value")
     ErrNotNumber            = fmt.Errorf("value is not an integer or out of range")
+    ErrNotFloat             = fmt.Errorf("value is not a valid float")
+    ErrOutOfRange           = fmt.Errorf("value is out of range, must be positive")
+    ErrNotTimeout           = fmt.Errorf("timeout is not a float or out of range")
+    ErrNegativeTimeout      = fmt.Errorf("timeout is negative")
+    ErrSyntax               = fmt.Errorf("syntax error")
 )
 
+// __prefixSuccessor is the smallest key greater than all the keys with the prefix
+func __prefixSuccessor(prefix []byte) []byte {
+    end := make([]byte, len(prefix))
+    copy(end, prefix)
+    for i := len(end) - 1; i >= 0; i-- {
+        if end[i] < 0xff {
+            end[i]++
+            return end[:i+1]
+        }
+    }
+    return nil
+}
+
 func (rh *RocksDBHandler) copySlice(slice *rocks.Slice, toFree bool) []byte {
     data := make([]byte, slice.Size())
     copy(data, slice.Data())
@@ -260,7 +443,16 @@ func (rh *RocksDBHandler) loadRedisObject(options *rocks.ReadOptions, key []byte
 
     if obj, err := decode(data, reflect.TypeOf(RedisObject{})); err == nil {
         globalStat.keyHits.Add(1)
-        return obj.(RedisObject), nil
+        redisObj := obj.(RedisObject)
+        switch v := redisObj.Data.(type) {
+        case []byte:
+            if v == nil {
+                redisObj.Data = []byte{}
+            }
+        case [][]byte:
+            __emptyBytes(v)
+        }
+        return redisObj, nil
     } else {
         return RedisObject{}, err
     }
@@ -278,13 +470,43 @@ func (rh *RocksDBHandler) saveRedisObject(options *rocks.WriteOptions, key []byt
 
     batch := rocks.NewWriteBatch()
     defer batch.Destroy()
+    unlock, err := rh.deleteOldSubKeys(batch, key)
+    if err != nil {
+        return err
+    }
+    defer unlock()
     batch.Put(rh.getTypeKey(key), []byte(objType))
     batch.Put(key, data)
     err = rh.db.Write(options, batch)
     if err != nil {
         log.Printf("[saveRedisObject] Error when PUT > RocksDB, %s", err)
+        return err
+    }
+    rh.notifyKeyspaceEvent(__notify_typeClass(objType), "set", key)
+    return nil
+}
+
+// signalKeyAsReady wakes up the clients blocked on the key after a push
+func (rh *RocksDBHandler) signalKeyAsReady(key []byte, count int) {
+    if rh.server != nil {
+        rh.server.keyWaiters.Notify(key, count)
+    }
+}
+
+// notifyKeyspaceEvent is the only hook of the keyspace notifications for every write
+func (rh *RocksDBHandler) notifyKeyspaceEvent(class int, event string, key []byte) {
+    if rh.server != nil {
+        rh.server.NotifyKeyspaceEvent(class, event, key)
+    }
+}
+
+// blockForKeys blocks the client of the request until serve succeeds on one of the keys
+func (rh *RocksDBHandler) blockForKeys(request *Request, keys [][]byte, timeout time.Duration, serve func() (bool, error)) error {
+    if rh.server == nil || request == nil {
+        _, err := serve()
+        return err
     }
-    return err
+    return rh.server.keyWaiters.BlockFor(request.Client, keys, timeout, serve)
 }
 
 func (rh *RocksDBHandler) checkRedisCall(args ...[]byte) error {
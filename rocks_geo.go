@@ -0,0 +1,545 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// The geo index is a sorted set, the score of a member is the 52 bits geohash of its position,
+// i.e. 26 bits of the longitude interleaved with 26 bits of the latitude. A search covers the area
+// with the cell of the center and its 8 neighbours at a step where a cell is larger than the radius,
+// each cell is a range of scores, and the candidates are filtered by the exact distance.
+
+const (
+    kGeoStepMax     = 26
+    kGeoLatMin      = -85.05112878
+    kGeoLatMax      = 85.05112878
+    kGeoLonMin      = -180.0
+    kGeoLonMax      = 180.0
+    kGeoEarthRadius = 6372797.560856
+)
+
+var (
+    ErrGeoInvalidPos = fmt.Errorf("invalid longitude,latitude pair")
+    ErrGeoUnit       = fmt.Errorf("unsupported unit provided. please use M, KM, FT, MI")
+    ErrGeoNoMember   = fmt.Errorf("could not decode requested zset member")
+    ErrGeoFrom       = fmt.Errorf("exactly one of FROMMEMBER or FROMLONLAT can be specified")
+    ErrGeoBy         = fmt.Errorf("exactly one of BYRADIUS and BYBOX can be specified")
+    ErrGeoCount      = fmt.Errorf("COUNT must be > 0")
+    ErrGeoAny        = fmt.Errorf("the ANY argument requires COUNT argument")
+)
+
+type geoPoint struct {
+    member   []byte
+    lon, lat float64
+    dist     float64
+    hash     uint64
+}
+
+// geoSearch is the shape and the options of GEOSEARCH and GEORADIUS
+type geoSearch struct {
+    lon, lat      float64
+    radius        float64
+    width, height float64
+    byBox         bool
+    unit          float64
+    count         int
+    any           bool
+    sortOrder     int
+    withCoord     bool
+    withDist      bool
+    withHash      bool
+}
+
+// GEOADD key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+func (rh *RocksDBHandler) RedisGeoadd(key []byte, args ...[]byte) (interface{}, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return nil, err
+    }
+    i := 0
+    zaddArgs := make([][]byte, 0, len(args))
+    for ; i < len(args); i++ {
+        option := strings.ToLower(string(args[i]))
+        if option != "nx" && option != "xx" && option != "ch" {
+            break
+        }
+        zaddArgs = append(zaddArgs, args[i])
+    }
+    triples := args[i:]
+    if len(triples) == 0 || len(triples)%3 != 0 {
+        return nil, ErrSyntax
+    }
+    for j := 0; j < len(triples); j += 3 {
+        lon, lat, err := __geo_parseLonLat(triples[j], triples[j+1])
+        if err != nil {
+            return nil, err
+        }
+        score := float64(__geo_encode(lon, lat, kGeoStepMax))
+        zaddArgs = append(zaddArgs, __zset_formatScore(score), triples[j+2])
+    }
+    return rh.RedisZadd(key, zaddArgs...)
+}
+
+// GEODIST key member1 member2 [M|KM|FT|MI]
+func (rh *RocksDBHandler) RedisGeodist(key, member1, member2 []byte, args ...[]byte) ([]byte, error) {
+    if err := rh.checkRedisCall(key, member1, member2); err != nil {
+        return nil, err
+    }
+    unit := 1.0
+    if len(args) > 1 {
+        return nil, ErrSyntax
+    } else if len(args) == 1 {
+        var err error
+        if unit, err = __geo_parseUnit(args[0]); err != nil {
+            return nil, err
+        }
+    }
+    if _, _, err := rh._zset_getMeta(key); err != nil {
+        return nil, err
+    }
+    lon1, lat1, exists1, err := rh._geo_getPos(key, member1)
+    if err != nil {
+        return nil, err
+    }
+    lon2, lat2, exists2, err := rh._geo_getPos(key, member2)
+    if err != nil {
+        return nil, err
+    }
+    if !exists1 || !exists2 {
+        return nil, nil
+    }
+    return __geo_formatDist(__geo_distance(lon1, lat1, lon2, lat2) / unit), nil
+}
+
+// GEOPOS key member [member ...]
+func (rh *RocksDBHandler) RedisGeopos(key []byte, members ...[]byte) ([]interface{}, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return nil, err
+    }
+    if _, _, err := rh._zset_getMeta(key); err != nil {
+        return nil, err
+    }
+    results := make([]interface{}, len(members))
+    for i, member := range members {
+        lon, lat, exists, err := rh._geo_getPos(key, member)
+        if err != nil {
+            return nil, err
+        }
+        if !exists {
+            results[i] = &ArrayReply{}
+            continue
+        }
+        results[i] = &ArrayReply{[]interface{}{__geo_formatCoord(lon), __geo_formatCoord(lat)}}
+    }
+    return results, nil
+}
+
+// GEOSEARCH key FROMMEMBER member|FROMLONLAT longitude latitude BYRADIUS radius unit|BYBOX width height unit
+//   [ASC|DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+func (rh *RocksDBHandler) RedisGeosearch(key []byte, args ...[]byte) ([]interface{}, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return nil, err
+    }
+    search := geoSearch{}
+    var fromMember []byte
+    hasFrom, hasBy := false, false
+    for i := 0; i < len(args); i++ {
+        switch strings.ToLower(string(args[i])) {
+        case "frommember":
+            if hasFrom || i+1 >= len(args) {
+                return nil, ErrGeoFrom
+            }
+            fromMember = args[i+1]
+            hasFrom = true
+            i++
+        case "fromlonlat":
+            if hasFrom || i+2 >= len(args) {
+                return nil, ErrGeoFrom
+            }
+            lon, lat, err := __geo_parseLonLat(args[i+1], args[i+2])
+            if err != nil {
+                return nil, err
+            }
+            search.lon, search.lat = lon, lat
+            hasFrom = true
+            i += 2
+        case "byradius":
+            if hasBy || i+2 >= len(args) {
+                return nil, ErrGeoBy
+            }
+            if err := search.parseRadius(args[i+1], args[i+2]); err != nil {
+                return nil, err
+            }
+            hasBy = true
+            i += 2
+        case "bybox":
+            if hasBy || i+3 >= len(args) {
+                return nil, ErrGeoBy
+            }
+            if err := search.parseBox(args[i+1], args[i+2], args[i+3]); err != nil {
+                return nil, err
+            }
+            hasBy = true
+            i += 3
+        default:
+            n, err := search.parseOption(args, i)
+            if err != nil {
+                return nil, err
+            }
+            i += n
+        }
+    }
+    if !hasFrom {
+        return nil, ErrGeoFrom
+    }
+    if !hasBy {
+        return nil, ErrGeoBy
+    }
+    if search.any && search.count == 0 {
+        return nil, ErrGeoAny
+    }
+
+    if _, _, err := rh._zset_getMeta(key); err != nil {
+        return nil, err
+    }
+    if fromMember != nil {
+        lon, lat, exists, err := rh._geo_getPos(key, fromMember)
+        if err != nil {
+            return nil, err
+        }
+        if !exists {
+            return nil, ErrGeoNoMember
+        }
+        search.lon, search.lat = lon, lat
+    }
+    return rh._geo_search(key, search)
+}
+
+// GEORADIUS key longitude latitude radius M|KM|FT|MI [WITHCOORD] [WITHDIST] [WITHHASH] [COUNT count [ANY]] [ASC|DESC]
+func (rh *RocksDBHandler) RedisGeoradius(key, lon, lat, radius, unit []byte, args ...[]byte) ([]interface{}, error) {
+    if err := rh.checkRedisCall(key, lon, lat, radius, unit); err != nil {
+        return nil, err
+    }
+    search := geoSearch{}
+    var err error
+    if search.lon, search.lat, err = __geo_parseLonLat(lon, lat); err != nil {
+        return nil, err
+    }
+    if err := search.parseRadius(radius, unit); err != nil {
+        return nil, err
+    }
+    for i := 0; i < len(args); i++ {
+        n, err := search.parseOption(args, i)
+        if err != nil {
+            return nil, err
+        }
+        i += n
+    }
+    if search.any && search.count == 0 {
+        return nil, ErrGeoAny
+    }
+    if _, _, err := rh._zset_getMeta(key); err != nil {
+        return nil, err
+    }
+    return rh._geo_search(key, search)
+}
+
+func (rh *RocksDBHandler) _geo_search(key []byte, search geoSearch) ([]interface{}, error) {
+    points := make([]geoPoint, 0)
+    for _, scoreRange := range __geo_searchRanges(search) {
+        done := false
+        err := rh._zset_scanScore(key, scoreRange, false, func(member []byte, score float64) bool {
+            hash := uint64(score)
+            lon, lat := __geo_decode(hash, kGeoStepMax)
+            dist, ok := search.distanceIfInside(lon, lat)
+            if !ok {
+                return true
+            }
+            points = append(points, geoPoint{member, lon, lat, dist, hash})
+            done = search.any && len(points) >= search.count
+            return !done
+        })
+        if err != nil {
+            return nil, err
+        }
+        if done {
+            break
+        }
+    }
+
+    if search.sortOrder == 0 && search.count > 0 && !search.any {
+        // like Redis, COUNT without ANY returns the nearest ones
+        search.sortOrder = 1
+    }
+    switch search.sortOrder {
+    case 1:
+        sort.Sort(geoPointsByDist(points))
+    case -1:
+        sort.Sort(sort.Reverse(geoPointsByDist(points)))
+    }
+    if search.count > 0 && len(points) > search.count {
+        points = points[:search.count]
+    }
+
+    results := make([]interface{}, len(points))
+    for i, p := range points {
+        if !search.withCoord && !search.withDist && !search.withHash {
+            results[i] = p.member
+            continue
+        }
+        item := []interface{}{p.member}
+        if search.withDist {
+            item = append(item, __geo_formatDist(p.dist/search.unit))
+        }
+        if search.withHash {
+            item = append(item, int(p.hash))
+        }
+        if search.withCoord {
+            item = append(item, &ArrayReply{[]interface{}{__geo_formatCoord(p.lon), __geo_formatCoord(p.lat)}})
+        }
+        results[i] = &ArrayReply{item}
+    }
+    return results, nil
+}
+
+func (rh *RocksDBHandler) _geo_getPos(key, member []byte) (float64, float64, bool, error) {
+    score, exists, err := rh._zset_getScore(key, member)
+    if err != nil || !exists {
+        return 0, 0, false, err
+    }
+    lon, lat := __geo_decode(uint64(score), kGeoStepMax)
+    return lon, lat, true, nil
+}
+
+func (s *geoSearch) parseRadius(radius, unit []byte) error {
+    r, err := strconv.ParseFloat(string(radius), 64)
+    if err != nil || r < 0 {
+        return fmt.Errorf("need numeric radius")
+    }
+    if s.unit, err = __geo_parseUnit(unit); err != nil {
+        return err
+    }
+    s.radius = r * s.unit
+    return nil
+}
+
+func (s *geoSearch) parseBox(width, height, unit []byte) error {
+    w, err1 := strconv.ParseFloat(string(width), 64)
+    h, err2 := strconv.ParseFloat(string(height), 64)
+    if err1 != nil || err2 != nil || w < 0 || h < 0 {
+        return fmt.Errorf("need numeric width and height")
+    }
+    var err error
+    if s.unit, err = __geo_parseUnit(unit); err != nil {
+        return err
+    }
+    s.width, s.height = w*s.unit, h*s.unit
+    s.radius = math.Sqrt(s.width*s.width+s.height*s.height) / 2
+    s.byBox = true
+    return nil
+}
+
+// parseOption parses the common options at args[i], returns the number of extra arguments consumed
+func (s *geoSearch) parseOption(args [][]byte, i int) (int, error) {
+    switch strings.ToLower(string(args[i])) {
+    case "asc":
+        s.sortOrder = 1
+    case "desc":
+        s.sortOrder = -1
+    case "withcoord":
+        s.withCoord = true
+    case "withdist":
+        s.withDist = true
+    case "withhash":
+        s.withHash = true
+    case "any":
+        s.any = true
+    case "count":
+        if i+1 >= len(args) {
+            return 0, ErrSyntax
+        }
+        count, err := strconv.Atoi(string(args[i+1]))
+        if err != nil {
+            return 0, ErrNotNumber
+        }
+        if count <= 0 {
+            return 0, ErrGeoCount
+        }
+        s.count = count
+        return 1, nil
+    default:
+        return 0, ErrSyntax
+    }
+    return 0, nil
+}
+
+// distanceIfInside returns the distance to the center in meters if the point is inside the shape
+func (s *geoSearch) distanceIfInside(lon, lat float64) (float64, bool) {
+    dist := __geo_distance(s.lon, s.lat, lon, lat)
+    if !s.byBox {
+        return dist, dist <= s.radius
+    }
+    // measure the latitude along the meridian of the point, and the longitude along its parallel
+    if __geo_distance(lon, lat, lon, s.lat) > s.height/2 {
+        return 0, false
+    }
+    if __geo_distance(lon, lat, s.lon, lat) > s.width/2 {
+        return 0, false
+    }
+    return dist, true
+}
+
+// __geo_searchRanges returns the score ranges of the cells covering the area of the search
+func __geo_searchRanges(search geoSearch) []zsetRange {
+    // the half extent of the area in degrees, the longitude widens towards the poles
+    latDelta := search.radius / kGeoEarthRadius * 180 / math.Pi
+    lonDelta := 360.0
+    if cos := math.Cos(search.lat * math.Pi / 180); cos > 0 {
+        lonDelta = latDelta / cos
+    }
+    step := kGeoStepMax
+    for step > 1 {
+        cells := float64(uint64(1) << uint(step))
+        if (kGeoLatMax-kGeoLatMin)/cells >= latDelta && (kGeoLonMax-kGeoLonMin)/cells >= lonDelta {
+            break
+        }
+        step--
+    }
+
+    cells := int64(1) << uint(step)
+    latIdx, lonIdx := __geo_cellIndex(search.lon, search.lat, step)
+    shift := uint(2 * (kGeoStepMax - step))
+    seen := make(map[uint64]bool)
+    ranges := make([]zsetRange, 0, 9)
+    for dLat := int64(-1); dLat <= 1; dLat++ {
+        for dLon := int64(-1); dLon <= 1; dLon++ {
+            y := latIdx + dLat
+            if y < 0 || y >= cells {
+                continue
+            }
+            // the longitude wraps around at the antimeridian
+            x := (lonIdx + dLon + cells) % cells
+            hash := __geo_interleave(uint32(y), uint32(x))
+            if seen[hash] {
+                continue
+            }
+            seen[hash] = true
+            ranges = append(ranges, zsetRange{
+                min:   float64(hash << shift),
+                max:   float64((hash + 1) << shift),
+                maxEx: true,
+            })
+        }
+    }
+    return ranges
+}
+
+func __geo_cellIndex(lon, lat float64, step int) (int64, int64) {
+    cells := float64(uint64(1) << uint(step))
+    latIdx := int64((lat - kGeoLatMin) / (kGeoLatMax - kGeoLatMin) * cells)
+    lonIdx := int64((lon - kGeoLonMin) / (kGeoLonMax - kGeoLonMin) * cells)
+    max := int64(cells) - 1
+    if latIdx > max {
+        latIdx = max
+    }
+    if lonIdx > max {
+        lonIdx = max
+    }
+    return latIdx, lonIdx
+}
+
+// __geo_encode returns the geohash of the position with step bits per coordinate
+func __geo_encode(lon, lat float64, step int) uint64 {
+    latIdx, lonIdx := __geo_cellIndex(lon, lat, step)
+    return __geo_interleave(uint32(latIdx), uint32(lonIdx))
+}
+
+// __geo_decode returns the center of the cell of the geohash
+func __geo_decode(hash uint64, step int) (float64, float64) {
+    cells := float64(uint64(1) << uint(step))
+    latIdx, lonIdx := __geo_deinterleave(hash)
+    lat := kGeoLatMin + (float64(latIdx)+0.5)*(kGeoLatMax-kGeoLatMin)/cells
+    lon := kGeoLonMin + (float64(lonIdx)+0.5)*(kGeoLonMax-kGeoLonMin)/cells
+    return math.Max(kGeoLonMin, math.Min(kGeoLonMax, lon)), math.Max(kGeoLatMin, math.Min(kGeoLatMax, lat))
+}
+
+// __geo_interleave puts the bits of the longitude at the odd positions and of the latitude at the even ones
+func __geo_interleave(latIdx, lonIdx uint32) uint64 {
+    return __geo_spread(latIdx) | __geo_spread(lonIdx)<<1
+}
+
+func __geo_deinterleave(hash uint64) (uint32, uint32) {
+    return __geo_squash(hash), __geo_squash(hash >> 1)
+}
+
+func __geo_spread(v uint32) uint64 {
+    x := uint64(v)
+    x = (x | x<<16) & 0x0000FFFF0000FFFF
+    x = (x | x<<8) & 0x00FF00FF00FF00FF
+    x = (x | x<<4) & 0x0F0F0F0F0F0F0F0F
+    x = (x | x<<2) & 0x3333333333333333
+    x = (x | x<<1) & 0x5555555555555555
+    return x
+}
+
+func __geo_squash(x uint64) uint32 {
+    x &= 0x5555555555555555
+    x = (x | x>>1) & 0x3333333333333333
+    x = (x | x>>2) & 0x0F0F0F0F0F0F0F0F
+    x = (x | x>>4) & 0x00FF00FF00FF00FF
+    x = (x | x>>8) & 0x0000FFFF0000FFFF
+    x = (x | x>>16) & 0x00000000FFFFFFFF
+    return uint32(x)
+}
+
+// __geo_distance is the haversine distance in meters
+func __geo_distance(lon1, lat1, lon2, lat2 float64) float64 {
+    lat1r, lat2r := lat1*math.Pi/180, lat2*math.Pi/180
+    u := math.Sin((lat2r - lat1r) / 2)
+    v := math.Sin((lon2 - lon1) * math.Pi / 180 / 2)
+    a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+    return 2 * kGeoEarthRadius * math.Asin(math.Sqrt(a))
+}
+
+func __geo_parseLonLat(lonArg, latArg []byte) (float64, float64, error) {
+    lon, err1 := strconv.ParseFloat(string(lonArg), 64)
+    lat, err2 := strconv.ParseFloat(string(latArg), 64)
+    if err1 != nil || err2 != nil {
+        return 0, 0, ErrNotFloat
+    }
+    if lon < kGeoLonMin || lon > kGeoLonMax || lat < kGeoLatMin || lat > kGeoLatMax {
+        return 0, 0, ErrGeoInvalidPos
+    }
+    return lon, lat, nil
+}
+
+func __geo_parseUnit(unit []byte) (float64, error) {
+    switch strings.ToLower(string(unit)) {
+    case "m":
+        return 1, nil
+    case "km":
+        return 1000, nil
+    case "ft":
+        return 0.3048, nil
+    case "mi":
+        return 1609.34, nil
+    }
+    return 0, ErrGeoUnit
+}
+
+func __geo_formatDist(dist float64) []byte {
+    return []byte(strconv.FormatFloat(dist, 'f', 4, 64))
+}
+
+func __geo_formatCoord(v float64) []byte {
+    return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+type geoPointsByDist []geoPoint
+
+func (p geoPointsByDist) Len() int           { return len(p) }
+func (p geoPointsByDist) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p geoPointsByDist) Less(i, j int) bool { return p[i].dist < p[j].dist }
@@ -0,0 +1,61 @@
+package main
+
+import (
+    "math"
+    "testing"
+)
+
+func TestGeoEncode(t *testing.T) {
+    // the scores of GEOADD in Redis
+    tests := []struct {
+        name     string
+        lon, lat float64
+        hash     uint64
+    }{
+        {"Palermo", 13.361389, 38.115556, 3479099956230698},
+        {"Catania", 15.087269, 37.502669, 3479447370796909},
+    }
+    for _, test := range tests {
+        hash := __geo_encode(test.lon, test.lat, kGeoStepMax)
+        if hash != test.hash {
+            t.Errorf("%s: __geo_encode(%g, %g) = %d, want %d", test.name, test.lon, test.lat, hash, test.hash)
+        }
+        lon, lat := __geo_decode(hash, kGeoStepMax)
+        if math.Abs(lon-test.lon) > 1e-5 || math.Abs(lat-test.lat) > 1e-5 {
+            t.Errorf("%s: __geo_decode(%d) = %g, %g, want %g, %g", test.name, hash, lon, lat, test.lon, test.lat)
+        }
+    }
+}
+
+func TestGeoInterleave(t *testing.T) {
+    tests := []struct {
+        latIdx, lonIdx uint32
+        hash           uint64
+    }{
+        {0, 0, 0},
+        {1, 0, 1},
+        {0, 1, 2},
+        {3, 0, 5},
+        {0xFFFFFFFF, 0, 0x5555555555555555},
+        {0, 0xFFFFFFFF, 0xAAAAAAAAAAAAAAAA},
+    }
+    for _, test := range tests {
+        hash := __geo_interleave(test.latIdx, test.lonIdx)
+        if hash != test.hash {
+            t.Errorf("__geo_interleave(%x, %x) = %x, want %x", test.latIdx, test.lonIdx, hash, test.hash)
+        }
+        if latIdx, lonIdx := __geo_deinterleave(hash); latIdx != test.latIdx || lonIdx != test.lonIdx {
+            t.Errorf("__geo_deinterleave(%x) = %x, %x", hash, latIdx, lonIdx)
+        }
+    }
+}
+
+func TestGeoDistance(t *testing.T) {
+    // GEODIST Sicily Palermo Catania in Redis, between the decoded positions
+    lon1, lat1 := __geo_decode(3479099956230698, kGeoStepMax)
+    lon2, lat2 := __geo_decode(3479447370796909, kGeoStepMax)
+    dist := __geo_distance(lon1, lat1, lon2, lat2)
+    if math.Abs(dist-166274.1516) > 0.001 {
+        t.Errorf("__geo_distance = %.4f, want 166274.1516", dist)
+    }
+}
@@ -4,7 +4,13 @@ import (
     "encoding/gob"
     "fmt"
     rocks "github.com/tecbot/gorocksdb"
+    "hash/fnv"
+    "math"
+    "math/rand"
     "reflect"
+    "strconv"
+    "strings"
+    "sync"
 )
 
 func (rh *RocksDBHandler) RedisHkeys(key []byte) ([][]byte, error) {
@@ -154,7 +160,7 @@ func (rh *RocksDBHandler) RedisHmget(key, field []byte, fields ...[]byte) ([][]b
     return data, nil
 }
 
-func (rh *RocksDBHandler) RedisHset(key, field, value []byte) (int, error) {
+func (rh *RocksDBHandler) RedisHset(key, field, value []byte, pairs ...[]byte) (int, error) {
     if err := rh.checkRedisCall(key, field, value); err != nil {
         return 0, err
     }
@@ -162,21 +168,145 @@ func (rh *RocksDBHandler) RedisHset(key, field, value []byte) (int, error) {
         return 0, err
     }
 
-    // This is hurting the performance for 1-5ms
-    // hashData, err := rh._hash_getData(key)
-    // if err != nil {
-    //     return 0, err
-    // }
-    // _, exists := hashData[string(field)]
+    data := append([][]byte{field, value}, pairs...)
+    if len(data)%2 != 0 {
+        return 0, ErrWrongArgumentsCount
+    }
+    // Counting the new fields needs a read which costs 1-5ms, but this is the reply of HSET
+    hashData, err := rh._hash_getData(key)
+    if err != nil {
+        return 0, err
+    }
+    count := 0
+    newFields := make(map[string]bool)
+    for i := 0; i < len(data); i += 2 {
+        f := string(data[i])
+        if _, exists := hashData[f]; !exists && !newFields[f] {
+            newFields[f] = true
+            count++
+        }
+    }
+    if err := rh._hash_doMerge(key, data, kHashOpSet); err != nil {
+        return 0, err
+    }
+    return count, nil
+}
+
+func (rh *RocksDBHandler) RedisHsetnx(key, field, value []byte) (int, error) {
+    if err := rh.checkRedisCall(key, field, value); err != nil {
+        return 0, err
+    }
+    if err := rh.checkKeyType(key, kRedisHash); err != nil {
+        return 0, err
+    }
+
+    hashData, err := rh._hash_getData(key)
+    if err != nil {
+        return 0, err
+    }
+    if _, exists := hashData[string(field)]; exists {
+        return 0, nil
+    }
     if err := rh._hash_doMerge(key, [][]byte{field, value}, kHashOpSet); err != nil {
         return 0, err
     }
-    // if exists {
-    //     return 0, nil
-    // }
     return 1, nil
 }
 
+func (rh *RocksDBHandler) RedisHincrby(key, field, increment []byte) (int, error) {
+    if _, err := strconv.ParseInt(string(increment), 10, 64); err != nil {
+        return 0, ErrNotNumber
+    }
+    data, err := rh._hash_doIncr(key, field, increment, kHashOpIncr)
+    if err != nil {
+        return 0, err
+    }
+    n, err := strconv.Atoi(string(data))
+    if err != nil {
+        return 0, ErrHashNotNumber
+    }
+    return n, nil
+}
+
+func (rh *RocksDBHandler) RedisHincrbyfloat(key, field, increment []byte) ([]byte, error) {
+    if _, err := __hash_parseFloat(increment); err != nil {
+        return nil, ErrNotFloat
+    }
+    return rh._hash_doIncr(key, field, increment, kHashOpIncrFloat)
+}
+
+func (rh *RocksDBHandler) RedisHstrlen(key, field []byte) (int, error) {
+    value, err := rh.RedisHget(key, field)
+    if err != nil {
+        return 0, err
+    }
+    return len(value), nil
+}
+
+// HRANDFIELD key [count [WITHVALUES]], a negative count allows the same field multiple times
+func (rh *RocksDBHandler) RedisHrandfield(key []byte, args ...[]byte) (interface{}, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return nil, err
+    }
+    if err := rh.checkKeyType(key, kRedisHash); err != nil {
+        return nil, err
+    }
+    if len(args) > 2 {
+        return nil, ErrSyntax
+    }
+    withValues := false
+    if len(args) == 2 {
+        if strings.ToLower(string(args[1])) != "withvalues" {
+            return nil, ErrSyntax
+        }
+        withValues = true
+    }
+
+    hashData, err := rh._hash_getData(key)
+    if err != nil {
+        return nil, err
+    }
+    fields := make([]string, 0, len(hashData))
+    for f := range hashData {
+        fields = append(fields, f)
+    }
+    if len(args) == 0 {
+        if len(fields) == 0 {
+            return []byte(nil), nil
+        }
+        return []byte(fields[rand.Intn(len(fields))]), nil
+    }
+
+    count, err := strconv.Atoi(string(args[0]))
+    if err != nil {
+        return nil, ErrNotNumber
+    }
+    var picked []string
+    if count >= 0 {
+        if count > len(fields) {
+            count = len(fields)
+        }
+        picked = make([]string, count)
+        for i, j := range rand.Perm(len(fields))[:count] {
+            picked[i] = fields[j]
+        }
+    } else if len(fields) > 0 {
+        picked = make([]string, -count)
+        for i := range picked {
+            picked[i] = fields[rand.Intn(len(fields))]
+        }
+    }
+
+    data := make([][]byte, 0, len(picked)*2)
+    for _, f := range picked {
+        data = append(data, []byte(f))
+        if withValues {
+            data = append(data, hashData[f])
+        }
+    }
+    return data, nil
+}
+
 func (rh *RocksDBHandler) RedisHmset(key, field, value []byte, pairs ...[]byte) error {
     if err := rh.checkRedisCall(key, field, value); err != nil {
         return err
@@ -192,7 +322,7 @@ func (rh *RocksDBHandler) RedisHmset(key, field, value []byte, pairs ...[]byte)
     return rh._hash_doMerge(key, data, kHashOpSet)
 }
 
-func (rh *RocksDBHandler) RedisHgetall(key []byte) ([][]byte, error) {
+func (rh *RocksDBHandler) RedisHgetall(key []byte) (*MapReply, error) {
     if err := rh.checkRedisCall(key); err != nil {
         return nil, err
     }
@@ -204,7 +334,44 @@ func (rh *RocksDBHandler) RedisHgetall(key []byte) ([][]byte, error) {
     if err != nil {
         return nil, err
     }
-    return __hashToBytes(hashData), nil
+    return &MapReply{bytesToValues(__hashToBytes(hashData))}, nil
+}
+
+// _hash_doIncr writes the increment as a merge operand, but it still reads and decodes the whole
+// hash once, as the fields are not stored apart, to validate the field and to reply the value the
+// merge operator computes. So an increment is not free of the read, only of the rewrite of the hash.
+func (rh *RocksDBHandler) _hash_doIncr(key, field, increment []byte, opCode string) ([]byte, error) {
+    if err := rh.checkRedisCall(key, field); err != nil {
+        return nil, err
+    }
+    if err := rh.checkKeyType(key, kRedisHash); err != nil {
+        return nil, err
+    }
+
+    lock := rh._hash_incrLock(key)
+    lock.Lock()
+    defer lock.Unlock()
+
+    hashData, err := rh._hash_getData(key)
+    if err != nil {
+        return nil, err
+    }
+    // the merge operator applies the same increment and drops it if invalid
+    value, err := __hash_applyIncr(hashData[string(field)], increment, opCode)
+    if err != nil {
+        return nil, err
+    }
+    if err := rh._hash_doMerge(key, [][]byte{field, increment}, opCode); err != nil {
+        return nil, err
+    }
+    return value, nil
+}
+
+// _hash_incrLock is the lock of the increments of the key, striped by the hash of the key
+func (rh *RocksDBHandler) _hash_incrLock(key []byte) *sync.Mutex {
+    h := fnv.New32a()
+    h.Write(key)
+    return &rh.hashIncrLocks[h.Sum32()%kHashIncrLocks]
 }
 
 func (rh *RocksDBHandler) _hash_doMerge(key []byte, values [][]byte, opCode string) error {
@@ -224,7 +391,11 @@ func (rh *RocksDBHandler) _hash_doMerge(key []byte, values [][]byte, opCode stri
             return err
         }
     }
-    return rh.db.Write(options, batch)
+    if err := rh.db.Write(options, batch); err != nil {
+        return err
+    }
+    rh.notifyKeyspaceEvent(kNotifyHash, __hash_opEvent(opCode), key)
+    return nil
 }
 
 func (rh *RocksDBHandler) _hash_getData(key []byte) (map[string][]byte, error) {
@@ -248,10 +419,22 @@ func (rh *RocksDBHandler) _hash_getData(key []byte) (map[string][]byte, error) {
     }
 }
 
+// kHashIncrLocks is the number of the locks striping the hash increments by the key
+const kHashIncrLocks = 64
+
 const (
-    kHashOpNone   = "noop"
-    kHashOpSet    = "set"
-    kHashOpDelete = "delete"
+    kHashOpNone      = "noop"
+    kHashOpSet       = "set"
+    kHashOpDelete    = "delete"
+    kHashOpIncr      = "incr"
+    kHashOpIncrFloat = "incrfloat"
+)
+
+var (
+    ErrHashNotNumber = fmt.Errorf("hash value is not an integer")
+    ErrHashNotFloat  = fmt.Errorf("hash value is not a float")
+    ErrIncrOverflow  = fmt.Errorf("increment or decrement would overflow")
+    ErrIncrNaN       = fmt.Errorf("increment would produce NaN or Infinity")
 )
 
 type HashOperand struct {
@@ -283,6 +466,11 @@ func (m *HashMerger) FullMerge(existingObject *RedisObject, operands [][]byte) b
                 hashData[op.Key] = op.Value
             case kHashOpDelete:
                 delete(hashData, op.Key)
+            case kHashOpIncr, kHashOpIncrFloat:
+                // an increment of a value which is not a number or overflows is dropped
+                if value, err := __hash_applyIncr(hashData[op.Key], op.Value, op.Command); err == nil {
+                    hashData[op.Key] = value
+                }
             }
         }
     }
@@ -302,14 +490,89 @@ func (m *HashMerger) PartialMerge(leftOperand, rightOperand []byte) ([]byte, boo
         return nil, false
     }
     rightOp := obj.(HashOperand)
-    if leftOp.Key == rightOp.Key {
+    if leftOp.Key != rightOp.Key {
+        return nil, false
+    }
+    switch rightOp.Command {
+    case kHashOpSet, kHashOpDelete:
         // fmt.Println("PartialMerged", leftOp, rightOp)
         return rightOperand, true
+    case kHashOpIncr, kHashOpIncrFloat:
+        mergeOp := HashOperand{Command: leftOp.Command, Key: leftOp.Key}
+        err := ErrSyntax
+        switch leftOp.Command {
+        case kHashOpSet:
+            // set followed by incr is a set of the incremented value
+            mergeOp.Value, err = __hash_applyIncr(leftOp.Value, rightOp.Value, rightOp.Command)
+        case rightOp.Command:
+            // two increments are added up, unless they overflow together
+            mergeOp.Value, err = __hash_applyIncr(leftOp.Value, rightOp.Value, rightOp.Command)
+        }
+        if err == nil {
+            if data, err := encode(mergeOp); err == nil {
+                return data, true
+            }
+        }
     }
-
     return nil, false
 }
 
+// __hash_applyIncr adds the increment to the value, a missing value counts as zero
+func __hash_applyIncr(value, increment []byte, opCode string) ([]byte, error) {
+    if len(value) == 0 {
+        value = []byte("0")
+    }
+    switch opCode {
+    case kHashOpIncr:
+        n, err := strconv.ParseInt(string(value), 10, 64)
+        if err != nil {
+            return nil, ErrHashNotNumber
+        }
+        incr, err := strconv.ParseInt(string(increment), 10, 64)
+        if err != nil {
+            return nil, ErrNotNumber
+        }
+        if (incr > 0 && n > math.MaxInt64-incr) || (incr < 0 && n < math.MinInt64-incr) {
+            return nil, ErrIncrOverflow
+        }
+        return []byte(strconv.FormatInt(n+incr, 10)), nil
+    case kHashOpIncrFloat:
+        f, err := __hash_parseFloat(value)
+        if err != nil {
+            return nil, ErrHashNotFloat
+        }
+        incr, err := __hash_parseFloat(increment)
+        if err != nil {
+            return nil, ErrNotFloat
+        }
+        if math.IsInf(f+incr, 0) {
+            return nil, ErrIncrNaN
+        }
+        return []byte(strconv.FormatFloat(f+incr, 'f', -1, 64)), nil
+    }
+    return nil, ErrSyntax
+}
+
+func __hash_opEvent(opCode string) string {
+    switch opCode {
+    case kHashOpDelete:
+        return "hdel"
+    case kHashOpIncr:
+        return "hincrby"
+    case kHashOpIncrFloat:
+        return "hincrbyfloat"
+    }
+    return "hset"
+}
+
+func __hash_parseFloat(value []byte) (float64, error) {
+    f, err := strconv.ParseFloat(string(value), 64)
+    if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+        return 0, ErrNotFloat
+    }
+    return f, nil
+}
+
 func __hashToBytes(hashData map[string][]byte) [][]byte {
     rawData := make([][]byte, len(hashData)*2)
     index := 0
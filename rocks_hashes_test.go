@@ -0,0 +1,35 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestHashApplyIncr(t *testing.T) {
+    tests := []struct {
+        value     string
+        increment string
+        opCode    string
+        want      string
+        err       error
+    }{
+        {"", "5", kHashOpIncr, "5", nil},
+        {"10", "-15", kHashOpIncr, "-5", nil},
+        {"9223372036854775806", "1", kHashOpIncr, "9223372036854775807", nil},
+        {"9223372036854775807", "1", kHashOpIncr, "", ErrIncrOverflow},
+        {"-9223372036854775807", "-1", kHashOpIncr, "-9223372036854775808", nil},
+        {"-9223372036854775808", "-1", kHashOpIncr, "", ErrIncrOverflow},
+        {"abc", "1", kHashOpIncr, "", ErrHashNotNumber},
+        {"1.5", "1", kHashOpIncr, "", ErrHashNotNumber},
+        {"", "1.5", kHashOpIncrFloat, "1.5", nil},
+        {"10.5", "0.1", kHashOpIncrFloat, "10.6", nil},
+        {"abc", "1", kHashOpIncrFloat, "", ErrHashNotFloat},
+        {"1.7e308", "1.7e308", kHashOpIncrFloat, "", ErrIncrNaN},
+    }
+    for _, test := range tests {
+        value, err := __hash_applyIncr([]byte(test.value), []byte(test.increment), test.opCode)
+        if string(value) != test.want || err != test.err {
+            t.Errorf("__hash_applyIncr(%s, %s, %s) = %s, %v, want %s, %v",
+                test.value, test.increment, test.opCode, value, err, test.want, test.err)
+        }
+    }
+}
@@ -21,16 +21,21 @@ func (rh *RocksDBHandler) RedisDel(key []byte, keys ...[]byte) (int, error) {
     defer writeOptions.Destroy()
 
     for _, dKey := range keyData {
-        _, err := rh.loadRedisObject(readOptions, dKey)
-        if err == nil {
-            batch := rocks.NewWriteBatch()
+        if _, err := rh.loadRedisObject(readOptions, dKey); err != nil {
+            continue
+        }
+        batch := rocks.NewWriteBatch()
+        // under the lock of the type, e.g. not to race with XADD on the stream entries
+        if unlock, err := rh.deleteOldSubKeys(batch, dKey); err == nil {
             batch.Delete(rh.getTypeKey(dKey))
             batch.Delete(dKey)
             if err := rh.db.Write(writeOptions, batch); err == nil {
                 count++
+                rh.notifyKeyspaceEvent(kNotifyGeneric, "del", dKey)
             }
-            batch.Destroy()
+            unlock()
         }
+        batch.Destroy()
     }
     return count, nil
 }
@@ -99,7 +104,7 @@ func (rh *RocksDBHandler) RedisKeys(pattern []byte) ([][]byte, error) {
     for ; it.Valid(); it.Next() {
         key := it.Key()
         dKey := rh.copySlice(key, false)
-        if bytes.HasPrefix(dKey, kTypeKeyPrefix) {
+        if rh.isInternalKey(dKey) {
             continue
         }
         if !bytes.HasPrefix(dKey, pattern) {
@@ -5,6 +5,7 @@ import (
     "fmt"
     rocks "github.com/tecbot/gorocksdb"
     "reflect"
+    "strings"
 )
 
 func (rh *RocksDBHandler) RedisLlen(key []byte) (int, error) {
@@ -38,7 +39,7 @@ func (rh *RocksDBHandler) RedisLindex(key []byte, index int) ([]byte, error) {
         index += len(data)
     }
     if index < 0 || index >= len(data) {
-        return []byte{}, nil
+        return nil, nil
     }
     return data[index], nil
 }
@@ -79,6 +80,50 @@ func (rh *RocksDBHandler) RedisLpush(key, value []byte, values ...[]byte) (int,
     return rh._list_Push(0, key, value, values...)
 }
 
+func (rh *RocksDBHandler) RedisBlpop(request *Request, keysTimeout [][]byte) ([][]byte, error) {
+    return rh._list_BlockingPop(request, 0, keysTimeout)
+}
+
+func (rh *RocksDBHandler) RedisBrpop(request *Request, keysTimeout [][]byte) ([][]byte, error) {
+    return rh._list_BlockingPop(request, -1, keysTimeout)
+}
+
+func (rh *RocksDBHandler) RedisLmove(source, destination, whereFrom, whereTo []byte) ([]byte, error) {
+    from, to, err := __list_getMoveDirections(whereFrom, whereTo)
+    if err != nil {
+        return nil, err
+    }
+    return rh._list_Move(source, destination, from, to)
+}
+
+func (rh *RocksDBHandler) RedisBlmove(request *Request, source, destination, whereFrom, whereTo, timeout []byte) ([]byte, error) {
+    from, to, err := __list_getMoveDirections(whereFrom, whereTo)
+    if err != nil {
+        return nil, err
+    }
+    duration, err := parseTimeout(timeout)
+    if err != nil {
+        return nil, err
+    }
+
+    var moveData []byte
+    err = rh.blockForKeys(request, [][]byte{source}, duration, func() (bool, error) {
+        data, err := rh._list_Move(source, destination, from, to)
+        if err != nil {
+            return false, err
+        }
+        moveData = data
+        return data != nil, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if moveData == nil {
+        return nil, nil
+    }
+    return moveData, nil
+}
+
 func (rh *RocksDBHandler) RedisLtrim(key []byte, start, end int) error {
     if err := rh.checkRedisCall(key); err != nil {
         return err
@@ -102,7 +147,7 @@ func (rh *RocksDBHandler) _list_Pop(direction int, key []byte) ([]byte, error) {
         return nil, err
     }
     if len(data) == 0 {
-        return []byte{}, nil // this is not an error
+        return nil, nil // this is not an error
     }
     popData := data[0]
     if direction == -1 {
@@ -114,6 +159,91 @@ func (rh *RocksDBHandler) _list_Pop(direction int, key []byte) ([]byte, error) {
     return popData, nil
 }
 
+func (rh *RocksDBHandler) _list_BlockingPop(request *Request, direction int, keysTimeout [][]byte) ([][]byte, error) {
+    if len(keysTimeout) < 2 {
+        return nil, ErrWrongArgumentsCount
+    }
+    keys := keysTimeout[:len(keysTimeout)-1]
+    timeout, err := parseTimeout(keysTimeout[len(keysTimeout)-1])
+    if err != nil {
+        return nil, err
+    }
+    if err := rh.checkRedisCall(keys...); err != nil {
+        return nil, err
+    }
+    for _, key := range keys {
+        if err := rh.checkKeyType(key, kRedisList); err != nil {
+            return nil, err
+        }
+    }
+
+    var popKey, popData []byte
+    err = rh.blockForKeys(request, keys, timeout, func() (bool, error) {
+        for _, key := range keys {
+            data, err := rh._list_Pop(direction, key)
+            if err != nil {
+                return false, err
+            }
+            if data != nil {
+                popKey, popData = key, data
+                return true, nil
+            }
+        }
+        return false, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if popData == nil {
+        // timed out
+        return nil, nil
+    }
+    return [][]byte{popKey, popData}, nil
+}
+
+// _list_Move pops from the source and pushes to the destination in one write batch
+func (rh *RocksDBHandler) _list_Move(source, destination []byte, from, to int) ([]byte, error) {
+    if err := rh.checkRedisCall(source, destination); err != nil {
+        return nil, err
+    }
+    if err := rh.checkKeyType(source, kRedisList); err != nil {
+        return nil, err
+    }
+    if err := rh.checkKeyType(destination, kRedisList); err != nil {
+        return nil, err
+    }
+
+    data, err := rh._list_getData(source)
+    if err != nil {
+        return nil, err
+    }
+    if len(data) == 0 {
+        return nil, nil
+    }
+    moveData := data[0]
+    if from == -1 {
+        moveData = data[len(data)-1]
+    }
+
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+    if err := rh._list_batchMerge(batch, source, ListOperand{kListOpRemove, from, 0, moveData}); err != nil {
+        return nil, err
+    }
+    if err := rh._list_batchMerge(batch, destination, ListOperand{kListOpInsert, to, 0, moveData}); err != nil {
+        return nil, err
+    }
+    if err := rh.db.Write(options, batch); err != nil {
+        return nil, err
+    }
+    rh.notifyKeyspaceEvent(kNotifyList, __list_opEvent(kListOpRemove, from), source)
+    rh.notifyKeyspaceEvent(kNotifyList, __list_opEvent(kListOpInsert, to), destination)
+    rh.signalKeyAsReady(destination, 1)
+    return moveData, nil
+}
+
 func (rh *RocksDBHandler) _list_Push(direction int, key, value []byte, values ...[]byte) (int, error) {
     if err := rh.checkRedisCall(key, value); err != nil {
         return 0, err
@@ -125,6 +255,7 @@ func (rh *RocksDBHandler) _list_Push(direction int, key, value []byte, values ..
     if err := rh._list_doMerge(key, values, kListOpInsert, direction, 0); err != nil {
         return 0, err
     }
+    rh.signalKeyAsReady(key, len(values))
     // This will hurt the performance
     // if data, err := rh._list_getData(key); err == nil {
     //     return len(data), nil
@@ -150,16 +281,27 @@ func (rh *RocksDBHandler) _list_doMerge(key []byte, value interface{}, opCode st
     defer options.Destroy()
     batch := rocks.NewWriteBatch()
     defer batch.Destroy()
-    batch.Put(rh.getTypeKey(key), []byte(kRedisList))
     for _, dValue := range values {
         operand := ListOperand{opCode, start, end, dValue}
-        if data, err := encode(operand); err == nil {
-            batch.Merge(key, data)
-        } else {
+        if err := rh._list_batchMerge(batch, key, operand); err != nil {
             return err
         }
     }
-    return rh.db.Write(options, batch)
+    if err := rh.db.Write(options, batch); err != nil {
+        return err
+    }
+    rh.notifyKeyspaceEvent(kNotifyList, __list_opEvent(opCode, start), key)
+    return nil
+}
+
+func (rh *RocksDBHandler) _list_batchMerge(batch *rocks.WriteBatch, key []byte, operand ListOperand) error {
+    data, err := encode(operand)
+    if err != nil {
+        return err
+    }
+    batch.Put(rh.getTypeKey(key), []byte(kRedisList))
+    batch.Merge(key, data)
+    return nil
 }
 
 func (rh *RocksDBHandler) _list_getData(key []byte) ([][]byte, error) {
@@ -237,6 +379,44 @@ func (m *ListMerger) PartialMerge(leftOperand, rightOperand []byte) ([]byte, boo
     return nil, false
 }
 
+func __list_opEvent(opCode string, direction int) string {
+    switch opCode {
+    case kListOpInsert:
+        if direction == 0 {
+            return "lpush"
+        }
+        return "rpush"
+    case kListOpRemove:
+        if direction == 0 {
+            return "lpop"
+        }
+        return "rpop"
+    }
+    return "ltrim"
+}
+
+func __list_getMoveDirections(whereFrom, whereTo []byte) (int, int, error) {
+    from, err := __list_getDirection(whereFrom)
+    if err != nil {
+        return 0, 0, err
+    }
+    to, err := __list_getDirection(whereTo)
+    if err != nil {
+        return 0, 0, err
+    }
+    return from, to, nil
+}
+
+func __list_getDirection(where []byte) (int, error) {
+    switch strings.ToLower(string(where)) {
+    case "left":
+        return 0, nil
+    case "right":
+        return -1, nil
+    }
+    return 0, ErrSyntax
+}
+
 func __list_getIndex(index, length int, isRightmost bool) int {
     if index < 0 {
         index += length
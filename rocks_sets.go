@@ -4,7 +4,10 @@ import (
     "encoding/gob"
     "fmt"
     rocks "github.com/tecbot/gorocksdb"
+    "math/rand"
     "reflect"
+    "sort"
+    "strconv"
 )
 
 func (rh *RocksDBHandler) RedisScard(key []byte) (int, error) {
@@ -40,7 +43,7 @@ func (rh *RocksDBHandler) RedisSismember(key, member []byte) (int, error) {
     return 0, nil
 }
 
-func (rh *RocksDBHandler) RedisSmembers(key []byte) ([][]byte, error) {
+func (rh *RocksDBHandler) RedisSmembers(key []byte) (*SetReply, error) {
     if err := rh.checkRedisCall(key); err != nil {
         return nil, err
     }
@@ -52,7 +55,7 @@ func (rh *RocksDBHandler) RedisSmembers(key []byte) ([][]byte, error) {
     if err != nil {
         return nil, err
     }
-    return __setToBytes(setData), nil
+    return &SetReply{bytesToValues(__setToBytes(setData))}, nil
 }
 
 func (rh *RocksDBHandler) RedisSadd(key, value []byte, values ...[]byte) (int, error) {
@@ -71,6 +74,252 @@ func (rh *RocksDBHandler) RedisSrem(key, value []byte, values ...[]byte) (int, e
     return existCount, nil
 }
 
+func (rh *RocksDBHandler) RedisSmismember(key, member []byte, members ...[]byte) ([]interface{}, error) {
+    if err := rh.checkRedisCall(key, member); err != nil {
+        return nil, err
+    }
+    if err := rh.checkKeyType(key, kRedisSet); err != nil {
+        return nil, err
+    }
+
+    setData, err := rh._set_getData(key)
+    if err != nil {
+        return nil, err
+    }
+    members = append([][]byte{member}, members...)
+    data := make([]interface{}, len(members))
+    for i := range members {
+        if _, ok := setData[string(members[i])]; ok {
+            data[i] = 1
+        } else {
+            data[i] = 0
+        }
+    }
+    return data, nil
+}
+
+func (rh *RocksDBHandler) RedisSinter(key []byte, keys ...[]byte) (*SetReply, error) {
+    sets, err := rh._set_getSets(append([][]byte{key}, keys...))
+    if err != nil {
+        return nil, err
+    }
+    return &SetReply{bytesToValues(__setToBytes(__set_inter(sets)))}, nil
+}
+
+func (rh *RocksDBHandler) RedisSunion(key []byte, keys ...[]byte) (*SetReply, error) {
+    sets, err := rh._set_getSets(append([][]byte{key}, keys...))
+    if err != nil {
+        return nil, err
+    }
+    return &SetReply{bytesToValues(__setToBytes(__set_union(sets)))}, nil
+}
+
+func (rh *RocksDBHandler) RedisSdiff(key []byte, keys ...[]byte) (*SetReply, error) {
+    sets, err := rh._set_getSets(append([][]byte{key}, keys...))
+    if err != nil {
+        return nil, err
+    }
+    return &SetReply{bytesToValues(__setToBytes(__set_diff(sets)))}, nil
+}
+
+func (rh *RocksDBHandler) RedisSinterstore(destination, key []byte, keys ...[]byte) (int, error) {
+    sets, err := rh._set_getSets(append([][]byte{key}, keys...))
+    if err != nil {
+        return 0, err
+    }
+    return rh._set_store(destination, __set_inter(sets), "sinterstore")
+}
+
+func (rh *RocksDBHandler) RedisSunionstore(destination, key []byte, keys ...[]byte) (int, error) {
+    sets, err := rh._set_getSets(append([][]byte{key}, keys...))
+    if err != nil {
+        return 0, err
+    }
+    return rh._set_store(destination, __set_union(sets), "sunionstore")
+}
+
+func (rh *RocksDBHandler) RedisSdiffstore(destination, key []byte, keys ...[]byte) (int, error) {
+    sets, err := rh._set_getSets(append([][]byte{key}, keys...))
+    if err != nil {
+        return 0, err
+    }
+    return rh._set_store(destination, __set_diff(sets), "sdiffstore")
+}
+
+// SMOVE removes the member from the source and adds to the destination in one write batch
+func (rh *RocksDBHandler) RedisSmove(source, destination, member []byte) (int, error) {
+    if err := rh.checkRedisCall(source, destination, member); err != nil {
+        return 0, err
+    }
+    if err := rh.checkKeyType(source, kRedisSet); err != nil {
+        return 0, err
+    }
+    if err := rh.checkKeyType(destination, kRedisSet); err != nil {
+        return 0, err
+    }
+
+    setData, err := rh._set_getData(source)
+    if err != nil {
+        return 0, err
+    }
+    if _, ok := setData[string(member)]; !ok {
+        return 0, nil
+    }
+
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+    if err := rh._set_batchMerge(batch, source, SetOperand{kSetOpDelete, member}); err != nil {
+        return 0, err
+    }
+    if err := rh._set_batchMerge(batch, destination, SetOperand{kSetOpSet, member}); err != nil {
+        return 0, err
+    }
+    if err := rh.db.Write(options, batch); err != nil {
+        return 0, err
+    }
+    rh.notifyKeyspaceEvent(kNotifySet, "srem", source)
+    rh.notifyKeyspaceEvent(kNotifySet, "sadd", destination)
+    return 1, nil
+}
+
+// SPOP key [count]
+func (rh *RocksDBHandler) RedisSpop(key []byte, args ...[]byte) (interface{}, error) {
+    count, withCount, err := __set_getCount(args)
+    if err != nil {
+        return nil, err
+    }
+    if withCount && count < 0 {
+        return nil, ErrOutOfRange
+    }
+    members, err := rh._set_randMembers(key, count, withCount)
+    if err != nil {
+        return nil, err
+    }
+    if len(members) > 0 {
+        options := rocks.NewDefaultWriteOptions()
+        defer options.Destroy()
+        batch := rocks.NewWriteBatch()
+        defer batch.Destroy()
+        for _, member := range members {
+            if err := rh._set_batchMerge(batch, key, SetOperand{kSetOpDelete, member}); err != nil {
+                return nil, err
+            }
+        }
+        if err := rh.db.Write(options, batch); err != nil {
+            return nil, err
+        }
+        rh.notifyKeyspaceEvent(kNotifySet, "spop", key)
+    }
+    return __set_randReply(members, withCount), nil
+}
+
+// SRANDMEMBER key [count], a negative count allows the same member multiple times
+func (rh *RocksDBHandler) RedisSrandmember(key []byte, args ...[]byte) (interface{}, error) {
+    count, withCount, err := __set_getCount(args)
+    if err != nil {
+        return nil, err
+    }
+    members, err := rh._set_randMembers(key, count, withCount)
+    if err != nil {
+        return nil, err
+    }
+    return __set_randReply(members, withCount), nil
+}
+
+func (rh *RocksDBHandler) _set_randMembers(key []byte, count int, withCount bool) ([][]byte, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return nil, err
+    }
+    if err := rh.checkKeyType(key, kRedisSet); err != nil {
+        return nil, err
+    }
+
+    setData, err := rh._set_getData(key)
+    if err != nil {
+        return nil, err
+    }
+    members := __setToBytes(setData)
+    if !withCount {
+        count = 1
+    }
+    if len(members) == 0 {
+        return [][]byte{}, nil
+    }
+    if count < 0 {
+        picked := make([][]byte, -count)
+        for i := range picked {
+            picked[i] = members[rand.Intn(len(members))]
+        }
+        return picked, nil
+    }
+    if count > len(members) {
+        count = len(members)
+    }
+    picked := make([][]byte, count)
+    for i, j := range rand.Perm(len(members))[:count] {
+        picked[i] = members[j]
+    }
+    return picked, nil
+}
+
+// _set_getSets loads all the sets, a missing key is an empty set
+func (rh *RocksDBHandler) _set_getSets(keys [][]byte) ([]map[string]bool, error) {
+    if err := rh.checkRedisCall(keys...); err != nil {
+        return nil, err
+    }
+    sets := make([]map[string]bool, len(keys))
+    for i, key := range keys {
+        if err := rh.checkKeyType(key, kRedisSet); err != nil {
+            return nil, err
+        }
+        setData, err := rh._set_getData(key)
+        if err != nil {
+            return nil, err
+        }
+        sets[i] = setData
+    }
+    return sets, nil
+}
+
+// _set_store replaces the key with the members in one write batch, an empty result deletes the key
+func (rh *RocksDBHandler) _set_store(key []byte, setData map[string]bool, event string) (int, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return 0, err
+    }
+
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+    unlock, err := rh.deleteOldSubKeys(batch, key)
+    if err != nil {
+        return 0, err
+    }
+    defer unlock()
+    if len(setData) == 0 {
+        batch.Delete(rh.getTypeKey(key))
+        batch.Delete(key)
+    } else {
+        data, err := encode(RedisObject{Type: kRedisSet, Data: __setToBytes(setData)})
+        if err != nil {
+            return 0, err
+        }
+        batch.Put(rh.getTypeKey(key), []byte(kRedisSet))
+        batch.Put(key, data)
+    }
+    if err := rh.db.Write(options, batch); err != nil {
+        return 0, err
+    }
+    if len(setData) == 0 {
+        rh.notifyKeyspaceEvent(kNotifyGeneric, "del", key)
+    } else {
+        rh.notifyKeyspaceEvent(kNotifySet, event, key)
+    }
+    return len(setData), nil
+}
+
 func (rh *RocksDBHandler) _set_doMembership(opCode string, key, value []byte, values ...[]byte) (int, int, error) {
     if err := rh.checkRedisCall(key, value); err != nil {
         return 0, 0, err
@@ -104,16 +353,31 @@ func (rh *RocksDBHandler) _set_doMerge(key []byte, values [][]byte, opCode strin
     defer options.Destroy()
     batch := rocks.NewWriteBatch()
     defer batch.Destroy()
-    batch.Put(rh.getTypeKey(key), []byte(kRedisSet))
     for _, value := range values {
         operand := SetOperand{opCode, value}
-        if data, err := encode(operand); err == nil {
-            batch.Merge(key, data)
-        } else {
+        if err := rh._set_batchMerge(batch, key, operand); err != nil {
             return err
         }
     }
-    return rh.db.Write(options, batch)
+    if err := rh.db.Write(options, batch); err != nil {
+        return err
+    }
+    event := "sadd"
+    if opCode == kSetOpDelete {
+        event = "srem"
+    }
+    rh.notifyKeyspaceEvent(kNotifySet, event, key)
+    return nil
+}
+
+func (rh *RocksDBHandler) _set_batchMerge(batch *rocks.WriteBatch, key []byte, operand SetOperand) error {
+    data, err := encode(operand)
+    if err != nil {
+        return err
+    }
+    batch.Put(rh.getTypeKey(key), []byte(kRedisSet))
+    batch.Merge(key, data)
+    return nil
 }
 
 func (rh *RocksDBHandler) _set_getData(key []byte) (map[string]bool, error) {
@@ -195,6 +459,88 @@ func (m *SetMerger) PartialMerge(leftOperand, rightOperand []byte) ([]byte, bool
     return nil, false
 }
 
+// __set_inter iterates the smallest set and probes the others, from small to large
+func __set_inter(sets []map[string]bool) map[string]bool {
+    sorted := make([]map[string]bool, len(sets))
+    copy(sorted, sets)
+    sort.Sort(setsBySize(sorted))
+
+    result := make(map[string]bool)
+    if len(sorted) == 0 || len(sorted[0]) == 0 {
+        return result
+    }
+    for member := range sorted[0] {
+        inAll := true
+        for _, other := range sorted[1:] {
+            if !other[member] {
+                inAll = false
+                break
+            }
+        }
+        if inAll {
+            result[member] = true
+        }
+    }
+    return result
+}
+
+func __set_union(sets []map[string]bool) map[string]bool {
+    result := make(map[string]bool)
+    for _, setData := range sets {
+        for member := range setData {
+            result[member] = true
+        }
+    }
+    return result
+}
+
+func __set_diff(sets []map[string]bool) map[string]bool {
+    result := make(map[string]bool)
+    if len(sets) == 0 {
+        return result
+    }
+    for member := range sets[0] {
+        result[member] = true
+    }
+    for _, other := range sets[1:] {
+        for member := range other {
+            delete(result, member)
+        }
+    }
+    return result
+}
+
+func __set_getCount(args [][]byte) (int, bool, error) {
+    if len(args) == 0 {
+        return 0, false, nil
+    }
+    if len(args) > 1 {
+        return 0, false, ErrSyntax
+    }
+    count, err := strconv.Atoi(string(args[0]))
+    if err != nil {
+        return 0, false, ErrNotNumber
+    }
+    return count, true, nil
+}
+
+// __set_randReply is a bulk without count, otherwise a multi bulk
+func __set_randReply(members [][]byte, withCount bool) interface{} {
+    if withCount {
+        return members
+    }
+    if len(members) == 0 {
+        return []byte(nil)
+    }
+    return members[0]
+}
+
+type setsBySize []map[string]bool
+
+func (s setsBySize) Len() int           { return len(s) }
+func (s setsBySize) Less(i, j int) bool { return len(s[i]) < len(s[j]) }
+func (s setsBySize) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 func __setToBytes(setData map[string]bool) [][]byte {
     rawData := make([][]byte, len(setData))
     index := 0
@@ -1,9 +1,12 @@
 package main
 
 import (
+    "bytes"
     "fmt"
     "os"
+    rocks "github.com/tecbot/gorocksdb"
     "runtime"
+    "strconv"
     "strings"
     "time"
 )
@@ -23,38 +26,86 @@ func (rh *RocksDBHandler) RedisPing() (*StatusReply, error) {
     return &StatusReply{"PONG"}, nil
 }
 
-func (rh *RocksDBHandler) RedisInfo() ([]byte, error) {
+// kInfoDefaultSections are the sections of INFO without any, the others need to be named, all or
+// everything. The keyspace iterates all the keys so it is only reported when named or by everything,
+// estimate_num_keys of the rocksdb section is the cheap count.
+var (
+    kInfoDefaultSections    = []string{"server", "runtime", "rocksdb"}
+    kInfoAllSections        = []string{"server", "runtime", "rocksdb", "commandstats", "latencystats"}
+    kInfoEverythingSections = append(kInfoAllSections[:len(kInfoAllSections):len(kInfoAllSections)], "keyspace")
+)
+
+// INFO [section ...], or default, all and everything
+func (rh *RocksDBHandler) RedisInfo(sections ...[]byte) ([]byte, error) {
     if rh.db == nil {
         return nil, ErrRocksIsDead
     }
 
+    selected := __info_selectSections(sections)
     data := make([]string, 0)
+    if selected["server"] {
+        data = append(data, rh._info_server()...)
+    }
+    if selected["runtime"] {
+        data = append(data, rh._info_runtime()...)
+    }
+    if selected["rocksdb"] {
+        data = append(data, rh._info_rocksdb()...)
+    }
+    if selected["keyspace"] {
+        data = append(data, rh._info_keyspace()...)
+    }
+    if selected["commandstats"] && rh.server != nil {
+        data = append(data, "# Commandstats")
+        data = append(data, rh.server.cmdstats.InfoCommandStats()...)
+        data = append(data, "")
+    }
+    if selected["latencystats"] && rh.server != nil {
+        data = append(data, "# Latencystats")
+        data = append(data, rh.server.cmdstats.InfoLatencyStats()...)
+        data = append(data, "")
+    }
+    return []byte(strings.Join(data, "\r\n")), nil
+}
 
-    // server section
+func (rh *RocksDBHandler) _info_server() []string {
     qpsStart := globalStat.qpsStart.Get()
     qps := float64(globalStat.qpsCommands.Get()) / float64(time.Now().Unix()-qpsStart)
-    serverSection := []string{
+    config := globalStat.Config()
+    return []string{
         "# Server",
         "version: " + globalStat.version,
         "os: " + runtime.GOOS,
         fmt.Sprintf("process_id: %d", os.Getpid()),
-        fmt.Sprintf("tcp_port: %d", globalStat.config.Server.Port),
+        fmt.Sprintf("tcp_port: %d", config.Server.Port),
+        fmt.Sprintf("tls_port: %d", config.Server.TlsPort),
+        "unix_socket: " + config.Server.UnixSocket,
         "config_file: " + globalStat.configFile,
         fmt.Sprintf("uptime: %s", time.Since(globalStat.startTime)),
         fmt.Sprintf("connected_clients: %d", globalStat.clients.Get()),
+        fmt.Sprintf("maxclients: %d", rh._info_maxClients()),
+        fmt.Sprintf("blocked_clients: %d", globalStat.blockedClients.Get()),
         fmt.Sprintf("total_connections_received: %d", globalStat.totalConnections.Get()),
+        fmt.Sprintf("rejected_connections: %d", globalStat.rejectedConnections.Get()),
         fmt.Sprintf("total_commands_processed: %d", globalStat.totalCommands.Get()),
         fmt.Sprintf("instantaneous_ops_per_sec: %v", qps),
         fmt.Sprintf("keyspace_hits: %d", globalStat.keyHits.Get()),
         fmt.Sprintf("keyspace_misses: %d", globalStat.keyMisses.Get()),
         "",
     }
-    data = append(data, serverSection...)
+}
 
-    // Runtime Section
+func (rh *RocksDBHandler) _info_maxClients() int64 {
+    if rh.server == nil {
+        return 0
+    }
+    return rh.server.limits.maxClients.Get()
+}
+
+func (rh *RocksDBHandler) _info_runtime() []string {
     var memStats runtime.MemStats
     runtime.ReadMemStats(&memStats)
-    runtimeSection := []string{
+    return []string{
         "# Runtime",
         fmt.Sprintf("cpu_count: %d", runtime.NumCPU()),
         fmt.Sprintf("cgo_calls: %d", runtime.NumCgoCall()),
@@ -70,29 +121,105 @@ func (rh *RocksDBHandler) RedisInfo() ([]byte, error) {
         fmt.Sprintf("mem_gc_total_pause: %v", float64(memStats.PauseTotalNs)/float64(time.Millisecond)),
         "",
     }
-    data = append(data, runtimeSection...)
+}
 
-    // rocksdb section
+// kInfoRocksdbProperties are the fields of the Rocksdb section, read from the integer properties
+var kInfoRocksdbProperties = []struct {
+    field, property string
+}{
+    {"estimate_num_keys", "rocksdb.estimate-num-keys"},
+    {"cur_size_all_mem_tables", "rocksdb.cur-size-all-mem-tables"},
+    {"estimate_pending_compaction_bytes", "rocksdb.estimate-pending-compaction-bytes"},
+    {"block_cache_usage", "rocksdb.block-cache-usage"},
+    {"num_running_compactions", "rocksdb.num-running-compactions"},
+    {"background_errors", "rocksdb.background-errors"},
+}
+
+func (rh *RocksDBHandler) _info_rocksdb() []string {
+    config := globalStat.Config()
     rocksSection := []string{
         "# Rocksdb Config",
-        "rocksdb_directory: " + globalStat.config.Database.DbDir,
-        "max_memory: " + globalStat.config.Database.MaxMemory,
-        "block_size: " + globalStat.config.Database.BlockSize,
-        "compression: " + globalStat.config.Database.Compression,
-        "compaction_style: " + globalStat.config.Database.CompactionStyle,
-        fmt.Sprintf("max_memtable_merge: %d", globalStat.config.Database.MaxMerge),
+        "rocksdb_directory: " + config.Database.DbDir,
+        "max_memory: " + config.Database.MaxMemory,
+        "block_size: " + config.Database.BlockSize,
+        "compression: " + config.Database.Compression,
+        "compaction_style: " + config.Database.CompactionStyle,
+        fmt.Sprintf("max_memtable_merge: %d", config.Database.MaxMerge),
         "",
-        "# Rocksdb Stats",
+        "# Rocksdb",
     }
-    rocksStats := strings.Split(rh.db.GetProperty("rocksdb.stats"), "\n")
-    rocksStats = rocksStats[len(rocksStats)-14:]
-    for _, rockStat := range rocksStats {
-        rocksSection = append(rocksSection, rockStat)
+    // a property unknown to the RocksDB built with is left out
+    for level := 0; level < kRocksdbMaxLevels; level++ {
+        if value, ok := rh.getIntProperty(fmt.Sprintf("rocksdb.num-files-at-level%d", level)); ok {
+            rocksSection = append(rocksSection, fmt.Sprintf("num_files_at_level%d:%d", level, value))
+        }
     }
-    rocksSection = append(rocksSection, "")
-    data = append(data, rocksSection...)
+    for _, p := range kInfoRocksdbProperties {
+        if value, ok := rh.getIntProperty(p.property); ok {
+            rocksSection = append(rocksSection, fmt.Sprintf("%s:%d", p.field, value))
+        }
+    }
+    return append(rocksSection, "")
+}
 
-    return []byte(strings.Join(data, "\r\n")), nil
+// _info_keyspace counts the keys by their types, the only database is db0 and the keys never
+// expire as EXPIRE is a stub. It iterates all the keys, which is not cheap for a large database,
+// so only INFO keyspace and everything report it. Like the metrics, it holds the dbLock.
+func (rh *RocksDBHandler) _info_keyspace() []string {
+    options := rocks.NewDefaultReadOptions()
+    defer options.Destroy()
+    options.SetFillCache(false)
+
+    keys := 0
+    rh.dbLock.RLock()
+    if rh.db != nil {
+        it := rh.db.NewIterator(options)
+        for it.Seek(kTypeKeyPrefix); it.Valid(); it.Next() {
+            if !bytes.HasPrefix(it.Key().Data(), kTypeKeyPrefix) {
+                break
+            }
+            keys++
+        }
+        it.Close()
+    }
+    rh.dbLock.RUnlock()
+    keyspace := []string{"# Keyspace"}
+    if keys > 0 {
+        keyspace = append(keyspace, fmt.Sprintf("db0:keys=%d,expires=0", keys))
+    }
+    return append(keyspace, "")
+}
+
+// getIntProperty returns the value of the RocksDB property, false if unknown or not an integer
+func (rh *RocksDBHandler) getIntProperty(property string) (uint64, bool) {
+    value, err := strconv.ParseUint(strings.TrimSpace(rh.db.GetProperty(property)), 10, 64)
+    return value, err == nil
+}
+
+func __info_selectSections(sections [][]byte) map[string]bool {
+    selected := make(map[string]bool)
+    if len(sections) == 0 {
+        sections = [][]byte{[]byte("default")}
+    }
+    for _, section := range sections {
+        switch name := strings.ToLower(string(section)); name {
+        case "default":
+            for _, name := range kInfoDefaultSections {
+                selected[name] = true
+            }
+        case "all":
+            for _, name := range kInfoAllSections {
+                selected[name] = true
+            }
+        case "everything":
+            for _, name := range kInfoEverythingSections {
+                selected[name] = true
+            }
+        default:
+            selected[name] = true
+        }
+    }
+    return selected
 }
 
 var _ = fmt.Println
@@ -0,0 +1,921 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    rocks "github.com/tecbot/gorocksdb"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// The consumer groups are persisted beside the entries of the stream:
+//   __*xgroup*__<len(key)><key><len(group)><group> keeps the StreamGroup
+//   __*xpel*__<len(key)><key><len(group)><group><ms><seq> is a pending entry of the group,
+//   which records the owner consumer, the last delivery time and the delivery count.
+
+const (
+    kStreamAutoClaimCount = 100
+)
+
+var (
+    kStreamGroupPrefix = []byte("__*xgroup*__")
+    kStreamPelPrefix   = []byte("__*xpel*__")
+)
+
+var (
+    ErrStreamNoKey     = fmt.Errorf("The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+    ErrStreamBusyGroup = fmt.Errorf("BUSYGROUP Consumer Group name already exists")
+)
+
+type StreamGroup struct {
+    LastID      StreamID
+    EntriesRead int64
+    Consumers   map[string]StreamConsumer
+}
+
+type StreamConsumer struct {
+    SeenTime int64
+}
+
+type StreamPending struct {
+    Consumer      string
+    DeliveryTime  int64
+    DeliveryCount int
+}
+
+// XGROUP CREATE|SETID|DESTROY|CREATECONSUMER|DELCONSUMER key group ...
+func (rh *RocksDBHandler) RedisXgroup(subCommand, key, group []byte, args ...[]byte) (interface{}, error) {
+    if err := rh.checkRedisCall(subCommand, key, group); err != nil {
+        return nil, err
+    }
+
+    rh.streamLock.Lock()
+    defer rh.streamLock.Unlock()
+
+    meta, exists, err := rh._stream_getMeta(key)
+    if err != nil {
+        return nil, err
+    }
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+
+    switch strings.ToLower(string(subCommand)) {
+    case "create":
+        // XGROUP CREATE key group id|$ [MKSTREAM] [ENTRIESREAD entries-read]
+        if len(args) == 0 {
+            return nil, ErrWrongArgumentsCount
+        }
+        mkStream, entriesRead := false, int64(0)
+        for i := 1; i < len(args); i++ {
+            switch strings.ToLower(string(args[i])) {
+            case "mkstream":
+                mkStream = true
+            case "entriesread":
+                if i+1 >= len(args) {
+                    return nil, ErrSyntax
+                }
+                n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+                if err != nil {
+                    return nil, ErrNotNumber
+                }
+                entriesRead = n
+                i++
+            default:
+                return nil, ErrSyntax
+            }
+        }
+        if !exists {
+            if !mkStream {
+                return nil, ErrStreamNoKey
+            }
+            if err := rh._stream_putMeta(batch, key, meta); err != nil {
+                return nil, err
+            }
+        }
+        if _, found, err := rh._group_get(key, group); err != nil {
+            return nil, err
+        } else if found {
+            return nil, ErrStreamBusyGroup
+        }
+        lastID, err := __group_parseLastID(args[0], meta)
+        if err != nil {
+            return nil, err
+        }
+        g := StreamGroup{LastID: lastID, EntriesRead: entriesRead, Consumers: make(map[string]StreamConsumer)}
+        if err := rh._group_put(batch, key, group, g); err != nil {
+            return nil, err
+        }
+        if err := rh.db.Write(options, batch); err != nil {
+            return nil, err
+        }
+        rh.notifyKeyspaceEvent(kNotifyStream, "xgroup-create", key)
+        return &StatusReply{"OK"}, nil
+
+    case "setid":
+        // XGROUP SETID key group id|$ [ENTRIESREAD entries-read]
+        if len(args) != 1 && len(args) != 3 {
+            return nil, ErrWrongArgumentsCount
+        }
+        g, err := rh._group_mustGet(key, group, exists)
+        if err != nil {
+            return nil, err
+        }
+        if g.LastID, err = __group_parseLastID(args[0], meta); err != nil {
+            return nil, err
+        }
+        if len(args) == 3 {
+            if strings.ToLower(string(args[1])) != "entriesread" {
+                return nil, ErrSyntax
+            }
+            if g.EntriesRead, err = strconv.ParseInt(string(args[2]), 10, 64); err != nil {
+                return nil, ErrNotNumber
+            }
+        }
+        if err := rh._group_put(batch, key, group, g); err != nil {
+            return nil, err
+        }
+        if err := rh.db.Write(options, batch); err != nil {
+            return nil, err
+        }
+        rh.notifyKeyspaceEvent(kNotifyStream, "xgroup-setid", key)
+        return &StatusReply{"OK"}, nil
+
+    case "destroy":
+        if len(args) != 0 {
+            return nil, ErrWrongArgumentsCount
+        }
+        if _, found, err := rh._group_get(key, group); err != nil || !found {
+            return 0, err
+        }
+        batch.Delete(__group_key(key, group))
+        pelPrefix := __group_pelPrefix(key, group)
+        rh.deleteRange(batch, pelPrefix, __prefixSuccessor(pelPrefix))
+        if err := rh.db.Write(options, batch); err != nil {
+            return nil, err
+        }
+        rh.notifyKeyspaceEvent(kNotifyStream, "xgroup-destroy", key)
+        return 1, nil
+
+    case "createconsumer":
+        if len(args) != 1 {
+            return nil, ErrWrongArgumentsCount
+        }
+        g, err := rh._group_mustGet(key, group, exists)
+        if err != nil {
+            return nil, err
+        }
+        if _, ok := g.Consumers[string(args[0])]; ok {
+            return 0, nil
+        }
+        g.Consumers[string(args[0])] = StreamConsumer{__stream_nowMs()}
+        if err := rh._group_put(batch, key, group, g); err != nil {
+            return nil, err
+        }
+        if err := rh.db.Write(options, batch); err != nil {
+            return nil, err
+        }
+        rh.notifyKeyspaceEvent(kNotifyStream, "xgroup-createconsumer", key)
+        return 1, nil
+
+    case "delconsumer":
+        if len(args) != 1 {
+            return nil, ErrWrongArgumentsCount
+        }
+        g, err := rh._group_mustGet(key, group, exists)
+        if err != nil {
+            return nil, err
+        }
+        consumer := string(args[0])
+        if _, ok := g.Consumers[consumer]; !ok {
+            return 0, nil
+        }
+        deleted := 0
+        err = rh._group_scanPending(key, group, kStreamMinID, kStreamMaxID, func(id StreamID, pending StreamPending) bool {
+            if pending.Consumer == consumer {
+                batch.Delete(__group_pelKey(key, group, id))
+                deleted++
+            }
+            return true
+        })
+        if err != nil {
+            return nil, err
+        }
+        delete(g.Consumers, consumer)
+        if err := rh._group_put(batch, key, group, g); err != nil {
+            return nil, err
+        }
+        if err := rh.db.Write(options, batch); err != nil {
+            return nil, err
+        }
+        rh.notifyKeyspaceEvent(kNotifyStream, "xgroup-delconsumer", key)
+        return deleted, nil
+    }
+    return nil, ErrSyntax
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+func (rh *RocksDBHandler) RedisXreadgroup(request *Request, args [][]byte) ([]interface{}, error) {
+    if len(args) < 3 || strings.ToLower(string(args[0])) != "group" {
+        return nil, ErrSyntax
+    }
+    group, consumer := args[1], args[2]
+    count, block, timeout, noAck := 0, false, time.Duration(0), false
+    i := 3
+    for ; i < len(args); i++ {
+        option := strings.ToLower(string(args[i]))
+        if option == "streams" {
+            break
+        }
+        if option == "noack" {
+            noAck = true
+            continue
+        }
+        if i+1 >= len(args) {
+            return nil, ErrSyntax
+        }
+        switch option {
+        case "count":
+            n, err := strconv.Atoi(string(args[i+1]))
+            if err != nil {
+                return nil, ErrNotNumber
+            }
+            count = n
+        case "block":
+            ms, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+            if err != nil {
+                return nil, ErrNotTimeout
+            }
+            if ms < 0 {
+                return nil, ErrNegativeTimeout
+            }
+            block, timeout = true, time.Duration(ms)*time.Millisecond
+        default:
+            return nil, ErrSyntax
+        }
+        i++
+    }
+    if i >= len(args) || i+1 == len(args) {
+        return nil, ErrSyntax
+    }
+    streams := args[i+1:]
+    if len(streams)%2 != 0 {
+        return nil, ErrStreamUnbalanced
+    }
+    keys, ids := streams[:len(streams)/2], streams[len(streams)/2:]
+    if err := rh.checkRedisCall(append([][]byte{group, consumer}, keys...)...); err != nil {
+        return nil, err
+    }
+
+    // only the new entries (>) will block, the history is served at once
+    onlyNew := true
+    history := make([]StreamID, len(keys))
+    for j := range keys {
+        if _, _, err := rh._stream_getMeta(keys[j]); err != nil {
+            return nil, err
+        }
+        if _, found, err := rh._group_get(keys[j], group); err != nil {
+            return nil, err
+        } else if !found {
+            return nil, __group_noGroupError(keys[j], group)
+        }
+        if string(ids[j]) != ">" {
+            onlyNew = false
+            id, err := __stream_parseID(ids[j], 0)
+            if err != nil {
+                return nil, err
+            }
+            history[j] = id
+        }
+    }
+
+    var result []interface{}
+    serve := func() (bool, error) {
+        rh.streamLock.Lock()
+        defer rh.streamLock.Unlock()
+        for j := range keys {
+            var entries []interface{}
+            var err error
+            if string(ids[j]) == ">" {
+                entries, err = rh._group_deliverNew(keys[j], group, consumer, count, noAck)
+            } else {
+                entries, err = rh._group_deliverHistory(keys[j], group, consumer, history[j], count)
+            }
+            if err != nil {
+                return false, err
+            }
+            if len(entries) > 0 || !onlyNew {
+                result = append(result, &ArrayReply{[]interface{}{keys[j], entries}})
+            }
+        }
+        return len(result) > 0, nil
+    }
+    if !block || !onlyNew {
+        _, err := serve()
+        return result, err
+    }
+    if err := rh.blockForKeys(request, keys, timeout, serve); err != nil {
+        return nil, err
+    }
+    return result, nil
+}
+
+// XACK key group id [id ...]
+func (rh *RocksDBHandler) RedisXack(key, group, id []byte, ids ...[]byte) (int, error) {
+    if err := rh.checkRedisCall(key, group, id); err != nil {
+        return 0, err
+    }
+    ids = append([][]byte{id}, ids...)
+    streamIDs := make([]StreamID, len(ids))
+    for i := range ids {
+        var err error
+        if streamIDs[i], err = __stream_parseID(ids[i], 0); err != nil {
+            return 0, err
+        }
+    }
+
+    rh.streamLock.Lock()
+    defer rh.streamLock.Unlock()
+
+    if _, _, err := rh._stream_getMeta(key); err != nil {
+        return 0, err
+    }
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+
+    count := 0
+    acked := make(map[StreamID]bool)
+    for _, streamID := range streamIDs {
+        if acked[streamID] {
+            continue
+        }
+        if _, found, err := rh._group_getPending(key, group, streamID); err != nil {
+            return 0, err
+        } else if found {
+            batch.Delete(__group_pelKey(key, group, streamID))
+            acked[streamID] = true
+            count++
+        }
+    }
+    if count > 0 {
+        if err := rh.db.Write(options, batch); err != nil {
+            return 0, err
+        }
+    }
+    return count, nil
+}
+
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func (rh *RocksDBHandler) RedisXpending(key, group []byte, args ...[]byte) ([]interface{}, error) {
+    if err := rh.checkRedisCall(key, group); err != nil {
+        return nil, err
+    }
+    if _, _, err := rh._stream_getMeta(key); err != nil {
+        return nil, err
+    }
+    if _, found, err := rh._group_get(key, group); err != nil {
+        return nil, err
+    } else if !found {
+        return nil, __group_noGroupError(key, group)
+    }
+
+    if len(args) == 0 {
+        // summary form
+        total := 0
+        var minID, maxID StreamID
+        consumers := make(map[string]int)
+        err := rh._group_scanPending(key, group, kStreamMinID, kStreamMaxID, func(id StreamID, pending StreamPending) bool {
+            if total == 0 {
+                minID = id
+            }
+            maxID = id
+            total++
+            consumers[pending.Consumer]++
+            return true
+        })
+        if err != nil {
+            return nil, err
+        }
+        if total == 0 {
+            return []interface{}{0, nil, nil, &ArrayReply{nil}}, nil
+        }
+        names := make([]string, 0, len(consumers))
+        for name := range consumers {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        consumerData := make([]interface{}, len(names))
+        for i, name := range names {
+            consumerData[i] = &MultiBulkReply{[][]byte{[]byte(name), []byte(strconv.Itoa(consumers[name]))}}
+        }
+        return []interface{}{total, []byte(minID.String()), []byte(maxID.String()), &ArrayReply{consumerData}}, nil
+    }
+
+    // extended form
+    minIdle := int64(0)
+    if strings.ToLower(string(args[0])) == "idle" {
+        if len(args) < 2 {
+            return nil, ErrSyntax
+        }
+        n, err := strconv.ParseInt(string(args[1]), 10, 64)
+        if err != nil {
+            return nil, ErrNotNumber
+        }
+        minIdle = n
+        args = args[2:]
+    }
+    if len(args) != 3 && len(args) != 4 {
+        return nil, ErrSyntax
+    }
+    start, ok, err := __stream_parseRangeID(args[0], false)
+    if err != nil {
+        return nil, err
+    }
+    end, endOk, err := __stream_parseRangeID(args[1], true)
+    if err != nil {
+        return nil, err
+    }
+    count, err := strconv.Atoi(string(args[2]))
+    if err != nil {
+        return nil, ErrNotNumber
+    }
+    if !ok || !endOk || count <= 0 || end.Less(start) {
+        return []interface{}{}, nil
+    }
+    var consumer []byte
+    if len(args) == 4 {
+        consumer = args[3]
+    }
+
+    now := __stream_nowMs()
+    data := make([]interface{}, 0)
+    err = rh._group_scanPending(key, group, start, end, func(id StreamID, pending StreamPending) bool {
+        idle := now - pending.DeliveryTime
+        if (consumer == nil || pending.Consumer == string(consumer)) && idle >= minIdle {
+            data = append(data, &ArrayReply{[]interface{}{
+                []byte(id.String()), []byte(pending.Consumer), int(idle), pending.DeliveryCount,
+            }})
+        }
+        return len(data) < count
+    })
+    if err != nil {
+        return nil, err
+    }
+    return data, nil
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds]
+//        [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]
+func (rh *RocksDBHandler) RedisXclaim(key, group, consumer, minIdleTime []byte, args ...[]byte) ([]interface{}, error) {
+    if err := rh.checkRedisCall(key, group, consumer, minIdleTime); err != nil {
+        return nil, err
+    }
+    minIdle, err := strconv.ParseInt(string(minIdleTime), 10, 64)
+    if err != nil {
+        return nil, ErrNotNumber
+    }
+
+    now := __stream_nowMs()
+    ids := make([]StreamID, 0)
+    deliveryTime, retryCount := now, -1
+    force, justID := false, false
+    var lastID *StreamID
+    i := 0
+    for ; i < len(args); i++ {
+        id, err := __stream_parseID(args[i], 0)
+        if err != nil {
+            break
+        }
+        ids = append(ids, id)
+    }
+    if len(ids) == 0 {
+        return nil, ErrWrongArgumentsCount
+    }
+    for ; i < len(args); i++ {
+        option := strings.ToLower(string(args[i]))
+        switch option {
+        case "force":
+            force = true
+            continue
+        case "justid":
+            justID = true
+            continue
+        }
+        if i+1 >= len(args) {
+            return nil, ErrSyntax
+        }
+        switch option {
+        case "idle", "time", "retrycount":
+            n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+            if err != nil {
+                return nil, ErrNotNumber
+            }
+            switch option {
+            case "idle":
+                deliveryTime = now - n
+            case "time":
+                deliveryTime = n
+            case "retrycount":
+                retryCount = int(n)
+            }
+        case "lastid":
+            id, err := __stream_parseID(args[i+1], 0)
+            if err != nil {
+                return nil, err
+            }
+            lastID = &id
+        default:
+            return nil, ErrSyntax
+        }
+        i++
+    }
+
+    rh.streamLock.Lock()
+    defer rh.streamLock.Unlock()
+
+    if _, _, err := rh._stream_getMeta(key); err != nil {
+        return nil, err
+    }
+    g, found, err := rh._group_get(key, group)
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        return nil, __group_noGroupError(key, group)
+    }
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+
+    if lastID != nil && g.LastID.Less(*lastID) {
+        g.LastID = *lastID
+    }
+    claimed := make([]interface{}, 0, len(ids))
+    for _, id := range ids {
+        pending, found, err := rh._group_getPending(key, group, id)
+        if err != nil {
+            return nil, err
+        }
+        fields, exists, err := rh._stream_getEntry(key, id)
+        if err != nil {
+            return nil, err
+        }
+        if !exists {
+            // the entry was deleted from the stream, so it is no longer pending
+            if found {
+                batch.Delete(__group_pelKey(key, group, id))
+            }
+            continue
+        }
+        if !found {
+            if !force {
+                continue
+            }
+            pending = StreamPending{DeliveryCount: 0}
+        } else if minIdle > 0 && now-pending.DeliveryTime < minIdle {
+            continue
+        }
+        pending.Consumer = string(consumer)
+        pending.DeliveryTime = deliveryTime
+        if retryCount >= 0 {
+            pending.DeliveryCount = retryCount
+        } else if !justID {
+            pending.DeliveryCount++
+        }
+        if err := rh._group_putPending(batch, key, group, id, pending); err != nil {
+            return nil, err
+        }
+        if justID {
+            claimed = append(claimed, []byte(id.String()))
+        } else {
+            claimed = append(claimed, __stream_entriesReply([]StreamEntry{{id, fields}})[0])
+        }
+    }
+    g.Consumers[string(consumer)] = StreamConsumer{now}
+    if err := rh._group_put(batch, key, group, g); err != nil {
+        return nil, err
+    }
+    if err := rh.db.Write(options, batch); err != nil {
+        return nil, err
+    }
+    return claimed, nil
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func (rh *RocksDBHandler) RedisXautoclaim(key, group, consumer, minIdleTime, start []byte, args ...[]byte) ([]interface{}, error) {
+    if err := rh.checkRedisCall(key, group, consumer, minIdleTime, start); err != nil {
+        return nil, err
+    }
+    minIdle, err := strconv.ParseInt(string(minIdleTime), 10, 64)
+    if err != nil {
+        return nil, ErrNotNumber
+    }
+    startID, ok, err := __stream_parseRangeID(start, false)
+    if err != nil {
+        return nil, err
+    }
+    count, justID := kStreamAutoClaimCount, false
+    for i := 0; i < len(args); i++ {
+        switch strings.ToLower(string(args[i])) {
+        case "justid":
+            justID = true
+        case "count":
+            if i+1 >= len(args) {
+                return nil, ErrSyntax
+            }
+            n, err := strconv.Atoi(string(args[i+1]))
+            if err != nil || n <= 0 {
+                return nil, ErrOutOfRange
+            }
+            count = n
+            i++
+        default:
+            return nil, ErrSyntax
+        }
+    }
+
+    rh.streamLock.Lock()
+    defer rh.streamLock.Unlock()
+
+    if _, _, err := rh._stream_getMeta(key); err != nil {
+        return nil, err
+    }
+    g, found, err := rh._group_get(key, group)
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        return nil, __group_noGroupError(key, group)
+    }
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+
+    now := __stream_nowMs()
+    claimed, deleted := make([]interface{}, 0), make([][]byte, 0)
+    next := kStreamMinID
+    attempts := count * 10
+    if ok {
+        var claimErr error
+        err = rh._group_scanPending(key, group, startID, kStreamMaxID, func(id StreamID, pending StreamPending) bool {
+            if len(claimed) >= count || attempts == 0 {
+                next = id
+                return false
+            }
+            attempts--
+            if now-pending.DeliveryTime < minIdle {
+                return true
+            }
+            fields, exists, getErr := rh._stream_getEntry(key, id)
+            if getErr != nil {
+                claimErr = getErr
+                return false
+            }
+            if !exists {
+                batch.Delete(__group_pelKey(key, group, id))
+                deleted = append(deleted, []byte(id.String()))
+                return true
+            }
+            pending.Consumer = string(consumer)
+            pending.DeliveryTime = now
+            if !justID {
+                pending.DeliveryCount++
+            }
+            if putErr := rh._group_putPending(batch, key, group, id, pending); putErr != nil {
+                claimErr = putErr
+                return false
+            }
+            if justID {
+                claimed = append(claimed, []byte(id.String()))
+            } else {
+                claimed = append(claimed, __stream_entriesReply([]StreamEntry{{id, fields}})[0])
+            }
+            return true
+        })
+        if err == nil {
+            err = claimErr
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    g.Consumers[string(consumer)] = StreamConsumer{now}
+    if err := rh._group_put(batch, key, group, g); err != nil {
+        return nil, err
+    }
+    if err := rh.db.Write(options, batch); err != nil {
+        return nil, err
+    }
+    return []interface{}{[]byte(next.String()), &ArrayReply{claimed}, &MultiBulkReply{deleted}}, nil
+}
+
+// _group_deliverNew delivers the entries after the last delivered ID and adds them to the PEL
+func (rh *RocksDBHandler) _group_deliverNew(key, group, consumer []byte, count int, noAck bool) ([]interface{}, error) {
+    g, found, err := rh._group_get(key, group)
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        return nil, __group_noGroupError(key, group)
+    }
+    start, ok := g.LastID.Incr()
+    if !ok {
+        return []interface{}{}, nil
+    }
+    entries, err := rh._stream_getEntries(key, start, kStreamMaxID, count, false)
+    if err != nil {
+        return nil, err
+    }
+
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+
+    now := __stream_nowMs()
+    for _, entry := range entries {
+        if !noAck {
+            if err := rh._group_putPending(batch, key, group, entry.ID, StreamPending{string(consumer), now, 1}); err != nil {
+                return nil, err
+            }
+        }
+        g.LastID = entry.ID
+        g.EntriesRead++
+    }
+    g.Consumers[string(consumer)] = StreamConsumer{now}
+    if err := rh._group_put(batch, key, group, g); err != nil {
+        return nil, err
+    }
+    if err := rh.db.Write(options, batch); err != nil {
+        return nil, err
+    }
+    return __stream_entriesReply(entries), nil
+}
+
+// _group_deliverHistory serves the pending entries of the consumer after the ID,
+// the entries deleted from the stream are replied with a nil body.
+func (rh *RocksDBHandler) _group_deliverHistory(key, group, consumer []byte, after StreamID, count int) ([]interface{}, error) {
+    data := make([]interface{}, 0)
+    start, ok := after.Incr()
+    if !ok {
+        return data, nil
+    }
+    var err error
+    scanErr := rh._group_scanPending(key, group, start, kStreamMaxID, func(id StreamID, pending StreamPending) bool {
+        if pending.Consumer != string(consumer) {
+            return true
+        }
+        fields, exists, getErr := rh._stream_getEntry(key, id)
+        if getErr != nil {
+            err = getErr
+            return false
+        }
+        if exists {
+            data = append(data, __stream_entriesReply([]StreamEntry{{id, fields}})[0])
+        } else {
+            data = append(data, &ArrayReply{[]interface{}{[]byte(id.String()), &MultiBulkReply{nil}}})
+        }
+        return count <= 0 || len(data) < count
+    })
+    if scanErr != nil {
+        return nil, scanErr
+    }
+    return data, err
+}
+
+func (rh *RocksDBHandler) _group_mustGet(key, group []byte, streamExists bool) (StreamGroup, error) {
+    if !streamExists {
+        return StreamGroup{}, ErrStreamNoKey
+    }
+    g, found, err := rh._group_get(key, group)
+    if err != nil {
+        return g, err
+    }
+    if !found {
+        return g, __group_noGroupError(key, group)
+    }
+    return g, nil
+}
+
+func (rh *RocksDBHandler) _group_get(key, group []byte) (StreamGroup, bool, error) {
+    data, err := rh._stream_getRaw(__group_key(key, group))
+    if err != nil || data == nil {
+        return StreamGroup{}, false, err
+    }
+    obj, err := decode(data, reflect.TypeOf(StreamGroup{}))
+    if err != nil {
+        return StreamGroup{}, false, err
+    }
+    g := obj.(StreamGroup)
+    if g.Consumers == nil {
+        g.Consumers = make(map[string]StreamConsumer)
+    }
+    return g, true, nil
+}
+
+func (rh *RocksDBHandler) _group_put(batch *rocks.WriteBatch, key, group []byte, g StreamGroup) error {
+    data, err := encode(g)
+    if err != nil {
+        return err
+    }
+    batch.Put(__group_key(key, group), data)
+    return nil
+}
+
+func (rh *RocksDBHandler) _group_getPending(key, group []byte, id StreamID) (StreamPending, bool, error) {
+    data, err := rh._stream_getRaw(__group_pelKey(key, group, id))
+    if err != nil || data == nil {
+        return StreamPending{}, false, err
+    }
+    obj, err := decode(data, reflect.TypeOf(StreamPending{}))
+    if err != nil {
+        return StreamPending{}, false, err
+    }
+    return obj.(StreamPending), true, nil
+}
+
+func (rh *RocksDBHandler) _group_putPending(batch *rocks.WriteBatch, key, group []byte, id StreamID, pending StreamPending) error {
+    data, err := encode(pending)
+    if err != nil {
+        return err
+    }
+    batch.Put(__group_pelKey(key, group, id), data)
+    return nil
+}
+
+// _group_scanPending iterates the PEL of the group in [start, end] until fn returns false
+func (rh *RocksDBHandler) _group_scanPending(key, group []byte, start, end StreamID, fn func(StreamID, StreamPending) bool) error {
+    options := rocks.NewDefaultReadOptions()
+    defer options.Destroy()
+    it := rh.db.NewIterator(options)
+    defer it.Close()
+
+    prefix := __group_pelPrefix(key, group)
+    endKey := __group_pelKey(key, group, end)
+    for it.Seek(__group_pelKey(key, group, start)); it.Valid(); it.Next() {
+        pelKey := rh.copySlice(it.Key(), false)
+        if !bytes.HasPrefix(pelKey, prefix) || bytes.Compare(pelKey, endKey) > 0 {
+            break
+        }
+        obj, err := decode(rh.copySlice(it.Value(), false), reflect.TypeOf(StreamPending{}))
+        if err != nil {
+            return err
+        }
+        if !fn(__stream_keyID(pelKey), obj.(StreamPending)) {
+            break
+        }
+    }
+    return it.Err()
+}
+
+func __group_parseLastID(data []byte, meta StreamMeta) (StreamID, error) {
+    if string(data) == "$" {
+        return meta.LastID, nil
+    }
+    return __stream_parseID(data, 0)
+}
+
+func __group_noGroupError(key, group []byte) error {
+    return fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", key, group)
+}
+
+func __group_appendName(data, name []byte) []byte {
+    size := make([]byte, 4)
+    binary.BigEndian.PutUint32(size, uint32(len(name)))
+    return append(append(data, size...), name...)
+}
+
+func __group_key(key, group []byte) []byte {
+    data := __group_appendName(append([]byte{}, kStreamGroupPrefix...), key)
+    return __group_appendName(data, group)
+}
+
+func __group_pelPrefix(key, group []byte) []byte {
+    data := __group_appendName(append([]byte{}, kStreamPelPrefix...), key)
+    return __group_appendName(data, group)
+}
+
+func __group_pelKey(key, group []byte, id StreamID) []byte {
+    return append(__group_pelPrefix(key, group), id.Bytes()...)
+}
+
+// __group_streamPrefixes are the prefixes of all the groups and pending entries of the stream
+func __group_streamPrefixes(key []byte) [][]byte {
+    return [][]byte{
+        __group_appendName(append([]byte{}, kStreamGroupPrefix...), key),
+        __group_appendName(append([]byte{}, kStreamPelPrefix...), key),
+    }
+}
+
+func __stream_nowMs() int64 {
+    return time.Now().UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/gob"
+    "fmt"
+    rocks "github.com/tecbot/gorocksdb"
+    "math"
+    "reflect"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Each entry of the stream is stored in its own key, __*stream*__<len(key)><key><ms><seq>,
+// so the entries are ordered by the ID in RocksDB. The object of the key keeps the StreamMeta.
+
+const (
+    kStreamTrimChunk    = 100 // the approximate trimming only deletes in chunks
+    kStreamDefaultLimit = 100 * kStreamTrimChunk
+)
+
+var (
+    ErrStreamIDInvalid  = fmt.Errorf("Invalid stream ID specified as stream command argument")
+    ErrStreamIDTooSmall = fmt.Errorf("The ID specified in XADD is equal or smaller than the target stream top item")
+    ErrStreamIDZero     = fmt.Errorf("The ID specified in XADD must be greater than 0-0")
+    ErrStreamLimit      = fmt.Errorf("syntax error, LIMIT cannot be used without the special ~ option")
+    ErrStreamUnbalanced = fmt.Errorf("Unbalanced XREAD list of streams: for each stream key an ID or '$' must be specified.")
+)
+
+type StreamID struct {
+    Ms  uint64
+    Seq uint64
+}
+
+var (
+    kStreamMinID = StreamID{0, 0}
+    kStreamMaxID = StreamID{math.MaxUint64, math.MaxUint64}
+)
+
+func (id StreamID) String() string {
+    return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+func (id StreamID) Bytes() []byte {
+    data := make([]byte, 16)
+    binary.BigEndian.PutUint64(data[:8], id.Ms)
+    binary.BigEndian.PutUint64(data[8:], id.Seq)
+    return data
+}
+
+func (id StreamID) Less(other StreamID) bool {
+    return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+func (id StreamID) Incr() (StreamID, bool) {
+    if id.Seq < math.MaxUint64 {
+        return StreamID{id.Ms, id.Seq + 1}, true
+    }
+    if id.Ms < math.MaxUint64 {
+        return StreamID{id.Ms + 1, 0}, true
+    }
+    return id, false
+}
+
+func (id StreamID) Decr() (StreamID, bool) {
+    if id.Seq > 0 {
+        return StreamID{id.Ms, id.Seq - 1}, true
+    }
+    if id.Ms > 0 {
+        return StreamID{id.Ms - 1, math.MaxUint64}, true
+    }
+    return id, false
+}
+
+type StreamMeta struct {
+    Length       int
+    LastID       StreamID
+    EntriesAdded uint64
+}
+
+type StreamEntry struct {
+    ID     StreamID
+    Fields [][]byte
+}
+
+func init() {
+    gob.Register(StreamMeta{})
+}
+
+type streamTrim struct {
+    strategy string // maxlen or minid, empty to not trim
+    approx   bool
+    maxLen   int
+    minID    StreamID
+    limit    int
+}
+
+func (rh *RocksDBHandler) RedisXlen(key []byte) (int, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return 0, err
+    }
+    meta, _, err := rh._stream_getMeta(key)
+    if err != nil {
+        return 0, err
+    }
+    return meta.Length, nil
+}
+
+// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] *|id field value [field value ...]
+func (rh *RocksDBHandler) RedisXadd(key []byte, args ...[]byte) ([]byte, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return nil, err
+    }
+    noMkStream := false
+    i := 0
+    if i < len(args) && strings.ToLower(string(args[i])) == "nomkstream" {
+        noMkStream = true
+        i++
+    }
+    trim, i, err := __stream_parseTrim(args, i)
+    if err != nil {
+        return nil, err
+    }
+    if i >= len(args) {
+        return nil, ErrWrongArgumentsCount
+    }
+    idArg := args[i]
+    fields := args[i+1:]
+    if len(fields) == 0 || len(fields)%2 != 0 {
+        return nil, ErrWrongArgumentsCount
+    }
+
+    rh.streamLock.Lock()
+    defer rh.streamLock.Unlock()
+
+    meta, exists, err := rh._stream_getMeta(key)
+    if err != nil {
+        return nil, err
+    }
+    if !exists && noMkStream {
+        return nil, nil
+    }
+    id, err := __stream_nextID(idArg, meta.LastID)
+    if err != nil {
+        return nil, err
+    }
+
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+
+    value, err := encode(fields)
+    if err != nil {
+        return nil, err
+    }
+    batch.Put(__stream_entryKey(key, id), value)
+    meta.Length++
+    meta.LastID = id
+    meta.EntriesAdded++
+    trimmed := rh._stream_trim(batch, key, &meta, trim, __stream_entryKey(key, id))
+    if err := rh._stream_putMeta(batch, key, meta); err != nil {
+        return nil, err
+    }
+    if err := rh.db.Write(options, batch); err != nil {
+        return nil, err
+    }
+
+    rh.notifyKeyspaceEvent(kNotifyStream, "xadd", key)
+    if trimmed > 0 {
+        rh.notifyKeyspaceEvent(kNotifyStream, "xtrim", key)
+    }
+    rh.signalKeyAsReady(key, kWakeAllWaiters)
+    return []byte(id.String()), nil
+}
+
+// XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+func (rh *RocksDBHandler) RedisXtrim(key []byte, args ...[]byte) (int, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return 0, err
+    }
+    trim, i, err := __stream_parseTrim(args, 0)
+    if err != nil {
+        return 0, err
+    }
+    if trim.strategy == "" || i != len(args) {
+        return 0, ErrSyntax
+    }
+
+    rh.streamLock.Lock()
+    defer rh.streamLock.Unlock()
+
+    meta, exists, err := rh._stream_getMeta(key)
+    if err != nil || !exists {
+        return 0, err
+    }
+
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+    trimmed := rh._stream_trim(batch, key, &meta, trim, nil)
+    if trimmed == 0 {
+        return 0, nil
+    }
+    if err := rh._stream_putMeta(batch, key, meta); err != nil {
+        return 0, err
+    }
+    if err := rh.db.Write(options, batch); err != nil {
+        return 0, err
+    }
+    rh.notifyKeyspaceEvent(kNotifyStream, "xtrim", key)
+    return trimmed, nil
+}
+
+// XRANGE key start end [COUNT count]
+func (rh *RocksDBHandler) RedisXrange(key, start, end []byte, args ...[]byte) ([]interface{}, error) {
+    return rh._stream_range(key, start, end, args, false)
+}
+
+// XREVRANGE key end start [COUNT count]
+func (rh *RocksDBHandler) RedisXrevrange(key, end, start []byte, args ...[]byte) ([]interface{}, error) {
+    return rh._stream_range(key, start, end, args, true)
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func (rh *RocksDBHandler) RedisXread(request *Request, args [][]byte) ([]interface{}, error) {
+    count, block, timeout := 0, false, time.Duration(0)
+    i := 0
+    for ; i < len(args); i++ {
+        option := strings.ToLower(string(args[i]))
+        if option == "streams" {
+            break
+        }
+        if i+1 >= len(args) {
+            return nil, ErrSyntax
+        }
+        switch option {
+        case "count":
+            n, err := strconv.Atoi(string(args[i+1]))
+            if err != nil {
+                return nil, ErrNotNumber
+            }
+            count = n
+        case "block":
+            ms, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+            if err != nil {
+                return nil, ErrNotTimeout
+            }
+            if ms < 0 {
+                return nil, ErrNegativeTimeout
+            }
+            block, timeout = true, time.Duration(ms)*time.Millisecond
+        default:
+            return nil, ErrSyntax
+        }
+        i++
+    }
+    if i >= len(args) || i+1 == len(args) {
+        return nil, ErrSyntax
+    }
+    streams := args[i+1:]
+    if len(streams)%2 != 0 {
+        return nil, ErrStreamUnbalanced
+    }
+    keys, ids := streams[:len(streams)/2], streams[len(streams)/2:]
+    if err := rh.checkRedisCall(keys...); err != nil {
+        return nil, err
+    }
+
+    // the entries after the IDs will be read, $ is resolved before blocking
+    after := make([]StreamID, len(keys))
+    for j := range keys {
+        meta, _, err := rh._stream_getMeta(keys[j])
+        if err != nil {
+            return nil, err
+        }
+        if string(ids[j]) == "$" {
+            after[j] = meta.LastID
+        } else if after[j], err = __stream_parseID(ids[j], 0); err != nil {
+            return nil, err
+        }
+    }
+
+    var result []interface{}
+    serve := func() (bool, error) {
+        for j := range keys {
+            start, ok := after[j].Incr()
+            if !ok {
+                continue
+            }
+            entries, err := rh._stream_getEntries(keys[j], start, kStreamMaxID, count, false)
+            if err != nil {
+                return false, err
+            }
+            if len(entries) > 0 {
+                result = append(result, &ArrayReply{[]interface{}{keys[j], __stream_entriesReply(entries)}})
+            }
+        }
+        return len(result) > 0, nil
+    }
+    if !block {
+        _, err := serve()
+        return result, err
+    }
+    if err := rh.blockForKeys(request, keys, timeout, serve); err != nil {
+        return nil, err
+    }
+    return result, nil
+}
+
+func (rh *RocksDBHandler) _stream_range(key, start, end []byte, args [][]byte, reverse bool) ([]interface{}, error) {
+    if err := rh.checkRedisCall(key, start, end); err != nil {
+        return nil, err
+    }
+    count := 0
+    if len(args) > 0 {
+        if len(args) != 2 || strings.ToLower(string(args[0])) != "count" {
+            return nil, ErrSyntax
+        }
+        n, err := strconv.Atoi(string(args[1]))
+        if err != nil {
+            return nil, ErrNotNumber
+        }
+        if n <= 0 {
+            return []interface{}{}, nil
+        }
+        count = n
+    }
+    startID, ok, err := __stream_parseRangeID(start, false)
+    if err != nil {
+        return nil, err
+    }
+    if !ok {
+        return []interface{}{}, nil
+    }
+    endID, ok, err := __stream_parseRangeID(end, true)
+    if err != nil {
+        return nil, err
+    }
+    if !ok || endID.Less(startID) {
+        return []interface{}{}, nil
+    }
+    if _, _, err := rh._stream_getMeta(key); err != nil {
+        return nil, err
+    }
+
+    entries, err := rh._stream_getEntries(key, startID, endID, count, reverse)
+    if err != nil {
+        return nil, err
+    }
+    return __stream_entriesReply(entries), nil
+}
+
+// _stream_getEntries scans the entries in [start, end] in the order of the IDs, count 0 for all
+func (rh *RocksDBHandler) _stream_getEntries(key []byte, start, end StreamID, count int, reverse bool) ([]StreamEntry, error) {
+    options := rocks.NewDefaultReadOptions()
+    defer options.Destroy()
+    it := rh.db.NewIterator(options)
+    defer it.Close()
+
+    prefix := __stream_entryPrefix(key)
+    startKey, endKey := __stream_entryKey(key, start), __stream_entryKey(key, end)
+    if reverse {
+        it.Seek(endKey)
+        if !it.Valid() {
+            it.SeekToLast()
+        } else if bytes.Compare(rh.copySlice(it.Key(), false), endKey) > 0 {
+            it.Prev()
+        }
+    } else {
+        it.Seek(startKey)
+    }
+
+    entries := make([]StreamEntry, 0)
+    for it.Valid() {
+        entryKey := rh.copySlice(it.Key(), false)
+        if !bytes.HasPrefix(entryKey, prefix) {
+            break
+        }
+        if reverse && bytes.Compare(entryKey, startKey) < 0 {
+            break
+        }
+        if !reverse && bytes.Compare(entryKey, endKey) > 0 {
+            break
+        }
+        fields, err := decode(rh.copySlice(it.Value(), false), reflect.TypeOf([][]byte{}))
+        if err != nil {
+            return nil, err
+        }
+        entries = append(entries, StreamEntry{__stream_keyID(entryKey), __emptyBytes(fields.([][]byte))})
+        if count > 0 && len(entries) >= count {
+            break
+        }
+        if reverse {
+            it.Prev()
+        } else {
+            it.Next()
+        }
+    }
+    if err := it.Err(); err != nil {
+        return nil, err
+    }
+    return entries, nil
+}
+
+// _stream_trim deletes the oldest entries within the batch and updates the meta,
+// the approximate trimming only deletes whole chunks and may keep a few more entries.
+// The added entry is put in the batch but not written yet, it is the newest one and
+// is trimmed like the others.
+func (rh *RocksDBHandler) _stream_trim(batch *rocks.WriteBatch, key []byte, meta *StreamMeta, trim streamTrim, added []byte) int {
+    if trim.strategy == "" || meta.Length == 0 {
+        return 0
+    }
+    limit := trim.limit
+    if limit <= 0 || limit > meta.Length {
+        limit = meta.Length
+    }
+
+    // find the first entry to keep, the entries before it will be deleted
+    options := rocks.NewDefaultReadOptions()
+    defer options.Destroy()
+    options.SetFillCache(false)
+    it := rh.db.NewIterator(options)
+    defer it.Close()
+
+    prefix := __stream_entryPrefix(key)
+    maxDeletes := limit
+    if trim.strategy == "maxlen" && meta.Length-trim.maxLen < maxDeletes {
+        maxDeletes = meta.Length - trim.maxLen
+    }
+    deletes := 0
+    var cut []byte
+    var boundaries [][]byte // the first key of every chunk for the approximate trimming
+    keep := func(entryKey []byte) bool {
+        if deletes >= maxDeletes || (trim.strategy == "minid" && !__stream_keyID(entryKey).Less(trim.minID)) {
+            cut = entryKey
+            return true
+        }
+        if deletes%kStreamTrimChunk == 0 {
+            boundaries = append(boundaries, entryKey)
+        }
+        deletes++
+        return false
+    }
+    for it.Seek(prefix); it.Valid(); it.Next() {
+        entryKey := rh.copySlice(it.Key(), false)
+        if !bytes.HasPrefix(entryKey, prefix) || (added != nil && bytes.Compare(entryKey, added) >= 0) {
+            break
+        }
+        if keep(entryKey) {
+            break
+        }
+    }
+    if cut == nil && added != nil {
+        keep(added)
+    }
+    if trim.approx {
+        // the cut is moved back to the chunk boundary
+        chunks := deletes / kStreamTrimChunk
+        if chunks < len(boundaries) {
+            cut = boundaries[chunks]
+        }
+        deletes = chunks * kStreamTrimChunk
+    }
+    if deletes <= 0 {
+        return 0
+    }
+    if cut == nil {
+        cut = __prefixSuccessor(prefix)
+    }
+    rh.deleteRange(batch, prefix, cut)
+    meta.Length -= deletes
+    return deletes
+}
+
+func (rh *RocksDBHandler) _stream_getMeta(key []byte) (StreamMeta, bool, error) {
+    options := rocks.NewDefaultReadOptions()
+    defer options.Destroy()
+    obj, err := rh.loadRedisObject(options, key)
+    if err != nil {
+        if err == ErrDoesNotExist {
+            return StreamMeta{}, false, nil
+        }
+        return StreamMeta{}, false, err
+    }
+    if obj.Type != kRedisStream {
+        return StreamMeta{}, false, ErrWrongTypeRedisObject
+    }
+    return obj.Data.(StreamMeta), true, nil
+}
+
+func (rh *RocksDBHandler) _stream_putMeta(batch *rocks.WriteBatch, key []byte, meta StreamMeta) error {
+    data, err := encode(RedisObject{Type: kRedisStream, Data: meta})
+    if err != nil {
+        return err
+    }
+    batch.Put(rh.getTypeKey(key), []byte(kRedisStream))
+    batch.Put(key, data)
+    return nil
+}
+
+func (rh *RocksDBHandler) _stream_getRaw(key []byte) ([]byte, error) {
+    options := rocks.NewDefaultReadOptions()
+    defer options.Destroy()
+    slice, err := rh.db.Get(options, key)
+    if err != nil {
+        return nil, err
+    }
+    data := rh.copySlice(slice, true)
+    if len(data) == 0 {
+        return nil, nil
+    }
+    return data, nil
+}
+
+func (rh *RocksDBHandler) _stream_getEntry(key []byte, id StreamID) ([][]byte, bool, error) {
+    data, err := rh._stream_getRaw(__stream_entryKey(key, id))
+    if err != nil || data == nil {
+        return nil, false, err
+    }
+    fields, err := decode(data, reflect.TypeOf([][]byte{}))
+    if err != nil {
+        return nil, false, err
+    }
+    return __emptyBytes(fields.([][]byte)), true, nil
+}
+
+func __stream_entriesReply(entries []StreamEntry) []interface{} {
+    data := make([]interface{}, len(entries))
+    for i, entry := range entries {
+        data[i] = &ArrayReply{[]interface{}{[]byte(entry.ID.String()), &MultiBulkReply{entry.Fields}}}
+    }
+    return data
+}
+
+func __stream_entryPrefix(key []byte) []byte {
+    prefix := make([]byte, 0, len(kStreamKeyPrefix)+4+len(key))
+    prefix = append(prefix, kStreamKeyPrefix...)
+    size := make([]byte, 4)
+    binary.BigEndian.PutUint32(size, uint32(len(key)))
+    prefix = append(prefix, size...)
+    return append(prefix, key...)
+}
+
+func __stream_entryKey(key []byte, id StreamID) []byte {
+    return append(__stream_entryPrefix(key), id.Bytes()...)
+}
+
+func __stream_keyID(entryKey []byte) StreamID {
+    idData := entryKey[len(entryKey)-16:]
+    return StreamID{binary.BigEndian.Uint64(idData[:8]), binary.BigEndian.Uint64(idData[8:])}
+}
+
+// __stream_parseID parses <ms>-<seq> or <ms> with the missing seq
+func __stream_parseID(data []byte, missingSeq uint64) (StreamID, error) {
+    parts := strings.SplitN(string(data), "-", 2)
+    ms, err := strconv.ParseUint(parts[0], 10, 64)
+    if err != nil {
+        return StreamID{}, ErrStreamIDInvalid
+    }
+    if len(parts) == 1 {
+        return StreamID{ms, missingSeq}, nil
+    }
+    seq, err := strconv.ParseUint(parts[1], 10, 64)
+    if err != nil {
+        return StreamID{}, ErrStreamIDInvalid
+    }
+    return StreamID{ms, seq}, nil
+}
+
+// __stream_parseRangeID parses -, + and the exclusive (id, returns false if the range is empty
+func __stream_parseRangeID(data []byte, isEnd bool) (StreamID, bool, error) {
+    switch string(data) {
+    case "-":
+        return kStreamMinID, true, nil
+    case "+":
+        return kStreamMaxID, true, nil
+    }
+    exclusive := data[0] == '('
+    if exclusive {
+        data = data[1:]
+    }
+    missingSeq := uint64(0)
+    if isEnd {
+        missingSeq = math.MaxUint64
+    }
+    id, err := __stream_parseID(data, missingSeq)
+    if err != nil {
+        return id, false, err
+    }
+    if !exclusive {
+        return id, true, nil
+    }
+    if isEnd {
+        id, ok := id.Decr()
+        return id, ok, nil
+    }
+    id, ok := id.Incr()
+    return id, ok, nil
+}
+
+// __stream_nextID generates the ID for *, <ms>-* or validates the explicit ID
+func __stream_nextID(data []byte, lastID StreamID) (StreamID, error) {
+    sData := string(data)
+    if sData == "*" {
+        ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+        if ms > lastID.Ms {
+            return StreamID{ms, 0}, nil
+        }
+        if id, ok := lastID.Incr(); ok {
+            return id, nil
+        }
+        return StreamID{}, ErrStreamIDTooSmall
+    }
+    if strings.HasSuffix(sData, "-*") {
+        ms, err := strconv.ParseUint(strings.TrimSuffix(sData, "-*"), 10, 64)
+        if err != nil {
+            return StreamID{}, ErrStreamIDInvalid
+        }
+        switch {
+        case ms > lastID.Ms:
+            return StreamID{ms, 0}, nil
+        case ms == lastID.Ms && lastID.Seq < math.MaxUint64:
+            return StreamID{ms, lastID.Seq + 1}, nil
+        }
+        return StreamID{}, ErrStreamIDTooSmall
+    }
+    id, err := __stream_parseID(data, 0)
+    if err != nil {
+        return id, err
+    }
+    if id == kStreamMinID {
+        return id, ErrStreamIDZero
+    }
+    if !lastID.Less(id) {
+        return id, ErrStreamIDTooSmall
+    }
+    return id, nil
+}
+
+// __stream_parseTrim parses [MAXLEN|MINID [=|~] threshold [LIMIT count]] from the index
+func __stream_parseTrim(args [][]byte, i int) (streamTrim, int, error) {
+    trim := streamTrim{}
+    if i >= len(args) {
+        return trim, i, nil
+    }
+    strategy := strings.ToLower(string(args[i]))
+    if strategy != "maxlen" && strategy != "minid" {
+        return trim, i, nil
+    }
+    trim.strategy = strategy
+    i++
+    if i < len(args) && (string(args[i]) == "~" || string(args[i]) == "=") {
+        trim.approx = string(args[i]) == "~"
+        i++
+    }
+    if i >= len(args) {
+        return trim, i, ErrSyntax
+    }
+    if strategy == "maxlen" {
+        n, err := strconv.Atoi(string(args[i]))
+        if err != nil || n < 0 {
+            return trim, i, ErrNotNumber
+        }
+        trim.maxLen = n
+    } else {
+        id, err := __stream_parseID(args[i], 0)
+        if err != nil {
+            return trim, i, err
+        }
+        trim.minID = id
+    }
+    i++
+    if trim.approx {
+        trim.limit = kStreamDefaultLimit
+    }
+    if i+1 < len(args) && strings.ToLower(string(args[i])) == "limit" {
+        if !trim.approx {
+            return trim, i, ErrStreamLimit
+        }
+        n, err := strconv.Atoi(string(args[i+1]))
+        if err != nil || n < 0 {
+            return trim, i, ErrNotNumber
+        }
+        trim.limit = n
+        i += 2
+    }
+    return trim, i, nil
+}
@@ -76,7 +76,7 @@ func (rh *RocksDBHandler) RedisGet(key []byte) ([]byte, error) {
     defer options.Destroy()
     if obj, err := rh.loadRedisObject(options, key); err != nil {
         if err == ErrDoesNotExist {
-            return []byte{}, nil
+            return nil, nil
         }
         return nil, err
     } else {
@@ -95,9 +95,6 @@ func (rh *RocksDBHandler) RedisMget(keys [][]byte) ([][]byte, error) {
     options := rocks.NewDefaultReadOptions()
     defer options.Destroy()
     results := make([][]byte, len(keys))
-    for i := range results {
-        results[i] = []byte{}
-    }
     for i := range results {
         if obj, err := rh.loadRedisObject(options, keys[i]); err == nil {
             if obj.Type == kRedisString {
@@ -148,7 +145,15 @@ func (rh *RocksDBHandler) _string_doMerge(key, value []byte, opCode string) erro
     } else {
         batch.Merge(key, data)
     }
-    return rh.db.Write(options, batch)
+    if err := rh.db.Write(options, batch); err != nil {
+        return err
+    }
+    event := "incrby"
+    if opCode == kStringOpAppend {
+        event = "append"
+    }
+    rh.notifyKeyspaceEvent(kNotifyString, event, key)
+    return nil
 }
 
 const (
@@ -0,0 +1,1096 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/gob"
+    "fmt"
+    rocks "github.com/tecbot/gorocksdb"
+    "math"
+    "strconv"
+    "strings"
+)
+
+// The sorted set keeps ZSetMeta with the cardinality in the object of the key, and two sub keys per member:
+//   __*zmember*__<len(key)><key><member> keeps the score of the member
+//   __*zscore*__<len(key)><key><score><member> is the index ordered by the score then the member,
+//   the score is encoded so its bytes sort in the same order as the float64.
+
+var (
+    kZSetMemberPrefix = []byte("__*zmember*__")
+    kZSetScorePrefix  = []byte("__*zscore*__")
+)
+
+var (
+    ErrZSetNotFloat    = fmt.Errorf("min or max is not a float")
+    ErrZSetNaN         = fmt.Errorf("resulting score is not a number (NaN)")
+    ErrZSetNxXx        = fmt.Errorf("XX and NX options at the same time are not compatible")
+    ErrZSetIncrOnePair = fmt.Errorf("INCR option supports a single increment-element pair")
+    ErrZSetNotLex      = fmt.Errorf("min or max not valid string range item")
+    ErrZSetNumKeys     = fmt.Errorf("at least 1 input key is needed for ZUNIONSTORE/ZINTERSTORE")
+    ErrZSetWeight      = fmt.Errorf("weight value is not a float")
+)
+
+type ZSetMeta struct {
+    Card int
+}
+
+func init() {
+    gob.Register(ZSetMeta{})
+}
+
+// zsetRange is a score range, the bounds may be exclusive
+type zsetRange struct {
+    min, max     float64
+    minEx, maxEx bool
+}
+
+func (r zsetRange) contains(score float64) bool {
+    return !r.belowMin(score) && !r.aboveMax(score)
+}
+
+func (r zsetRange) belowMin(score float64) bool {
+    return score < r.min || (r.minEx && score == r.min)
+}
+
+func (r zsetRange) aboveMax(score float64) bool {
+    return score > r.max || (r.maxEx && score == r.max)
+}
+
+// zsetLexBound is a bound of a lex range, inf is -1 for - and 1 for +
+type zsetLexBound struct {
+    value     []byte
+    exclusive bool
+    inf       int
+}
+
+type zsetLexRange struct {
+    min, max zsetLexBound
+}
+
+func (r zsetLexRange) belowMin(member []byte) bool {
+    if r.min.inf != 0 {
+        return r.min.inf > 0
+    }
+    c := bytes.Compare(member, r.min.value)
+    return c < 0 || (c == 0 && r.min.exclusive)
+}
+
+func (r zsetLexRange) aboveMax(member []byte) bool {
+    if r.max.inf != 0 {
+        return r.max.inf < 0
+    }
+    c := bytes.Compare(member, r.max.value)
+    return c > 0 || (c == 0 && r.max.exclusive)
+}
+
+func (rh *RocksDBHandler) RedisZcard(key []byte) (int, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return 0, err
+    }
+    meta, _, err := rh._zset_getMeta(key)
+    if err != nil {
+        return 0, err
+    }
+    return meta.Card, nil
+}
+
+func (rh *RocksDBHandler) RedisZscore(key, member []byte) (Reply, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return nil, err
+    }
+    if _, _, err := rh._zset_getMeta(key); err != nil {
+        return nil, err
+    }
+    score, exists, err := rh._zset_getScore(key, member)
+    if err != nil {
+        return nil, err
+    }
+    if !exists {
+        return &NullReply{}, nil
+    }
+    return &DoubleReply{score}, nil
+}
+
+// ZADD key [NX|XX] [CH] [INCR] score member [score member ...]
+func (rh *RocksDBHandler) RedisZadd(key []byte, args ...[]byte) (interface{}, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return nil, err
+    }
+    nx, xx, ch, incr := false, false, false, false
+    i := 0
+    for ; i < len(args); i++ {
+        switch strings.ToLower(string(args[i])) {
+        case "nx":
+            nx = true
+            continue
+        case "xx":
+            xx = true
+            continue
+        case "ch":
+            ch = true
+            continue
+        case "incr":
+            incr = true
+            continue
+        }
+        break
+    }
+    pairs := args[i:]
+    if len(pairs) == 0 || len(pairs)%2 != 0 {
+        return nil, ErrSyntax
+    }
+    if nx && xx {
+        return nil, ErrZSetNxXx
+    }
+    if incr && len(pairs) != 2 {
+        return nil, ErrZSetIncrOnePair
+    }
+    scores := make([]float64, len(pairs)/2)
+    for j := range scores {
+        score, err := __zset_parseScore(pairs[j*2])
+        if err != nil {
+            return nil, err
+        }
+        scores[j] = score
+    }
+
+    rh.zsetLock.Lock()
+    defer rh.zsetLock.Unlock()
+
+    meta, _, err := rh._zset_getMeta(key)
+    if err != nil {
+        return nil, err
+    }
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+
+    added, changed := 0, 0
+    var incrScore Reply = &NullReply{}
+    // the scores written in this batch, a member may be repeated
+    pending := make(map[string]float64)
+    for j, score := range scores {
+        member := pairs[j*2+1]
+        oldScore, exists := pending[string(member)]
+        if !exists {
+            if oldScore, exists, err = rh._zset_getScore(key, member); err != nil {
+                return nil, err
+            }
+        }
+        if (nx && exists) || (xx && !exists) {
+            continue
+        }
+        if incr {
+            if exists {
+                score += oldScore
+            }
+            if math.IsNaN(score) {
+                return nil, ErrZSetNaN
+            }
+            incrScore = &DoubleReply{score}
+        }
+        if exists && oldScore == score {
+            continue
+        }
+        rh._zset_put(batch, key, member, score, oldScore, exists)
+        pending[string(member)] = score
+        if exists {
+            changed++
+        } else {
+            added++
+            meta.Card++
+        }
+    }
+    if added+changed > 0 {
+        if err := rh._zset_putMeta(batch, key, meta); err != nil {
+            return nil, err
+        }
+        if err := rh.db.Write(options, batch); err != nil {
+            return nil, err
+        }
+        event := "zadd"
+        if incr {
+            event = "zincr"
+        }
+        rh.notifyKeyspaceEvent(kNotifyZSet, event, key)
+        rh.signalKeyAsReady(key, added)
+    }
+    if incr {
+        return incrScore, nil
+    }
+    if ch {
+        return added + changed, nil
+    }
+    return added, nil
+}
+
+func (rh *RocksDBHandler) RedisZrem(key, member []byte, members ...[]byte) (int, error) {
+    if err := rh.checkRedisCall(key, member); err != nil {
+        return 0, err
+    }
+
+    rh.zsetLock.Lock()
+    defer rh.zsetLock.Unlock()
+
+    meta, exists, err := rh._zset_getMeta(key)
+    if err != nil || !exists {
+        return 0, err
+    }
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+
+    removed := make(map[string]bool)
+    for _, m := range append([][]byte{member}, members...) {
+        if removed[string(m)] {
+            continue
+        }
+        score, exists, err := rh._zset_getScore(key, m)
+        if err != nil {
+            return 0, err
+        }
+        if exists {
+            rh._zset_delete(batch, key, m, score)
+            removed[string(m)] = true
+            meta.Card--
+        }
+    }
+    if len(removed) == 0 {
+        return 0, nil
+    }
+    if err := rh._zset_putMeta(batch, key, meta); err != nil {
+        return 0, err
+    }
+    if err := rh.db.Write(options, batch); err != nil {
+        return 0, err
+    }
+    rh.notifyKeyspaceEvent(kNotifyZSet, "zrem", key)
+    if meta.Card == 0 {
+        rh.notifyKeyspaceEvent(kNotifyGeneric, "del", key)
+    }
+    return len(removed), nil
+}
+
+// ZRANGE key start stop [WITHSCORES]
+func (rh *RocksDBHandler) RedisZrange(key []byte, start, stop int, args ...[]byte) ([]interface{}, error) {
+    return rh._zset_rangeByRank(key, start, stop, args, false)
+}
+
+// ZREVRANGE key start stop [WITHSCORES]
+func (rh *RocksDBHandler) RedisZrevrange(key []byte, start, stop int, args ...[]byte) ([]interface{}, error) {
+    return rh._zset_rangeByRank(key, start, stop, args, true)
+}
+
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func (rh *RocksDBHandler) RedisZrangebyscore(key, min, max []byte, args ...[]byte) ([]interface{}, error) {
+    if err := rh.checkRedisCall(key, min, max); err != nil {
+        return nil, err
+    }
+    scoreRange, err := __zset_parseRange(min, max)
+    if err != nil {
+        return nil, err
+    }
+    withScores, offset, count, err := __zset_parseRangeOptions(args)
+    if err != nil {
+        return nil, err
+    }
+    if _, _, err := rh._zset_getMeta(key); err != nil {
+        return nil, err
+    }
+
+    data := make([]interface{}, 0)
+    if count == 0 {
+        return data, nil
+    }
+    err = rh._zset_scanScore(key, scoreRange, false, func(member []byte, score float64) bool {
+        if offset > 0 {
+            offset--
+            return true
+        }
+        data = append(data, member)
+        if withScores {
+            data = append(data, &DoubleReply{score})
+        }
+        count--
+        return count != 0
+    })
+    if err != nil {
+        return nil, err
+    }
+    return data, nil
+}
+
+// ZRANGEBYLEX key min max [LIMIT offset count]
+func (rh *RocksDBHandler) RedisZrangebylex(key, min, max []byte, args ...[]byte) ([][]byte, error) {
+    return rh._zset_rangeByLex(key, min, max, args, false)
+}
+
+// ZREVRANGEBYLEX key max min [LIMIT offset count]
+func (rh *RocksDBHandler) RedisZrevrangebylex(key, max, min []byte, args ...[]byte) ([][]byte, error) {
+    return rh._zset_rangeByLex(key, min, max, args, true)
+}
+
+func (rh *RocksDBHandler) RedisZlexcount(key, min, max []byte) (int, error) {
+    if err := rh.checkRedisCall(key, min, max); err != nil {
+        return 0, err
+    }
+    lexRange, err := __zset_parseLexRange(min, max)
+    if err != nil {
+        return 0, err
+    }
+    if _, _, err := rh._zset_getMeta(key); err != nil {
+        return 0, err
+    }
+    count := 0
+    err = rh._zset_scanLex(key, lexRange, false, func(member []byte, score float64) bool {
+        count++
+        return true
+    })
+    return count, err
+}
+
+func (rh *RocksDBHandler) RedisZremrangebylex(key, min, max []byte) (int, error) {
+    if err := rh.checkRedisCall(key, min, max); err != nil {
+        return 0, err
+    }
+    lexRange, err := __zset_parseLexRange(min, max)
+    if err != nil {
+        return 0, err
+    }
+
+    rh.zsetLock.Lock()
+    defer rh.zsetLock.Unlock()
+
+    meta, exists, err := rh._zset_getMeta(key)
+    if err != nil || !exists {
+        return 0, err
+    }
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+
+    removed := 0
+    err = rh._zset_scanLex(key, lexRange, false, func(member []byte, score float64) bool {
+        rh._zset_delete(batch, key, member, score)
+        removed++
+        return true
+    })
+    if err != nil || removed == 0 {
+        return 0, err
+    }
+    meta.Card -= removed
+    if err := rh._zset_putMeta(batch, key, meta); err != nil {
+        return 0, err
+    }
+    if err := rh.db.Write(options, batch); err != nil {
+        return 0, err
+    }
+    rh.notifyKeyspaceEvent(kNotifyZSet, "zremrangebylex", key)
+    if meta.Card == 0 {
+        rh.notifyKeyspaceEvent(kNotifyGeneric, "del", key)
+    }
+    return removed, nil
+}
+
+// ZUNIONSTORE destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX]
+func (rh *RocksDBHandler) RedisZunionstore(destination []byte, numKeys int, args ...[]byte) (int, error) {
+    return rh._zset_store(destination, numKeys, args, false)
+}
+
+// ZINTERSTORE destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX]
+func (rh *RocksDBHandler) RedisZinterstore(destination []byte, numKeys int, args ...[]byte) (int, error) {
+    return rh._zset_store(destination, numKeys, args, true)
+}
+
+// ZPOPMIN key [count]
+func (rh *RocksDBHandler) RedisZpopmin(key []byte, args ...[]byte) ([]interface{}, error) {
+    return rh._zset_popCount(key, args, false)
+}
+
+// ZPOPMAX key [count]
+func (rh *RocksDBHandler) RedisZpopmax(key []byte, args ...[]byte) ([]interface{}, error) {
+    return rh._zset_popCount(key, args, true)
+}
+
+// BZPOPMIN key [key ...] timeout
+func (rh *RocksDBHandler) RedisBzpopmin(request *Request, keysTimeout [][]byte) ([]interface{}, error) {
+    return rh._zset_blockingPop(request, keysTimeout, false)
+}
+
+// BZPOPMAX key [key ...] timeout
+func (rh *RocksDBHandler) RedisBzpopmax(request *Request, keysTimeout [][]byte) ([]interface{}, error) {
+    return rh._zset_blockingPop(request, keysTimeout, true)
+}
+
+func (rh *RocksDBHandler) _zset_rangeByLex(key, min, max []byte, args [][]byte, reverse bool) ([][]byte, error) {
+    if err := rh.checkRedisCall(key, min, max); err != nil {
+        return nil, err
+    }
+    lexRange, err := __zset_parseLexRange(min, max)
+    if err != nil {
+        return nil, err
+    }
+    withScores, offset, count, err := __zset_parseRangeOptions(args)
+    if err != nil {
+        return nil, err
+    }
+    if withScores {
+        return nil, ErrSyntax
+    }
+    if _, _, err := rh._zset_getMeta(key); err != nil {
+        return nil, err
+    }
+
+    data := make([][]byte, 0)
+    if count == 0 {
+        return data, nil
+    }
+    err = rh._zset_scanLex(key, lexRange, reverse, func(member []byte, score float64) bool {
+        if offset > 0 {
+            offset--
+            return true
+        }
+        data = append(data, member)
+        count--
+        return count != 0
+    })
+    if err != nil {
+        return nil, err
+    }
+    return data, nil
+}
+
+// _zset_store computes the union or the intersection of the sources and replaces the destination
+func (rh *RocksDBHandler) _zset_store(destination []byte, numKeys int, args [][]byte, inter bool) (int, error) {
+    if err := rh.checkRedisCall(destination); err != nil {
+        return 0, err
+    }
+    if numKeys <= 0 {
+        return 0, ErrZSetNumKeys
+    }
+    if numKeys > len(args) {
+        return 0, ErrSyntax
+    }
+    keys := args[:numKeys]
+    weights := make([]float64, numKeys)
+    for i := range weights {
+        weights[i] = 1
+    }
+    aggregate := "sum"
+    for i := numKeys; i < len(args); i++ {
+        switch strings.ToLower(string(args[i])) {
+        case "weights":
+            if i+numKeys >= len(args) {
+                return 0, ErrSyntax
+            }
+            for j := range weights {
+                weight, err := strconv.ParseFloat(string(args[i+1+j]), 64)
+                if err != nil || math.IsNaN(weight) {
+                    return 0, ErrZSetWeight
+                }
+                weights[j] = weight
+            }
+            i += numKeys
+        case "aggregate":
+            if i+1 >= len(args) {
+                return 0, ErrSyntax
+            }
+            aggregate = strings.ToLower(string(args[i+1]))
+            if aggregate != "sum" && aggregate != "min" && aggregate != "max" {
+                return 0, ErrSyntax
+            }
+            i++
+        default:
+            return 0, ErrSyntax
+        }
+    }
+
+    rh.zsetLock.Lock()
+    defer rh.zsetLock.Unlock()
+
+    var result map[string]float64
+    for i, key := range keys {
+        members, err := rh._zset_getMembers(key)
+        if err != nil {
+            return 0, err
+        }
+        if i == 0 {
+            result = make(map[string]float64, len(members))
+            for member, score := range members {
+                result[member] = __zset_weighted(score, weights[i])
+            }
+            continue
+        }
+        if inter {
+            for member, score := range result {
+                if other, ok := members[member]; ok {
+                    result[member] = __zset_aggregate(aggregate, score, __zset_weighted(other, weights[i]))
+                } else {
+                    delete(result, member)
+                }
+            }
+        } else {
+            for member, other := range members {
+                other = __zset_weighted(other, weights[i])
+                if score, ok := result[member]; ok {
+                    result[member] = __zset_aggregate(aggregate, score, other)
+                } else {
+                    result[member] = other
+                }
+            }
+        }
+    }
+
+    oldType, err := rh.getKeyType(destination)
+    if err != nil {
+        return 0, err
+    }
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+    if oldType != "" && oldType != kRedisZSet {
+        // the zsetLock is held already
+        defer rh.lockSubKeys(oldType)()
+    }
+    if oldType != "" {
+        rh.deleteSubKeys(batch, destination, oldType)
+    }
+    for member, score := range result {
+        rh._zset_put(batch, destination, []byte(member), score, 0, false)
+    }
+    if err := rh._zset_putMeta(batch, destination, ZSetMeta{Card: len(result)}); err != nil {
+        return 0, err
+    }
+    if err := rh.db.Write(options, batch); err != nil {
+        return 0, err
+    }
+    if len(result) > 0 {
+        event := "zunionstore"
+        if inter {
+            event = "zinterstore"
+        }
+        rh.notifyKeyspaceEvent(kNotifyZSet, event, destination)
+        rh.signalKeyAsReady(destination, len(result))
+    } else if oldType != "" {
+        rh.notifyKeyspaceEvent(kNotifyGeneric, "del", destination)
+    }
+    return len(result), nil
+}
+
+// _zset_getMembers reads the members with the scores, a plain set counts as scores of 1
+func (rh *RocksDBHandler) _zset_getMembers(key []byte) (map[string]float64, error) {
+    keyType, err := rh.getKeyType(key)
+    if err != nil {
+        return nil, err
+    }
+    members := make(map[string]float64)
+    switch keyType {
+    case "":
+    case kRedisSet:
+        setData, err := rh._set_getData(key)
+        if err != nil {
+            return nil, err
+        }
+        for member := range setData {
+            members[member] = 1
+        }
+    case kRedisZSet:
+        err = rh._zset_scanScore(key, zsetRange{math.Inf(-1), math.Inf(1), false, false}, false, func(member []byte, score float64) bool {
+            members[string(member)] = score
+            return true
+        })
+        if err != nil {
+            return nil, err
+        }
+    default:
+        return nil, ErrWrongTypeRedisObject
+    }
+    return members, nil
+}
+
+func (rh *RocksDBHandler) _zset_popCount(key []byte, args [][]byte, max bool) ([]interface{}, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return nil, err
+    }
+    count := 1
+    if len(args) > 1 {
+        return nil, ErrSyntax
+    } else if len(args) == 1 {
+        var err error
+        if count, err = strconv.Atoi(string(args[0])); err != nil {
+            return nil, ErrNotNumber
+        }
+        if count < 0 {
+            return nil, ErrOutOfRange
+        }
+    }
+    return rh._zset_pop(key, count, max)
+}
+
+func (rh *RocksDBHandler) _zset_blockingPop(request *Request, keysTimeout [][]byte, max bool) ([]interface{}, error) {
+    if len(keysTimeout) < 2 {
+        return nil, ErrWrongArgumentsCount
+    }
+    keys := keysTimeout[:len(keysTimeout)-1]
+    timeout, err := parseTimeout(keysTimeout[len(keysTimeout)-1])
+    if err != nil {
+        return nil, err
+    }
+    if err := rh.checkRedisCall(keys...); err != nil {
+        return nil, err
+    }
+    for _, key := range keys {
+        if err := rh.checkKeyType(key, kRedisZSet); err != nil {
+            return nil, err
+        }
+    }
+
+    var result []interface{}
+    err = rh.blockForKeys(request, keys, timeout, func() (bool, error) {
+        for _, key := range keys {
+            data, err := rh._zset_pop(key, 1, max)
+            if err != nil {
+                return false, err
+            }
+            if len(data) > 0 {
+                result = append([]interface{}{key}, data...)
+                return true, nil
+            }
+        }
+        return false, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    // nil if timed out
+    return result, nil
+}
+
+// _zset_pop removes up to count members with the lowest or the highest scores
+func (rh *RocksDBHandler) _zset_pop(key []byte, count int, max bool) ([]interface{}, error) {
+    rh.zsetLock.Lock()
+    defer rh.zsetLock.Unlock()
+
+    data := make([]interface{}, 0)
+    meta, exists, err := rh._zset_getMeta(key)
+    if err != nil || !exists || count == 0 {
+        return data, err
+    }
+    options := rocks.NewDefaultWriteOptions()
+    defer options.Destroy()
+    batch := rocks.NewWriteBatch()
+    defer batch.Destroy()
+
+    popped := 0
+    err = rh._zset_scanScore(key, zsetRange{math.Inf(-1), math.Inf(1), false, false}, max, func(member []byte, score float64) bool {
+        rh._zset_delete(batch, key, member, score)
+        data = append(data, member, &DoubleReply{score})
+        popped++
+        return popped < count
+    })
+    if err != nil || popped == 0 {
+        return data, err
+    }
+    meta.Card -= popped
+    if err := rh._zset_putMeta(batch, key, meta); err != nil {
+        return nil, err
+    }
+    if err := rh.db.Write(options, batch); err != nil {
+        return nil, err
+    }
+    event := "zpopmin"
+    if max {
+        event = "zpopmax"
+    }
+    rh.notifyKeyspaceEvent(kNotifyZSet, event, key)
+    if meta.Card == 0 {
+        rh.notifyKeyspaceEvent(kNotifyGeneric, "del", key)
+    }
+    return data, nil
+}
+
+func (rh *RocksDBHandler) _zset_rangeByRank(key []byte, start, stop int, args [][]byte, reverse bool) ([]interface{}, error) {
+    if err := rh.checkRedisCall(key); err != nil {
+        return nil, err
+    }
+    withScores := false
+    if len(args) > 0 {
+        if len(args) != 1 || strings.ToLower(string(args[0])) != "withscores" {
+            return nil, ErrSyntax
+        }
+        withScores = true
+    }
+    meta, _, err := rh._zset_getMeta(key)
+    if err != nil {
+        return nil, err
+    }
+    data := make([]interface{}, 0)
+    if meta.Card == 0 {
+        return data, nil
+    }
+    start = __list_getIndex(start, meta.Card, false)
+    end := __list_getIndex(stop, meta.Card, true)
+    if start >= end {
+        return data, nil
+    }
+
+    rank := 0
+    err = rh._zset_scanScore(key, zsetRange{math.Inf(-1), math.Inf(1), false, false}, reverse, func(member []byte, score float64) bool {
+        if rank >= start {
+            data = append(data, member)
+            if withScores {
+                data = append(data, &DoubleReply{score})
+            }
+        }
+        rank++
+        return rank < end
+    })
+    if err != nil {
+        return nil, err
+    }
+    return data, nil
+}
+
+// _zset_scanScore iterates the members in the score range by the index until fn returns false
+func (rh *RocksDBHandler) _zset_scanScore(key []byte, scoreRange zsetRange, reverse bool, fn func([]byte, float64) bool) error {
+    options := rocks.NewDefaultReadOptions()
+    defer options.Destroy()
+    it := rh.db.NewIterator(options)
+    defer it.Close()
+
+    prefix := __zset_scorePrefix(key)
+    if reverse {
+        // seek to the first key after the max score, then step back
+        seekKey := __prefixSuccessor(append(append([]byte{}, prefix...), __zset_encodeScore(scoreRange.max)...))
+        it.Seek(seekKey)
+        if it.Valid() {
+            it.Prev()
+        } else {
+            it.SeekToLast()
+        }
+    } else {
+        it.Seek(append(append([]byte{}, prefix...), __zset_encodeScore(scoreRange.min)...))
+    }
+
+    for it.Valid() {
+        indexKey := rh.copySlice(it.Key(), false)
+        if !bytes.HasPrefix(indexKey, prefix) {
+            break
+        }
+        score := __zset_decodeScore(indexKey[len(prefix) : len(prefix)+8])
+        member := indexKey[len(prefix)+8:]
+        if reverse && scoreRange.belowMin(score) {
+            break
+        }
+        if !reverse && scoreRange.aboveMax(score) {
+            break
+        }
+        if scoreRange.contains(score) && !fn(member, score) {
+            break
+        }
+        if reverse {
+            it.Prev()
+        } else {
+            it.Next()
+        }
+    }
+    return it.Err()
+}
+
+// _zset_scanLex iterates the members in the lex range, the members are expected to have the same score
+// so the index keys are sorted by the member after the score of the first one.
+func (rh *RocksDBHandler) _zset_scanLex(key []byte, lexRange zsetLexRange, reverse bool, fn func([]byte, float64) bool) error {
+    options := rocks.NewDefaultReadOptions()
+    defer options.Destroy()
+    it := rh.db.NewIterator(options)
+    defer it.Close()
+
+    prefix := __zset_scorePrefix(key)
+    seekLast := func(seekKey []byte) {
+        it.Seek(seekKey)
+        if it.Valid() {
+            it.Prev()
+        } else {
+            it.SeekToLast()
+        }
+    }
+    if reverse {
+        seekLast(__prefixSuccessor(prefix))
+    } else {
+        it.Seek(prefix)
+    }
+    if !it.Valid() {
+        return it.Err()
+    }
+    scoreKey := rh.copySlice(it.Key(), false)
+    if !bytes.HasPrefix(scoreKey, prefix) {
+        return nil
+    }
+    scoreKey = scoreKey[:len(prefix)+8]
+    if reverse && lexRange.max.inf == 0 {
+        // seek to the first key after the max member, then step back
+        seekLast(append(append(scoreKey, lexRange.max.value...), 0))
+    } else if !reverse && lexRange.min.inf == 0 {
+        it.Seek(append(scoreKey, lexRange.min.value...))
+    }
+
+    for it.Valid() {
+        indexKey := rh.copySlice(it.Key(), false)
+        if !bytes.HasPrefix(indexKey, prefix) {
+            break
+        }
+        score := __zset_decodeScore(indexKey[len(prefix) : len(prefix)+8])
+        member := indexKey[len(prefix)+8:]
+        if reverse && lexRange.belowMin(member) {
+            break
+        }
+        if !reverse && lexRange.aboveMax(member) {
+            break
+        }
+        if !lexRange.belowMin(member) && !lexRange.aboveMax(member) && !fn(member, score) {
+            break
+        }
+        if reverse {
+            it.Prev()
+        } else {
+            it.Next()
+        }
+    }
+    return it.Err()
+}
+
+func __zset_weighted(score, weight float64) float64 {
+    score *= weight
+    if math.IsNaN(score) {
+        // zero times infinity
+        return 0
+    }
+    return score
+}
+
+func __zset_aggregate(aggregate string, a, b float64) float64 {
+    switch aggregate {
+    case "min":
+        return math.Min(a, b)
+    case "max":
+        return math.Max(a, b)
+    }
+    sum := a + b
+    if math.IsNaN(sum) {
+        // inf plus -inf
+        return 0
+    }
+    return sum
+}
+
+// __zset_parseLexRange parses the min and max like [a, (a, - and +
+func __zset_parseLexRange(min, max []byte) (zsetLexRange, error) {
+    r := zsetLexRange{}
+    var err error
+    if r.min, err = __zset_parseLexBound(min); err != nil {
+        return r, err
+    }
+    if r.max, err = __zset_parseLexBound(max); err != nil {
+        return r, err
+    }
+    return r, nil
+}
+
+func __zset_parseLexBound(data []byte) (zsetLexBound, error) {
+    switch {
+    case len(data) == 1 && data[0] == '-':
+        return zsetLexBound{inf: -1}, nil
+    case len(data) == 1 && data[0] == '+':
+        return zsetLexBound{inf: 1}, nil
+    case len(data) > 0 && data[0] == '[':
+        return zsetLexBound{value: data[1:]}, nil
+    case len(data) > 0 && data[0] == '(':
+        return zsetLexBound{value: data[1:], exclusive: true}, nil
+    }
+    return zsetLexBound{}, ErrZSetNotLex
+}
+
+func (rh *RocksDBHandler) _zset_getMeta(key []byte) (ZSetMeta, bool, error) {
+    options := rocks.NewDefaultReadOptions()
+    defer options.Destroy()
+    obj, err := rh.loadRedisObject(options, key)
+    if err != nil {
+        if err == ErrDoesNotExist {
+            return ZSetMeta{}, false, nil
+        }
+        return ZSetMeta{}, false, err
+    }
+    if obj.Type != kRedisZSet {
+        return ZSetMeta{}, false, ErrWrongTypeRedisObject
+    }
+    return obj.Data.(ZSetMeta), true, nil
+}
+
+// _zset_putMeta writes the cardinality, the key is deleted when the sorted set is empty
+func (rh *RocksDBHandler) _zset_putMeta(batch *rocks.WriteBatch, key []byte, meta ZSetMeta) error {
+    if meta.Card <= 0 {
+        batch.Delete(rh.getTypeKey(key))
+        batch.Delete(key)
+        return nil
+    }
+    data, err := encode(RedisObject{Type: kRedisZSet, Data: meta})
+    if err != nil {
+        return err
+    }
+    batch.Put(rh.getTypeKey(key), []byte(kRedisZSet))
+    batch.Put(key, data)
+    return nil
+}
+
+func (rh *RocksDBHandler) _zset_getScore(key, member []byte) (float64, bool, error) {
+    options := rocks.NewDefaultReadOptions()
+    defer options.Destroy()
+    slice, err := rh.db.Get(options, __zset_memberKey(key, member))
+    if err != nil {
+        return 0, false, err
+    }
+    data := rh.copySlice(slice, true)
+    if len(data) != 8 {
+        return 0, false, nil
+    }
+    return __zset_decodeScore(data), true, nil
+}
+
+// _zset_put sets the score of the member in the batch, the old index key is replaced
+func (rh *RocksDBHandler) _zset_put(batch *rocks.WriteBatch, key, member []byte, score, oldScore float64, exists bool) {
+    if exists {
+        batch.Delete(__zset_scoreKey(key, member, oldScore))
+    }
+    batch.Put(__zset_memberKey(key, member), __zset_encodeScore(score))
+    batch.Put(__zset_scoreKey(key, member, score), []byte{})
+}
+
+func (rh *RocksDBHandler) _zset_delete(batch *rocks.WriteBatch, key, member []byte, score float64) {
+    batch.Delete(__zset_memberKey(key, member))
+    batch.Delete(__zset_scoreKey(key, member, score))
+}
+
+func __zset_prefix(prefix, key []byte) []byte {
+    data := make([]byte, 0, len(prefix)+4+len(key))
+    data = append(data, prefix...)
+    size := make([]byte, 4)
+    binary.BigEndian.PutUint32(size, uint32(len(key)))
+    data = append(data, size...)
+    return append(data, key...)
+}
+
+func __zset_memberPrefix(key []byte) []byte {
+    return __zset_prefix(kZSetMemberPrefix, key)
+}
+
+func __zset_scorePrefix(key []byte) []byte {
+    return __zset_prefix(kZSetScorePrefix, key)
+}
+
+func __zset_memberKey(key, member []byte) []byte {
+    return append(__zset_memberPrefix(key), member...)
+}
+
+func __zset_scoreKey(key, member []byte, score float64) []byte {
+    return append(append(__zset_scorePrefix(key), __zset_encodeScore(score)...), member...)
+}
+
+// __zset_encodeScore flips the bits so the big endian bytes sort like the float64
+func __zset_encodeScore(score float64) []byte {
+    bits := math.Float64bits(score)
+    if bits&(1<<63) == 0 {
+        bits |= 1 << 63
+    } else {
+        bits = ^bits
+    }
+    data := make([]byte, 8)
+    binary.BigEndian.PutUint64(data, bits)
+    return data
+}
+
+func __zset_decodeScore(data []byte) float64 {
+    bits := binary.BigEndian.Uint64(data)
+    if bits&(1<<63) != 0 {
+        bits &^= 1 << 63
+    } else {
+        bits = ^bits
+    }
+    return math.Float64frombits(bits)
+}
+
+func __zset_parseScore(data []byte) (float64, error) {
+    score, err := strconv.ParseFloat(string(data), 64)
+    if err != nil || math.IsNaN(score) {
+        return 0, ErrNotFloat
+    }
+    return score, nil
+}
+
+func __zset_formatScore(score float64) []byte {
+    switch {
+    case math.IsInf(score, 1):
+        return []byte("inf")
+    case math.IsInf(score, -1):
+        return []byte("-inf")
+    }
+    return []byte(strconv.FormatFloat(score, 'g', -1, 64))
+}
+
+// __zset_parseRange parses the min and max like (1.5, -inf and +inf
+func __zset_parseRange(min, max []byte) (zsetRange, error) {
+    r := zsetRange{}
+    var err error
+    if r.min, r.minEx, err = __zset_parseBound(min); err != nil {
+        return r, err
+    }
+    if r.max, r.maxEx, err = __zset_parseBound(max); err != nil {
+        return r, err
+    }
+    return r, nil
+}
+
+func __zset_parseBound(data []byte) (float64, bool, error) {
+    exclusive := len(data) > 0 && data[0] == '('
+    if exclusive {
+        data = data[1:]
+    }
+    score, err := strconv.ParseFloat(string(data), 64)
+    if err != nil || math.IsNaN(score) {
+        return 0, false, ErrZSetNotFloat
+    }
+    return score, exclusive, nil
+}
+
+// __zset_parseRangeOptions parses [WITHSCORES] [LIMIT offset count], a negative count for all
+func __zset_parseRangeOptions(args [][]byte) (bool, int, int, error) {
+    withScores, offset, count := false, 0, -1
+    for i := 0; i < len(args); i++ {
+        switch strings.ToLower(string(args[i])) {
+        case "withscores":
+            withScores = true
+        case "limit":
+            if i+2 >= len(args) {
+                return false, 0, 0, ErrSyntax
+            }
+            var err error
+            if offset, err = strconv.Atoi(string(args[i+1])); err != nil {
+                return false, 0, 0, ErrNotNumber
+            }
+            if count, err = strconv.Atoi(string(args[i+2])); err != nil {
+                return false, 0, 0, ErrNotNumber
+            }
+            i += 2
+        default:
+            return false, 0, 0, ErrSyntax
+        }
+    }
+    if offset < 0 {
+        count = 0
+    }
+    return withScores, offset, count, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+    "bytes"
+    "math"
+    "testing"
+)
+
+func TestZSetEncodeScore(t *testing.T) {
+    // in ascending order
+    scores := []float64{
+        math.Inf(-1),
+        -math.MaxFloat64,
+        -1.5,
+        -1,
+        -math.SmallestNonzeroFloat64,
+        0,
+        math.SmallestNonzeroFloat64,
+        1,
+        1.5,
+        math.MaxFloat64,
+        math.Inf(1),
+    }
+    for i, score := range scores {
+        data := __zset_encodeScore(score)
+        if decoded := __zset_decodeScore(data); decoded != score {
+            t.Errorf("__zset_decodeScore(__zset_encodeScore(%g)) = %g", score, decoded)
+        }
+        if i > 0 && bytes.Compare(__zset_encodeScore(scores[i-1]), data) >= 0 {
+            t.Errorf("__zset_encodeScore(%g) doesn't sort before __zset_encodeScore(%g)", scores[i-1], score)
+        }
+    }
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/sha1"
+    "encoding/hex"
+    "fmt"
+    lua "github.com/yuin/gopher-lua"
+    "github.com/yuin/gopher-lua/parse"
+    "io"
+    "log"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// The scripts run in a fresh Lua state each, holding the execution lock of the server alone,
+// so no other command is served in the middle of a script. redis.call dispatches through
+// Server.Methods, the replies are converted to the Lua values by parsing their RESP encoding.
+// A script running over the time limit makes the server reply BUSY, and may be killed by
+// SCRIPT KILL unless it has called a write command.
+
+const kDefaultLuaTimeLimit = 5 * time.Second
+
+var (
+    ErrNoScript        = &CodeErrorReply{"NOSCRIPT", "No matching script. Please use EVAL."}
+    ErrBusyScript      = &CodeErrorReply{"BUSY", "Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."}
+    ErrNotBusy         = &CodeErrorReply{"NOTBUSY", "No scripts in execution right now."}
+    ErrUnkillable      = &CodeErrorReply{"UNKILLABLE", "Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command."}
+    ErrScriptNumKeys   = fmt.Errorf("Number of keys can't be greater than number of args")
+    ErrScriptNegKeys   = fmt.Errorf("Number of keys can't be negative")
+    ErrScriptKilled    = fmt.Errorf("Script killed by user with SCRIPT KILL...")
+    ErrScriptArguments = fmt.Errorf("Lua redis() command arguments must be strings or integers")
+    ErrScriptNoCommand = fmt.Errorf("Please specify at least one argument for redis.call()")
+    ErrScriptUnknown   = fmt.Errorf("Unknown Redis command called from Lua script")
+    ErrScriptNotAllow  = fmt.Errorf("This Redis command is not allowed from scripts")
+)
+
+// Scripting keeps the compiled scripts by the SHA1 of the body, and the running script
+type Scripting struct {
+    sync.Mutex
+    scripts   map[string]*lua.FunctionProto
+    running   *scriptRun
+    busy      AtomicInt
+    timeLimit AtomicInt // nanoseconds
+}
+
+type scriptRun struct {
+    cancel context.CancelFunc
+    wrote  bool
+    killed bool
+}
+
+func NewScripting(timeLimit time.Duration) *Scripting {
+    sc := &Scripting{scripts: make(map[string]*lua.FunctionProto)}
+    sc.SetTimeLimit(timeLimit)
+    return sc
+}
+
+// SetTimeLimit changes the limit of the scripts started later, the default if not positive
+func (sc *Scripting) SetTimeLimit(timeLimit time.Duration) {
+    if timeLimit <= 0 {
+        timeLimit = kDefaultLuaTimeLimit
+    }
+    sc.timeLimit.Set(int64(timeLimit))
+}
+
+func (sc *Scripting) TimeLimit() time.Duration {
+    return time.Duration(sc.timeLimit.Get())
+}
+
+// Busy tells if a script is running over the time limit
+func (sc *Scripting) Busy() bool {
+    return sc.busy.Get() == 1
+}
+
+// Load compiles the script and caches it, returns the SHA1 of the body
+func (sc *Scripting) Load(body []byte) (string, *lua.FunctionProto, error) {
+    sha := __script_sha1hex(body)
+    sc.Lock()
+    proto, ok := sc.scripts[sha]
+    sc.Unlock()
+    if ok {
+        return sha, proto, nil
+    }
+
+    chunk, err := parse.Parse(bytes.NewReader(body), "@user_script")
+    if err != nil {
+        return "", nil, fmt.Errorf("Error compiling script (new function): %s", err)
+    }
+    proto, err = lua.Compile(chunk, "@user_script")
+    if err != nil {
+        return "", nil, fmt.Errorf("Error compiling script (new function): %s", err)
+    }
+    sc.Lock()
+    sc.scripts[sha] = proto
+    sc.Unlock()
+    return sha, proto, nil
+}
+
+func (sc *Scripting) Get(sha string) (*lua.FunctionProto, bool) {
+    sc.Lock()
+    defer sc.Unlock()
+    proto, ok := sc.scripts[strings.ToLower(sha)]
+    return proto, ok
+}
+
+func (sc *Scripting) Flush() {
+    sc.Lock()
+    defer sc.Unlock()
+    sc.scripts = make(map[string]*lua.FunctionProto)
+}
+
+func (sc *Scripting) Kill() error {
+    sc.Lock()
+    defer sc.Unlock()
+    if sc.running == nil {
+        return ErrNotBusy
+    }
+    if sc.running.wrote {
+        return ErrUnkillable
+    }
+    sc.running.killed = true
+    sc.running.cancel()
+    return nil
+}
+
+func (sc *Scripting) begin(cancel context.CancelFunc) *scriptRun {
+    sc.Lock()
+    defer sc.Unlock()
+    sc.running = &scriptRun{cancel: cancel}
+    return sc.running
+}
+
+func (sc *Scripting) end() {
+    sc.Lock()
+    defer sc.Unlock()
+    sc.running = nil
+    sc.busy.Set(0)
+}
+
+// markBusy marks the server busy if the script is still running
+func (sc *Scripting) markBusy(run *scriptRun) bool {
+    sc.Lock()
+    defer sc.Unlock()
+    if sc.running != run {
+        return false
+    }
+    sc.busy.Set(1)
+    return true
+}
+
+func (sc *Scripting) markWrite(run *scriptRun) {
+    sc.Lock()
+    defer sc.Unlock()
+    run.wrote = true
+}
+
+func (sc *Scripting) isKilled(run *scriptRun) bool {
+    sc.Lock()
+    defer sc.Unlock()
+    return run.killed
+}
+
+// EVAL script numkeys [key ...] [arg ...]
+func (s *Server) RedisEval(request *Request, script []byte, numKeys int, args ...[]byte) (Reply, error) {
+    sha, proto, err := s.scripting.Load(script)
+    if err != nil {
+        return nil, err
+    }
+    return s._script_run(request, sha, proto, numKeys, args)
+}
+
+// EVALSHA sha1 numkeys [key ...] [arg ...]
+func (s *Server) RedisEvalsha(request *Request, sha []byte, numKeys int, args ...[]byte) (Reply, error) {
+    proto, ok := s.scripting.Get(string(sha))
+    if !ok {
+        return nil, ErrNoScript
+    }
+    return s._script_run(request, strings.ToLower(string(sha)), proto, numKeys, args)
+}
+
+// SCRIPT LOAD script | EXISTS sha1 [sha1 ...] | FLUSH [ASYNC|SYNC] | KILL
+func (s *Server) RedisScript(subCommand []byte, args ...[]byte) (interface{}, error) {
+    switch strings.ToLower(string(subCommand)) {
+    case "load":
+        if len(args) != 1 {
+            return nil, ErrWrongArgumentsCount
+        }
+        sha, _, err := s.scripting.Load(args[0])
+        if err != nil {
+            return nil, err
+        }
+        return []byte(sha), nil
+    case "exists":
+        if len(args) == 0 {
+            return nil, ErrWrongArgumentsCount
+        }
+        data := make([]interface{}, len(args))
+        for i, sha := range args {
+            data[i] = 0
+            if _, ok := s.scripting.Get(string(sha)); ok {
+                data[i] = 1
+            }
+        }
+        return data, nil
+    case "flush":
+        if len(args) > 1 {
+            return nil, ErrSyntax
+        } else if len(args) == 1 {
+            if mode := strings.ToLower(string(args[0])); mode != "async" && mode != "sync" {
+                return nil, ErrSyntax
+            }
+        }
+        s.scripting.Flush()
+        return &StatusReply{"OK"}, nil
+    case "kill":
+        if err := s.scripting.Kill(); err != nil {
+            return nil, err
+        }
+        return &StatusReply{"OK"}, nil
+    }
+    return nil, ErrSyntax
+}
+
+func (s *Server) _script_run(request *Request, sha string, proto *lua.FunctionProto, numKeys int, args [][]byte) (Reply, error) {
+    if numKeys < 0 {
+        return nil, ErrScriptNegKeys
+    }
+    if numKeys > len(args) {
+        return nil, ErrScriptNumKeys
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    run := s.scripting.begin(cancel)
+    defer s.scripting.end()
+    timeLimit := s.scripting.TimeLimit()
+    timer := time.AfterFunc(timeLimit, func() {
+        if s.scripting.markBusy(run) {
+            log.Printf("[Script] Lua slow script detected: still in execution after %s, script: %s", timeLimit, sha)
+        }
+    })
+    defer timer.Stop()
+
+    L := lua.NewState(lua.Options{SkipOpenLibs: true})
+    defer L.Close()
+    L.SetContext(ctx)
+    __script_openLibs(L)
+    L.SetGlobal("redis", s.__script_redisTable(L, request, run))
+    L.SetGlobal("KEYS", __script_argsTable(L, args[:numKeys]))
+    L.SetGlobal("ARGV", __script_argsTable(L, args[numKeys:]))
+
+    L.Push(L.NewFunctionFromProto(proto))
+    if err := L.PCall(0, 1, nil); err != nil {
+        if s.scripting.isKilled(run) {
+            return nil, ErrScriptKilled
+        }
+        if apiErr, ok := err.(*lua.ApiError); ok {
+            if tbl, ok := apiErr.Object.(*lua.LTable); ok {
+                // raised by redis.call with the error reply
+                if msg, ok := tbl.RawGetString("err").(lua.LString); ok {
+                    return nil, fmt.Errorf("Error running script (call to f_%s): %s", sha, string(msg))
+                }
+            }
+            return nil, fmt.Errorf("Error running script (call to f_%s): %s", sha, apiErr.Object.String())
+        }
+        return nil, err
+    }
+    return __script_luaToReply(L.Get(-1)), nil
+}
+
+// __script_redisTable builds the redis table of the script
+func (s *Server) __script_redisTable(L *lua.LState, request *Request, run *scriptRun) *lua.LTable {
+    redis := L.NewTable()
+    redis.RawSetString("call", L.NewFunction(func(L *lua.LState) int {
+        return s.__script_call(L, request, run, true)
+    }))
+    redis.RawSetString("pcall", L.NewFunction(func(L *lua.LState) int {
+        return s.__script_call(L, request, run, false)
+    }))
+    redis.RawSetString("error_reply", L.NewFunction(func(L *lua.LState) int {
+        tbl := L.NewTable()
+        tbl.RawSetString("err", lua.LString(L.CheckString(1)))
+        L.Push(tbl)
+        return 1
+    }))
+    redis.RawSetString("status_reply", L.NewFunction(func(L *lua.LState) int {
+        tbl := L.NewTable()
+        tbl.RawSetString("ok", lua.LString(L.CheckString(1)))
+        L.Push(tbl)
+        return 1
+    }))
+    redis.RawSetString("sha1hex", L.NewFunction(func(L *lua.LState) int {
+        L.Push(lua.LString(__script_sha1hex([]byte(L.CheckString(1)))))
+        return 1
+    }))
+    redis.RawSetString("log", L.NewFunction(func(L *lua.LState) int {
+        parts := make([]string, 0, L.GetTop())
+        for i := 2; i <= L.GetTop(); i++ {
+            parts = append(parts, lua.LVAsString(L.Get(i)))
+        }
+        log.Printf("[Script] %s", strings.Join(parts, " "))
+        return 0
+    }))
+    for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+        redis.RawSetString(level, lua.LNumber(i))
+    }
+    return redis
+}
+
+// __script_call serves redis.call and redis.pcall, an error is raised by call and returned by pcall
+func (s *Server) __script_call(L *lua.LState, request *Request, run *scriptRun, raise bool) int {
+    fail := func(err error) int {
+        tbl := L.NewTable()
+        tbl.RawSetString("err", lua.LString(err.Error()))
+        if raise {
+            L.Error(tbl, 1)
+            return 0
+        }
+        L.Push(tbl)
+        return 1
+    }
+
+    if L.GetTop() == 0 {
+        return fail(ErrScriptNoCommand)
+    }
+    args := make([][]byte, L.GetTop())
+    for i := range args {
+        switch v := L.Get(i + 1).(type) {
+        case lua.LString, lua.LNumber:
+            args[i] = []byte(lua.LVAsString(v))
+        default:
+            return fail(ErrScriptArguments)
+        }
+    }
+    name := strings.ToLower(string(args[0]))
+    fn, ok := s.Methods[name]
+    if !ok {
+        return fail(ErrScriptUnknown)
+    }
+    spec := lookupCommand(name)
+    if spec.Flags&kCmdNoScript != 0 {
+        return fail(ErrScriptNotAllow)
+    }
+    callRequest := &Request{
+        Command:       name,
+        Arguments:     args[1:],
+        RemoteAddress: request.RemoteAddress,
+    }
+    // the script runs with the permissions of its caller
+    if err := s.checkPermission(request.Client, callRequest); err != nil {
+        return fail(err)
+    }
+    if spec.Flags&kCmdWrite != 0 {
+        s.scripting.markWrite(run)
+    }
+
+    // no client for the call, so the blocking commands never block
+    reply, err := fn(callRequest)
+    if err != nil {
+        return fail(err)
+    }
+    value, err := __script_replyToLua(L, reply)
+    if err != nil {
+        return fail(err)
+    }
+    if tbl, ok := value.(*lua.LTable); ok && raise {
+        if _, isErr := tbl.RawGetString("err").(lua.LString); isErr {
+            L.Error(tbl, 1)
+            return 0
+        }
+    }
+    L.Push(value)
+    return 1
+}
+
+func __script_openLibs(L *lua.LState) {
+    libs := []struct {
+        name string
+        fn   lua.LGFunction
+    }{
+        {lua.BaseLibName, lua.OpenBase},
+        {lua.TabLibName, lua.OpenTable},
+        {lua.StringLibName, lua.OpenString},
+        {lua.MathLibName, lua.OpenMath},
+    }
+    for _, lib := range libs {
+        L.Push(L.NewFunction(lib.fn))
+        L.Push(lua.LString(lib.name))
+        L.Call(1, 0)
+    }
+    // no access to the file system
+    for _, name := range []string{"dofile", "loadfile"} {
+        L.SetGlobal(name, lua.LNil)
+    }
+}
+
+func __script_argsTable(L *lua.LState, args [][]byte) *lua.LTable {
+    tbl := L.CreateTable(len(args), 0)
+    for i, arg := range args {
+        tbl.RawSetInt(i+1, lua.LString(arg))
+    }
+    return tbl
+}
+
+// __script_replyToLua converts the reply the way Redis does: integers to numbers, bulks to strings,
+// nil bulks and arrays to false, the status and the error to tables with the ok or the err field.
+func __script_replyToLua(L *lua.LState, reply Reply) (lua.LValue, error) {
+    var buf bytes.Buffer
+    if _, err := reply.WriteTo(&buf); err != nil {
+        return nil, err
+    }
+    if buf.Len() == 0 {
+        return lua.LFalse, nil
+    }
+    return __script_respToLua(L, bufio.NewReader(&buf))
+}
+
+func __script_respToLua(L *lua.LState, reader *bufio.Reader) (lua.LValue, error) {
+    line, err := reader.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    line = strings.TrimRight(line, "\r\n")
+    if len(line) == 0 {
+        return nil, Malformed("<reply>", line)
+    }
+    switch line[0] {
+    case '+':
+        tbl := L.NewTable()
+        tbl.RawSetString("ok", lua.LString(line[1:]))
+        return tbl, nil
+    case '-':
+        tbl := L.NewTable()
+        tbl.RawSetString("err", lua.LString(line[1:]))
+        return tbl, nil
+    case ':':
+        n, err := strconv.ParseInt(line[1:], 10, 64)
+        if err != nil {
+            return nil, err
+        }
+        return lua.LNumber(n), nil
+    case '$':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if n < 0 {
+            return lua.LFalse, nil
+        }
+        data := make([]byte, n+2)
+        if _, err := io.ReadFull(reader, data); err != nil {
+            return nil, err
+        }
+        return lua.LString(data[:n]), nil
+    case '*':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if n < 0 {
+            return lua.LFalse, nil
+        }
+        tbl := L.CreateTable(n, 0)
+        for i := 1; i <= n; i++ {
+            value, err := __script_respToLua(L, reader)
+            if err != nil {
+                return nil, err
+            }
+            tbl.RawSetInt(i, value)
+        }
+        return tbl, nil
+    }
+    return nil, Malformed("<reply>", line)
+}
+
+// __script_luaToReply converts the value returned by the script: numbers to integers, true to 1,
+// false and nil to nil, tables with the err or the ok field to the error or the status, and the
+// other tables to arrays up to the first nil.
+func __script_luaToReply(value lua.LValue) Reply {
+    switch v := value.(type) {
+    case lua.LNumber:
+        return &IntReply{int(v)}
+    case lua.LString:
+        return &BulkReply{[]byte(v)}
+    case lua.LBool:
+        if v {
+            return &IntReply{1}
+        }
+        return &BulkReply{nil}
+    case *lua.LTable:
+        if msg, ok := v.RawGetString("err").(lua.LString); ok {
+            return __script_errorReply(string(msg))
+        }
+        if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+            return &StatusReply{string(msg)}
+        }
+        values := make([]interface{}, 0, v.Len())
+        for i := 1; ; i++ {
+            item := v.RawGetInt(i)
+            if item == lua.LNil {
+                break
+            }
+            values = append(values, __script_luaToReply(item))
+        }
+        return &ArrayReply{values}
+    }
+    return &BulkReply{nil}
+}
+
+// __script_errorReply keeps the code of the error if there is one, e.g. "ERROR msg" from redis.call
+func __script_errorReply(msg string) Reply {
+    if i := strings.IndexByte(msg, ' '); i > 0 && strings.ToUpper(msg[:i]) == msg[:i] {
+        return &CodeErrorReply{msg[:i], msg[i+1:]}
+    }
+    return &ErrorReply{msg}
+}
+
+func __script_sha1hex(body []byte) string {
+    sum := sha1.Sum(body)
+    return hex.EncodeToString(sum[:])
+}
@@ -1,18 +1,23 @@
 package main
 
 import (
-    "bytes"
+    "crypto/tls"
     "fmt"
     "io"
     "log"
     "net"
+    "net/http"
+    "os"
     "reflect"
     "strings"
+    "sync"
     "time"
 )
 
 const (
-    kDefaultAddress = ":6379"
+    kDefaultAddress           = ":6379"
+    kDefaultPubSubOutputLimit = 32 << 20
+    kTLSHandshakeTimeout      = 10 * time.Second
 )
 
 type HandlerFn func(request *Request) (Reply, error)
@@ -20,11 +25,64 @@ type GuarderFn func(request *Request) (reflect.Value, *ErrorReply)
 
 type Server struct {
     Address    string
-    Methods    map[string]HandlerFn
-    MonitorLog bool
+    TLSAddress string
+    UnixSocket string
+    // the address of the HTTP listener serving /metrics, empty to disable
+    MetricsAddress string
+    Methods        map[string]HandlerFn
+    // 1 to log the commands served, it can be changed by CONFIG SET
+    MonitorLog AtomicInt
+
+    keyWaiters        *KeyWaiters
+    broker            *Broker
+    pubsubOutputLimit AtomicInt
+    limits            ClientLimits
+    notifyClasses     AtomicInt
+    scripting         *Scripting
+    acl               *ACL
+    tlsConfig         *tls.Config
+    clients           *ClientRegistry
+    pause             *ClientPause
+    monitors          *Monitors
+    slowlog           *Slowlog
+    cmdstats          *CommandStats
+    metricsWriters    []MetricsWriter
+    shutdownHandlers  []ShutdownHandler
+    optionsSetters    []OptionsSetter
+    unixSocketPerm    os.FileMode
+
+    // closing is set under the closeLock, so no connection is added to conns once shutting down
+    closeLock        sync.Mutex
+    closing          AtomicInt
+    conns            sync.WaitGroup
+    shutdownRequests chan bool
+
+    // configLock serializes CONFIG GET, SET and REWRITE
+    configLock sync.Mutex
+
+    // the commands share the execution lock, a script holds it alone to run atomically
+    execLock sync.RWMutex
+}
+
+// ServerBinder is implemented by the handlers which need to reach the server,
+// e.g. to wake up the clients blocked on a key.
+type ServerBinder interface {
+    BindServer(s *Server)
 }
 
 func (s *Server) RegisterHandler(handler interface{}) error {
+    if binder, ok := handler.(ServerBinder); ok {
+        binder.BindServer(s)
+    }
+    if mw, ok := handler.(MetricsWriter); ok {
+        s.metricsWriters = append(s.metricsWriters, mw)
+    }
+    if sh, ok := handler.(ShutdownHandler); ok {
+        s.shutdownHandlers = append(s.shutdownHandlers, sh)
+    }
+    if setter, ok := handler.(OptionsSetter); ok {
+        s.optionsSetters = append(s.optionsSetters, setter)
+    }
     hType := reflect.TypeOf(handler)
     for i := 0; i < hType.NumMethod(); i++ {
         method := hType.Method(i)
@@ -42,42 +100,144 @@ func (s *Server) RegisterHandler(handler interface{}) error {
     return nil
 }
 
+// ListenAndServe serves the plain TCP, the TLS and the unix socket listeners, the plain
+// one is disabled if only the others are configured, and the metrics over HTTP if configured.
+// It returns on the first listener failed, or nil once shut down by RequestShutdown.
 func (s *Server) ListenAndServe() error {
     addr := s.Address
-    if addr == "" {
+    if addr == "" && s.TLSAddress == "" && s.UnixSocket == "" {
         addr = kDefaultAddress
     }
-    l, err := net.Listen("tcp", addr)
-    if err != nil {
+    listeners := make([]net.Listener, 0, 3)
+    defer func() {
+        for _, l := range listeners {
+            l.Close()
+        }
+    }()
+    if addr != "" {
+        l, err := net.Listen("tcp", addr)
+        if err != nil {
+            return err
+        }
+        listeners = append(listeners, l)
+        log.Println("[ListenAndServe] GoRockdis is listening on", addr)
+    }
+    if s.TLSAddress != "" {
+        l, err := tls.Listen("tcp", s.TLSAddress, s.tlsConfig)
+        if err != nil {
+            return err
+        }
+        listeners = append(listeners, l)
+        log.Println("[ListenAndServe] GoRockdis is listening with TLS on", s.TLSAddress)
+    }
+    if s.UnixSocket != "" {
+        l, err := listenUnix(s.UnixSocket, s.unixSocketPerm)
+        if err != nil {
+            return err
+        }
+        listeners = append(listeners, l)
+        log.Println("[ListenAndServe] GoRockdis is listening on the unix socket", s.UnixSocket)
+    }
+
+    var metricsListener net.Listener
+    if s.MetricsAddress != "" {
+        l, err := net.Listen("tcp", s.MetricsAddress)
+        if err != nil {
+            return err
+        }
+        metricsListener = l
+        defer l.Close()
+        log.Println("[ListenAndServe] GoRockdis is serving the metrics on", s.MetricsAddress)
+    }
+
+    errs := make(chan error, len(listeners)+1)
+    for _, l := range listeners {
+        go func(l net.Listener) {
+            errs <- s.serve(l)
+        }(l)
+    }
+    var metricsServer *http.Server
+    if metricsListener != nil {
+        mux := http.NewServeMux()
+        mux.HandleFunc("/metrics", s.serveMetrics)
+        metricsServer = &http.Server{Handler: mux}
+        go func() {
+            errs <- metricsServer.Serve(metricsListener)
+        }()
+    }
+    select {
+    case err := <-errs:
         return err
+    case save := <-s.shutdownRequests:
+        s.shutdown(listeners, metricsServer, save)
+        return nil
     }
-    defer l.Close()
-    log.Println("[ListenAndServe] GoRockdis is listening on", addr)
+}
 
+func (s *Server) serve(l net.Listener) error {
     for {
         conn, err := l.Accept()
         if err != nil {
             return err
         }
-        go s.ServeClient(conn)
+        s.closeLock.Lock()
+        if s.isClosing() {
+            s.closeLock.Unlock()
+            conn.Close()
+            return nil
+        }
+        s.conns.Add(1)
+        s.closeLock.Unlock()
+        go func() {
+            defer s.conns.Done()
+            s.ServeClient(conn)
+        }()
     }
 }
 
 func (s *Server) ServeClient(conn net.Conn) (err error) {
     globalStat.totalConnections.Add(1)
     globalStat.clients.Add(1)
-    clientAddr := conn.RemoteAddr().String()
+    client := NewClient(conn)
+    client.limits = &s.limits
+    clientAddr := client.Address
+    if s.acl.DefaultNoPass() {
+        client.setUser(kDefaultUser)
+    }
+    if tlsConn, ok := conn.(*tls.Conn); ok {
+        // a failed handshake sticks to the connection, so do it before the zero byte read below
+        tlsConn.SetDeadline(time.Now().Add(kTLSHandshakeTimeout))
+        if err := tlsConn.Handshake(); err != nil {
+            log.Printf("[ServeClient] TLS handshake failed with <%s>: %s", clientAddr, err)
+            tlsConn.Close()
+            globalStat.clients.Add(-1)
+            return nil
+        }
+        tlsConn.SetDeadline(time.Time{})
+    }
+    if maxClients := s.limits.maxClients.Get(); maxClients > 0 && globalStat.clients.Get() > maxClients {
+        globalStat.rejectedConnections.Add(1)
+        ErrMaxClients.WriteTo(conn)
+        conn.Close()
+        globalStat.clients.Add(-1)
+        return nil
+    }
+    s.clients.Add(client)
     defer func() {
         if err != nil {
             log.Printf("[ServeClient] Error in request/reply, will close the connnetion <%s>: %s", clientAddr, err)
             fmt.Fprintf(conn, "-ERROR %s\r\n", err)
         }
+        s.clients.Remove(client)
+        s.monitors.Remove(client)
+        s.broker.UnsubscribeAll(client)
+        client.Close()
         conn.Close()
         conn = nil
         globalStat.clients.Add(-1)
     }()
 
-    for {
+    for !s.isClosing() {
         conn.SetReadDeadline(time.Now())
         zeroByte := make([]byte, 0)
         if _, err := conn.Read(zeroByte); err == io.EOF {
@@ -85,14 +245,21 @@ func (s *Server) ServeClient(conn net.Conn) (err error) {
             break
         }
 
-        conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
-        request, err := NewRequest(conn)
+        conn.SetReadDeadline(time.Now().Add(s.limits.readTimeout()))
+        if s.isClosing() {
+            // checked after the deadline set, so the wake up by shutdown is never missed
+            break
+        }
+        request, err := NewRequest(client.reader, int(s.limits.maxArgs.Get()), s.limits.maxBulkLen.Get())
         if err == io.EOF {
             // log.Printf("[ServeClient] Detect a closed connection on %s", clientAddr)
             break
         } else {
             if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
                 // log.Printf("[ServeClient] Detect a Timeout client on %s, will check if she is closed.", clientAddr)
+                if s.limits.isIdle(client) {
+                    break
+                }
             } else {
                 if err != nil {
                     return err
@@ -100,13 +267,34 @@ func (s *Server) ServeClient(conn net.Conn) (err error) {
                 globalStat.totalCommands.Add(1)
                 globalStat.qpsCommands.Add(1)
                 request.RemoteAddress = clientAddr
+                request.Connection = conn
+                request.Client = client
+                client.touch(request.Command)
+                if s.needAuth(request) {
+                    if err := client.WriteReply(ErrNoAuth); err != nil {
+                        return err
+                    }
+                    continue
+                }
+                if client.IsSubscriber() && client.Protocol() == kProtoResp2 {
+                    if reply, served := s.serveSubscriber(request); served {
+                        if err := client.WriteReply(reply); err != nil {
+                            return err
+                        }
+                        continue
+                    }
+                }
+                s.pause.Wait(lookupCommand(request.Command))
                 if reply, err := s.ServeRequest(request); err != nil {
                     return err
                 } else {
-                    if _, err := reply.WriteTo(conn); err != nil {
+                    if err := client.WriteReply(reply); err != nil {
                         return err
                     }
                 }
+                if client.quitting {
+                    break
+                }
             }
         }
     }
@@ -114,11 +302,47 @@ func (s *Server) ServeClient(conn net.Conn) (err error) {
 }
 
 func (s *Server) ServeRequest(request *Request) (Reply, error) {
-    if fn, ok := s.Methods[strings.ToLower(request.Command)]; ok {
-        return fn(request)
-    } else {
+    fn, ok := s.Methods[strings.ToLower(request.Command)]
+    if !ok {
         return ErrMethodNotSupported, nil
     }
+    spec := lookupCommand(request.Command)
+    if err := s.checkPermission(request.Client, request); err != nil {
+        s.cmdstats.Reject(spec.Name)
+        if r, ok := err.(Reply); ok {
+            return r, nil
+        }
+        return &ErrorReply{err.Error()}, nil
+    }
+    if spec.Flags&kCmdAllowBusy == 0 && s.scripting.Busy() {
+        s.cmdstats.Reject(spec.Name)
+        return ErrBusyScript, nil
+    }
+    switch {
+    case spec.Flags&kCmdNoLock != 0:
+    case spec.Flags&kCmdExclusive != 0:
+        s.execLock.Lock()
+        defer s.execLock.Unlock()
+    default:
+        s.execLock.RLock()
+        defer s.execLock.RUnlock()
+    }
+    start := time.Now()
+    reply, err := fn(request)
+    duration := time.Since(start)
+    if spec.Flags&kCmdBlocking != 0 {
+        // the time blocked on the keys is not the latency of the server
+        duration = -1
+    } else {
+        s.slowlog.Log(request, duration)
+    }
+    failed := err != nil
+    switch reply.(type) {
+    case *ErrorReply, *CodeErrorReply:
+        failed = true
+    }
+    s.cmdstats.Record(spec.Name, duration, failed)
+    return reply, err
 }
 
 func (s *Server) Close() {
@@ -129,7 +353,74 @@ func NewServer(config RockdisConfig) *Server {
     s := &Server{}
     s.Methods = make(map[string]HandlerFn)
     s.Address = fmt.Sprintf("%s:%d", config.Server.Bind, config.Server.Port)
-    s.MonitorLog = config.Server.MonitorLog
+    if config.Server.TlsPort != 0 {
+        if tlsConfig, err := newTLSConfig(config); err != nil {
+            log.Fatalf("[Config] TLS error for [Server], %s", err)
+        } else {
+            s.tlsConfig = tlsConfig
+        }
+        s.TLSAddress = fmt.Sprintf("%s:%d", config.Server.Bind, config.Server.TlsPort)
+    }
+    if config.Server.UnixSocket != "" {
+        if perm, err := parseUnixSocketPerm(config.Server.UnixSocketPerm); err != nil {
+            log.Fatalf("[Config] Format error for [Server] unixsocketperm=%s, %s", config.Server.UnixSocketPerm, err)
+        } else {
+            s.unixSocketPerm = perm
+        }
+        s.UnixSocket = config.Server.UnixSocket
+    }
+    if config.Server.MetricsPort != 0 {
+        s.MetricsAddress = fmt.Sprintf("%s:%d", config.Server.MetricsBind, config.Server.MetricsPort)
+    }
+    if config.Server.Port == 0 && (s.TLSAddress != "" || s.UnixSocket != "") {
+        // TLS or unix socket only
+        s.Address = ""
+    }
+    if config.Server.MonitorLog {
+        s.MonitorLog.Set(1)
+    }
+    if acl, err := NewACL(config.Server.RequirePass, config.Server.AclFile); err != nil {
+        log.Fatalf("[Config] Failed to load the ACL file %s, %s", config.Server.AclFile, err)
+    } else {
+        s.acl = acl
+    }
+    s.keyWaiters = NewKeyWaiters(s.execLock.RLocker())
+    s.broker = NewBroker()
+    s.clients = NewClientRegistry()
+    s.shutdownRequests = make(chan bool, 1)
+    s.pause = NewClientPause()
+    s.monitors = NewMonitors()
+    s.cmdstats = NewCommandStats()
+    if slowerThan, err := parseSlowlogSlowerThan(config.Server.SlowlogLogSlowerThan); err != nil {
+        log.Fatalf("[Config] Format error for [Server] slowloglogslowerthan=%s", config.Server.SlowlogLogSlowerThan)
+    } else {
+        maxLen := config.Server.SlowlogMaxLen
+        if maxLen <= 0 {
+            maxLen = kDefaultSlowlogMaxLen
+        }
+        s.slowlog = NewSlowlog(slowerThan, maxLen)
+    }
+    s.scripting = NewScripting(time.Duration(config.Server.LuaTimeLimit) * time.Millisecond)
+    if limit, err := parsePubSubOutputLimit(config.Server.PubSubOutputLimit); err != nil {
+        log.Fatalf("[Config] Format error for [Server] pubsuboutputlimit=%s", config.Server.PubSubOutputLimit)
+    } else {
+        s.pubsubOutputLimit.Set(limit)
+    }
+    // the client limits are applied the way CONFIG SET does
+    for _, name := range kConfigClientLimits {
+        p, _ := __config_lookup(name)
+        if change, err := p.apply(s, &config); err != nil {
+            log.Fatalf("[Config] Format error for [Server] %s=%s, %s", strings.ToLower(p.variable),
+                __config_format(__config_field(&config, p), false), err)
+        } else {
+            change()
+        }
+    }
+    if classes, err := parseNotifyKeyspaceEvents(config.Server.NotifyKeyspaceEvents); err != nil {
+        log.Fatalf("[Config] Format error for [Server] notifykeyspaceevents=%s, %s", config.Server.NotifyKeyspaceEvents, err)
+    } else {
+        s.notifyClasses.Set(int64(classes))
+    }
     return s
 }
 
@@ -163,17 +454,23 @@ func (s *Server) newHandlerGuards(handler interface{}, f *reflect.Value) ([]Guar
         // In: [*handlerType, arg0, arg1 ...]
         inputStart = 1
     }
+    argIndex := 0
     for i := inputStart; i < fType.NumIn(); i++ {
         switch fType.In(i) {
+        case reflect.TypeOf(&Request{}):
+            // the request itself does not consume any argument
+            guards = append(guards, guardRequest())
+            continue
         case reflect.TypeOf([]byte{}):
-            guards = append(guards, guardRequestByteArg(i-inputStart))
+            guards = append(guards, guardRequestByteArg(argIndex))
         case reflect.TypeOf([][]byte{}):
-            guards = append(guards, guardRequestByteSliceArg(i-inputStart))
+            guards = append(guards, guardRequestByteSliceArg(argIndex))
         case reflect.TypeOf(1):
-            guards = append(guards, guardRequestIntArg(i-inputStart))
+            guards = append(guards, guardRequestIntArg(argIndex))
         default:
             return nil, fmt.Errorf("Argument %d: wrong type %s (%s)", i, fType.In(i), fType.Name())
         }
+        argIndex++
     }
     return guards, nil
 }
@@ -194,21 +491,15 @@ func (s *Server) newHandlerFn(handler interface{}, f *reflect.Value, guards []Gu
             input = input[1:]
         }
 
-        var monitorString string
-        if len(request.Arguments) > 0 {
-            monitorString = fmt.Sprintf("%.6f [0 %s] \"%s\" \"%s\"",
-                float64(time.Now().UTC().UnixNano())/1e9,
-                request.RemoteAddress,
-                request.Command,
-                bytes.Join(request.Arguments, []byte{'"', ' ', '"'}))
-        } else {
-            monitorString = fmt.Sprintf("%.6f [0 %s] \"%s\"",
-                float64(time.Now().UTC().UnixNano())/1e9,
-                request.RemoteAddress,
-                request.Command)
-        }
-        if s.MonitorLog {
-            log.Printf("[Monitor] %s", monitorString)
+        monitorLog := s.MonitorLog.Get() == 1
+        if monitorLog || s.monitors.Active() {
+            monitorString := __monitor_format(request)
+            if monitorLog {
+                log.Printf("[Monitor] %s", monitorString)
+            }
+            if s.monitors.Active() {
+                s.monitors.Feed(monitorString)
+            }
         }
 
         var results []reflect.Value
@@ -218,6 +509,9 @@ func (s *Server) newHandlerFn(handler interface{}, f *reflect.Value, guards []Gu
             results = f.Call(input)
         }
         if err := results[len(results)-1].Interface(); err != nil {
+            if codeErr, ok := err.(*CodeErrorReply); ok {
+                return codeErr, nil
+            }
             return &ErrorReply{err.(error).Error()}, nil
         }
         if len(results) > 1 {
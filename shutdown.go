@@ -0,0 +1,105 @@
+package main
+
+import (
+    "context"
+    "log"
+    "net"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// kShutdownTimeout is how long the commands in flight may take before the connections are closed
+const kShutdownTimeout = 10 * time.Second
+
+// ShutdownHandler is implemented by the handlers which persist their data when the server
+// shuts down, e.g. to flush the memtables of RocksDB.
+type ShutdownHandler interface {
+    Shutdown(save bool)
+}
+
+// RequestShutdown makes ListenAndServe shut down the server and return, e.g. on a signal
+func (s *Server) RequestShutdown(save bool) {
+    select {
+    case s.shutdownRequests <- save:
+    default:
+        // already requested
+    }
+}
+
+// SHUTDOWN [NOSAVE|SAVE], the connection is closed without a reply once the server shuts down
+func (s *Server) RedisShutdown(request *Request, args ...[]byte) (Reply, error) {
+    if request.Client == nil {
+        return nil, ErrNotFromClient
+    }
+    save := true
+    if len(args) > 1 {
+        return nil, ErrWrongArgumentsCount
+    } else if len(args) == 1 {
+        switch strings.ToLower(string(args[0])) {
+        case "nosave":
+            save = false
+        case "save":
+        default:
+            return nil, ErrSyntax
+        }
+    }
+    log.Printf("[Server] SHUTDOWN requested by <%s>", request.RemoteAddress)
+    s.RequestShutdown(save)
+    request.Client.quitting = true
+    return &PushedReply{}, nil
+}
+
+// shutdown stops accepting the connections, lets the commands in flight finish within
+// kShutdownTimeout and closes the connections, then the handlers persist their data.
+// The metrics server is shut down first, so no scrape reads the database being closed.
+func (s *Server) shutdown(listeners []net.Listener, metricsServer *http.Server, save bool) {
+    log.Printf("[Server] Shutting down, save=%v", save)
+    s.closeLock.Lock()
+    s.closing.Set(1)
+    s.closeLock.Unlock()
+    for _, l := range listeners {
+        l.Close()
+    }
+    if metricsServer != nil {
+        ctx, cancel := context.WithTimeout(context.Background(), kShutdownTimeout)
+        metricsServer.Shutdown(ctx)
+        cancel()
+    }
+    // a client held by CLIENT PAUSE would never see its connection closed
+    s.pause.Close()
+
+    // the idle clients are waked up from the read to quit, the blocked ones are closed
+    for _, c := range s.clients.List() {
+        if c.blocked.Get() == 1 {
+            c.Kill()
+        } else {
+            c.conn.SetReadDeadline(time.Now())
+        }
+    }
+    drained := make(chan struct{})
+    go func() {
+        s.conns.Wait()
+        close(drained)
+    }()
+    select {
+    case <-drained:
+    case <-time.After(kShutdownTimeout):
+        log.Printf("[Server] Closing the connections still serving after %s", kShutdownTimeout)
+        for _, c := range s.clients.List() {
+            c.Kill()
+        }
+        // a script which has written is not killable and has to finish
+        s.scripting.Kill()
+        <-drained
+    }
+
+    for _, h := range s.shutdownHandlers {
+        h.Shutdown(save)
+    }
+    log.Printf("[Server] Shutdown completed.")
+}
+
+func (s *Server) isClosing() bool {
+    return s.closing.Get() == 1
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    kDefaultSlowlogSlowerThan = 10000 // microseconds
+    kDefaultSlowlogMaxLen     = 128
+    kSlowlogMaxArgc           = 32
+    kSlowlogMaxArgLen         = 128
+)
+
+type SlowlogEntry struct {
+    Id       int64
+    Time     time.Time
+    Duration time.Duration
+    Args     [][]byte
+    Address  string
+    Name     string
+}
+
+// Slowlog keeps the latest commands served slower than the threshold in a ring buffer.
+// A negative threshold disables it, zero logs every command.
+type Slowlog struct {
+    sync.Mutex
+    ring   []*SlowlogEntry
+    next   int
+    length int
+    nextId int64
+
+    slowerThan AtomicInt // microseconds
+}
+
+func NewSlowlog(slowerThan int64, maxLen int) *Slowlog {
+    sl := &Slowlog{}
+    sl.slowerThan.Set(slowerThan)
+    sl.SetMaxLen(maxLen)
+    return sl
+}
+
+func (sl *Slowlog) SetSlowerThan(microseconds int64) {
+    sl.slowerThan.Set(microseconds)
+}
+
+// SetMaxLen keeps the latest entries fit in the new length
+func (sl *Slowlog) SetMaxLen(maxLen int) {
+    sl.Lock()
+    defer sl.Unlock()
+    entries := sl.latest(maxLen)
+    sl.ring = make([]*SlowlogEntry, maxLen)
+    sl.next, sl.length = 0, 0
+    for i := len(entries) - 1; i >= 0; i-- {
+        sl.push(entries[i])
+    }
+}
+
+// Log records the request if it took longer than the threshold
+func (sl *Slowlog) Log(request *Request, duration time.Duration) {
+    slowerThan := sl.slowerThan.Get()
+    if slowerThan < 0 || int64(duration/time.Microsecond) < slowerThan {
+        return
+    }
+    entry := &SlowlogEntry{
+        Time:     time.Now(),
+        Duration: duration,
+        Args:     __slowlog_args(request),
+        Address:  request.RemoteAddress,
+    }
+    if request.Client != nil {
+        entry.Name = request.Client.Name()
+    }
+
+    sl.Lock()
+    defer sl.Unlock()
+    entry.Id = sl.nextId
+    sl.nextId++
+    sl.push(entry)
+}
+
+// Get returns the latest count entries, the newest first, or all if count is negative
+func (sl *Slowlog) Get(count int) []*SlowlogEntry {
+    sl.Lock()
+    defer sl.Unlock()
+    if count < 0 {
+        count = sl.length
+    }
+    return sl.latest(count)
+}
+
+func (sl *Slowlog) Len() int {
+    sl.Lock()
+    defer sl.Unlock()
+    return sl.length
+}
+
+func (sl *Slowlog) Reset() {
+    sl.Lock()
+    defer sl.Unlock()
+    for i := range sl.ring {
+        sl.ring[i] = nil
+    }
+    sl.next, sl.length = 0, 0
+}
+
+func (sl *Slowlog) push(entry *SlowlogEntry) {
+    if len(sl.ring) == 0 {
+        return
+    }
+    sl.ring[sl.next] = entry
+    sl.next = (sl.next + 1) % len(sl.ring)
+    if sl.length < len(sl.ring) {
+        sl.length++
+    }
+}
+
+func (sl *Slowlog) latest(count int) []*SlowlogEntry {
+    if count > sl.length {
+        count = sl.length
+    }
+    entries := make([]*SlowlogEntry, 0, count)
+    for i := 1; i <= count; i++ {
+        entries = append(entries, sl.ring[(sl.next-i+len(sl.ring))%len(sl.ring)])
+    }
+    return entries
+}
+
+// SLOWLOG GET [count] | LEN | RESET
+func (s *Server) RedisSlowlog(subCommand []byte, args ...[]byte) (interface{}, error) {
+    switch strings.ToLower(string(subCommand)) {
+    case "get":
+        if len(args) > 1 {
+            return nil, ErrWrongArgumentsCount
+        }
+        count := 10
+        if len(args) == 1 {
+            n, err := strconv.Atoi(string(args[0]))
+            if err != nil || n < -1 {
+                return nil, fmt.Errorf("count should be greater than or equal to -1")
+            }
+            count = n
+        }
+        entries := s.slowlog.Get(count)
+        data := make([]interface{}, len(entries))
+        for i, entry := range entries {
+            data[i] = &ArrayReply{[]interface{}{
+                int(entry.Id),
+                int(entry.Time.Unix()),
+                int(entry.Duration / time.Microsecond),
+                &MultiBulkReply{entry.Args},
+                []byte(entry.Address),
+                []byte(entry.Name),
+            }}
+        }
+        return data, nil
+    case "len":
+        return s.slowlog.Len(), nil
+    case "reset":
+        s.slowlog.Reset()
+        return &StatusReply{"OK"}, nil
+    }
+    return nil, ErrSyntax
+}
+
+// __slowlog_args truncates the command line the way Redis does, the last argument kept tells
+// how many more arguments were, and a long argument tells how many more bytes it had.
+func __slowlog_args(request *Request) [][]byte {
+    argc := len(request.Arguments) + 1
+    if argc > kSlowlogMaxArgc {
+        argc = kSlowlogMaxArgc
+    }
+    args := make([][]byte, 0, argc)
+    args = append(args, []byte(request.Command))
+    for i, arg := range request.Arguments {
+        if len(args) == kSlowlogMaxArgc-1 && i < len(request.Arguments)-1 {
+            args = append(args, []byte(fmt.Sprintf("... (%d more arguments)", len(request.Arguments)-i)))
+            break
+        }
+        if len(arg) > kSlowlogMaxArgLen {
+            arg = []byte(fmt.Sprintf("%s... (%d more bytes)", arg[:kSlowlogMaxArgLen], len(arg)-kSlowlogMaxArgLen))
+        }
+        args = append(args, arg)
+    }
+    return args
+}
+
+// parseSlowlogSlowerThan parses the threshold in microseconds, empty for the default
+func parseSlowlogSlowerThan(value string) (int64, error) {
+    if value == "" {
+        return kDefaultSlowlogSlowerThan, nil
+    }
+    return strconv.ParseInt(value, 10, 64)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestSlowlogArgs(t *testing.T) {
+    arguments := func(n int) [][]byte {
+        args := make([][]byte, n)
+        for i := range args {
+            args[i] = []byte(fmt.Sprint(i))
+        }
+        return args
+    }
+    long := strings.Repeat("a", kSlowlogMaxArgLen)
+
+    tests := []struct {
+        name      string
+        arguments [][]byte
+        want      [][]byte
+    }{
+        {"no argument", nil, [][]byte{[]byte("get")}},
+        {"short", [][]byte{[]byte("key")}, [][]byte{[]byte("get"), []byte("key")}},
+        {"long argument", [][]byte{[]byte(long), []byte(long + "bcd")},
+            [][]byte{[]byte("get"), []byte(long), []byte(long + "... (3 more bytes)")}},
+        {"max arguments", arguments(kSlowlogMaxArgc - 1),
+            append([][]byte{[]byte("get")}, arguments(kSlowlogMaxArgc-1)...)},
+        {"too many arguments", arguments(kSlowlogMaxArgc + 9),
+            append(append([][]byte{[]byte("get")}, arguments(kSlowlogMaxArgc-2)...), []byte("... (11 more arguments)"))},
+    }
+    for _, test := range tests {
+        args := __slowlog_args(&Request{Command: "get", Arguments: test.arguments})
+        if !reflect.DeepEqual(args, test.want) {
+            t.Errorf("%s: __slowlog_args = %q, want %q", test.name, args, test.want)
+        }
+    }
+}
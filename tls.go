@@ -0,0 +1,56 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "io/ioutil"
+    "strings"
+)
+
+// newTLSConfig loads the certificate and the key of the server, and the CA to verify the
+// client certificates with. TlsAuthClients is no, optional or yes, and defaults to yes if
+// the CA is given.
+func newTLSConfig(config RockdisConfig) (*tls.Config, error) {
+    cert, err := tls.LoadX509KeyPair(config.Server.TlsCertFile, config.Server.TlsKeyFile)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load the certificate and the key, %s", err)
+    }
+    tlsConfig := &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        MinVersion:   tls.VersionTLS12,
+        ClientAuth:   tls.NoClientCert,
+    }
+
+    authClients := strings.ToLower(config.Server.TlsAuthClients)
+    if authClients == "" {
+        authClients = "no"
+        if config.Server.TlsCaCertFile != "" {
+            authClients = "yes"
+        }
+    }
+    if authClients == "no" {
+        return tlsConfig, nil
+    }
+    if config.Server.TlsCaCertFile == "" {
+        return nil, fmt.Errorf("TlsCaCertFile is required to verify the client certificates")
+    }
+    caCert, err := ioutil.ReadFile(config.Server.TlsCaCertFile)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load the CA certificate, %s", err)
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(caCert) {
+        return nil, fmt.Errorf("no certificate found in %s", config.Server.TlsCaCertFile)
+    }
+    tlsConfig.ClientCAs = pool
+    switch authClients {
+    case "yes":
+        tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+    case "optional":
+        tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+    default:
+        return nil, fmt.Errorf("TlsAuthClients should be no, optional or yes")
+    }
+    return tlsConfig, nil
+}
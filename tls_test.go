@@ -0,0 +1,201 @@
+package main
+
+import (
+    "bufio"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "fmt"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+type tlsPinger struct{}
+
+func (p *tlsPinger) RedisPing() (*StatusReply, error) {
+    return &StatusReply{"PONG"}, nil
+}
+
+type testCert struct {
+    cert *x509.Certificate
+    key  *ecdsa.PrivateKey
+    pair tls.Certificate
+}
+
+// newTestCert creates a certificate signed by the parent, or a self-signed one if the parent is nil,
+// and writes it with its key to dir/name.crt and dir/name.key
+func newTestCert(t *testing.T, dir, name string, template *x509.Certificate, parent *testCert) *testCert {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template.Subject = pkix.Name{CommonName: name}
+    template.NotBefore = time.Now().Add(-time.Hour)
+    template.NotAfter = time.Now().Add(time.Hour)
+    signerCert, signerKey := template, key
+    if parent != nil {
+        signerCert, signerKey = parent.cert, parent.key
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+    keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+    if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPem, 0600); err != nil {
+        t.Fatal(err)
+    }
+    if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPem, 0600); err != nil {
+        t.Fatal(err)
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pair, err := tls.X509KeyPair(certPem, keyPem)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &testCert{cert, key, pair}
+}
+
+func newTestCA(t *testing.T, dir, name string, serial int64) *testCert {
+    return newTestCert(t, dir, name, &x509.Certificate{
+        SerialNumber:          big.NewInt(serial),
+        IsCA:                  true,
+        BasicConstraintsValid: true,
+        KeyUsage:              x509.KeyUsageCertSign,
+    }, nil)
+}
+
+func freeTestPort(t *testing.T) int {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    return l.Addr().(*net.TCPAddr).Port
+}
+
+// tlsPing sends a PING over TLS, the client certificate is rejected either by the handshake
+// or, with TLS 1.3, by the first read after it
+func tlsPing(addr string, config *tls.Config) error {
+    conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", addr, config)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(2 * time.Second))
+    if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+        return err
+    }
+    line, err := bufio.NewReader(conn).ReadString('\n')
+    if err != nil {
+        return err
+    }
+    if line != "+PONG\r\n" {
+        return fmt.Errorf("unexpected reply %q", line)
+    }
+    return nil
+}
+
+func TestTLSAuthClients(t *testing.T) {
+    dir, err := ioutil.TempDir("", "rockdis-tls")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    ca := newTestCA(t, dir, "ca", 1)
+    newTestCert(t, dir, "server", &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }, ca)
+    client := newTestCert(t, dir, "client", &x509.Certificate{
+        SerialNumber: big.NewInt(3),
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+    }, ca)
+    otherCA := newTestCA(t, dir, "other-ca", 4)
+    stranger := newTestCert(t, dir, "stranger", &x509.Certificate{
+        SerialNumber: big.NewInt(5),
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+    }, otherCA)
+
+    roots := x509.NewCertPool()
+    roots.AddCert(ca.cert)
+    clients := map[string]*tls.Config{
+        "none":     &tls.Config{RootCAs: roots},
+        "trusted":  &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client.pair}},
+        // the certificate of an unknown CA is only sent if forced
+        "stranger": &tls.Config{RootCAs: roots, GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+            return &stranger.pair, nil
+        }},
+    }
+
+    tests := []struct {
+        authClients string
+        accepted    map[string]bool
+    }{
+        {"no", map[string]bool{"none": true, "trusted": true, "stranger": true}},
+        {"optional", map[string]bool{"none": true, "trusted": true, "stranger": false}},
+        {"yes", map[string]bool{"none": false, "trusted": true, "stranger": false}},
+    }
+    for _, test := range tests {
+        var config RockdisConfig
+        config.Server.Bind = "127.0.0.1"
+        config.Server.TlsPort = freeTestPort(t)
+        config.Server.TlsCertFile = filepath.Join(dir, "server.crt")
+        config.Server.TlsKeyFile = filepath.Join(dir, "server.key")
+        config.Server.TlsCaCertFile = filepath.Join(dir, "ca.crt")
+        config.Server.TlsAuthClients = test.authClients
+
+        s := NewServer(config)
+        if s.Address != "" {
+            t.Fatalf("TlsAuthClients=%s: the plain listener %s is enabled", test.authClients, s.Address)
+        }
+        s.RegisterHandler(&tlsPinger{})
+        done := make(chan error, 1)
+        go func() {
+            done <- s.ListenAndServe()
+        }()
+        for i := 0; ; i++ {
+            conn, err := net.Dial("tcp", s.TLSAddress)
+            if err == nil {
+                conn.Close()
+                break
+            }
+            if i == 100 {
+                t.Fatalf("TlsAuthClients=%s: %s", test.authClients, err)
+            }
+            time.Sleep(20 * time.Millisecond)
+        }
+
+        for name, accepted := range test.accepted {
+            err := tlsPing(s.TLSAddress, clients[name])
+            if accepted && err != nil {
+                t.Errorf("TlsAuthClients=%s: the %s client is rejected, %s", test.authClients, name, err)
+            } else if !accepted && err == nil {
+                t.Errorf("TlsAuthClients=%s: the %s client is accepted", test.authClients, name)
+            }
+        }
+
+        s.RequestShutdown(false)
+        if err := <-done; err != nil {
+            t.Fatalf("TlsAuthClients=%s: %s", test.authClients, err)
+        }
+    }
+}
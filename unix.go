@@ -0,0 +1,52 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "strconv"
+    "time"
+)
+
+const (
+    kDefaultUnixSocketPerm  = 0700
+    kUnixSocketProbeTimeout = time.Second
+)
+
+// listenUnix binds the unix socket and sets its permissions. A socket file left by a
+// crashed server is removed, but not the one another server is still listening on.
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+    if info, err := os.Lstat(path); err == nil {
+        if info.Mode()&os.ModeSocket == 0 {
+            return nil, fmt.Errorf("%s exists and is not a socket", path)
+        }
+        if conn, err := net.DialTimeout("unix", path, kUnixSocketProbeTimeout); err == nil {
+            conn.Close()
+            return nil, fmt.Errorf("%s is in use by another server", path)
+        }
+        if err := os.Remove(path); err != nil {
+            return nil, fmt.Errorf("failed to remove the stale socket %s, %s", path, err)
+        }
+    }
+    l, err := net.Listen("unix", path)
+    if err != nil {
+        return nil, err
+    }
+    if err := os.Chmod(path, perm); err != nil {
+        l.Close()
+        return nil, err
+    }
+    return l, nil
+}
+
+// parseUnixSocketPerm parses the octal permissions like 770, 0700 by default
+func parseUnixSocketPerm(perm string) (os.FileMode, error) {
+    if perm == "" {
+        return kDefaultUnixSocketPerm, nil
+    }
+    mode, err := strconv.ParseUint(perm, 8, 32)
+    if err != nil || mode > 0777 {
+        return 0, fmt.Errorf("UnixSocketPerm should be octal permissions like 770")
+    }
+    return os.FileMode(mode), nil
+}
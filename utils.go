@@ -9,6 +9,7 @@ import (
     "strconv"
     "strings"
     "sync/atomic"
+    "time"
 )
 
 func encode(value interface{}) ([]byte, error) {
@@ -32,6 +33,17 @@ func decode(data []byte, vType reflect.Type) (interface{}, error) {
     return reflect.Indirect(v).Interface(), nil
 }
 
+// __emptyBytes replaces the nil values in place, gob decodes an empty slice to nil but
+// it is an empty bulk for the clients, not a null one
+func __emptyBytes(values [][]byte) [][]byte {
+    for i := range values {
+        if values[i] == nil {
+            values[i] = []byte{}
+        }
+    }
+    return values
+}
+
 func parseComputerSize(size string) (int, error) {
     oneKBytes := 1 << 10
     oneMBytes := 1 << 20
@@ -54,10 +66,117 @@ func parseComputerSize(size string) (int, error) {
     return 0, fmt.Errorf("[Config] Format error")
 }
 
+// parseSizeLimit parses a limit like 32m or in bytes, empty for the default
+func parseSizeLimit(value string, defaultLimit int64) (int64, error) {
+    if value == "" {
+        return defaultLimit, nil
+    }
+    if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+        if n < 0 {
+            return 0, fmt.Errorf("[Config] Format error")
+        }
+        return n, nil
+    }
+    size, err := parseComputerSize(value)
+    return int64(size), err
+}
+
+// parseTimeout parses the timeout of the blocking commands in seconds, e.g. "0.5"
+func parseTimeout(data []byte) (time.Duration, error) {
+    seconds, err := strconv.ParseFloat(string(data), 64)
+    if err != nil {
+        return 0, ErrNotTimeout
+    }
+    if seconds < 0 {
+        return 0, ErrNegativeTimeout
+    }
+    return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// globMatch matches the string with a glob-style pattern like redis does,
+// supports *, ?, [abc], [^a-z] and the \ escape.
+func globMatch(pattern, str []byte) bool {
+    for len(pattern) > 0 {
+        switch pattern[0] {
+        case '*':
+            for len(pattern) > 1 && pattern[1] == '*' {
+                pattern = pattern[1:]
+            }
+            if len(pattern) == 1 {
+                return true
+            }
+            for i := 0; i <= len(str); i++ {
+                if globMatch(pattern[1:], str[i:]) {
+                    return true
+                }
+            }
+            return false
+        case '?':
+            if len(str) == 0 {
+                return false
+            }
+            str = str[1:]
+        case '[':
+            if len(str) == 0 {
+                return false
+            }
+            pattern = pattern[1:]
+            not := len(pattern) > 0 && pattern[0] == '^'
+            if not {
+                pattern = pattern[1:]
+            }
+            match := false
+            for len(pattern) > 0 && pattern[0] != ']' {
+                if pattern[0] == '\\' && len(pattern) > 1 {
+                    pattern = pattern[1:]
+                    if pattern[0] == str[0] {
+                        match = true
+                    }
+                } else if len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']' {
+                    start, end := pattern[0], pattern[2]
+                    if start > end {
+                        start, end = end, start
+                    }
+                    if str[0] >= start && str[0] <= end {
+                        match = true
+                    }
+                    pattern = pattern[2:]
+                } else if pattern[0] == str[0] {
+                    match = true
+                }
+                pattern = pattern[1:]
+            }
+            if len(pattern) == 0 {
+                // unterminated class, the last char has been consumed
+                return false
+            }
+            if not {
+                match = !match
+            }
+            if !match {
+                return false
+            }
+            str = str[1:]
+        case '\\':
+            if len(pattern) > 1 {
+                pattern = pattern[1:]
+            }
+            fallthrough
+        default:
+            if len(str) == 0 || pattern[0] != str[0] {
+                return false
+            }
+            str = str[1:]
+        }
+        pattern = pattern[1:]
+    }
+    return len(str) == 0
+}
+
 type AtomicInt int64
 
-func (i *AtomicInt) Add(n int64) {
-    atomic.AddInt64((*int64)(i), n)
+func (i *AtomicInt) Add(n int64) int64 {
+    return atomic.AddInt64((*int64)(i), n)
 }
 
 func (i *AtomicInt) Set(n int64) {